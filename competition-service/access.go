@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"shared/events"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// maxOrganizationLength matches the organization column in user-service.
+const maxOrganizationLength = 100
+
+// canView reports whether user may see a competition. Public and unlisted
+// competitions are open to everyone, anonymous callers included. A private
+// one is open to administrators, its organizers, the users and organizations
+// on its allowlist, and anyone already registered, so that participants keep
+// access when the allowlist changes. user is nil for anonymous requests.
+func canView(user *auth.Claims, competitionID int, visibility string) (bool, error) {
+	if visibility != visibilityPrivate {
+		return true, nil
+	}
+	if user == nil {
+		return false, nil
+	}
+	if user.HasRole(auth.RoleAdmin) {
+		return true, nil
+	}
+
+	var allowed bool
+	query := `SELECT EXISTS (SELECT 1 FROM competition_organizers WHERE competition_id = $1 AND user_id = $2)
+		OR EXISTS (SELECT 1 FROM competition_allowlist WHERE competition_id = $1 AND (user_id = $2 OR organization = NULLIF($3, '')))
+		OR EXISTS (SELECT 1 FROM competition_registrations WHERE competition_id = $1 AND user_id = $2)`
+	err := dbPool.QueryRow(ctx, query, competitionID, user.UserID(), user.Organization).Scan(&allowed)
+	return allowed, err
+}
+
+// membersNotAllowed returns the joined members of a team, other than the
+// registering captain, who may not enter a private competition: those who
+// are neither organizers nor on its allowlist by user ID or by the
+// organization they had when they joined.
+func membersNotAllowed(db querier, competitionID int, teamID int, captainID int) ([]int, error) {
+	query := `SELECT m.user_id FROM team_members m
+		WHERE m.team_id = $2 AND m.joined_at IS NOT NULL AND m.user_id <> $3
+			AND NOT EXISTS (SELECT 1 FROM competition_organizers o WHERE o.competition_id = $1 AND o.user_id = m.user_id)
+			AND NOT EXISTS (SELECT 1 FROM competition_allowlist a WHERE a.competition_id = $1 AND (a.user_id = m.user_id OR a.organization = m.organization))
+		ORDER BY m.user_id`
+	rows, err := db.Query(ctx, query, competitionID, teamID, captainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	excluded := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		excluded = append(excluded, userID)
+	}
+
+	return excluded, rows.Err()
+}
+
+// requireAccess answers the request when the caller may not see the
+// competition, reporting whether the handler may go on. Private competitions
+// answer 404 rather than 403 so that they do not reveal they exist.
+func requireAccess(c *gin.Context, competitionID int, visibility string) bool {
+	user, _ := auth.User(c)
+	allowed, err := canView(user, competitionID, visibility)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return false
+	}
+
+	if !allowed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return false
+	}
+
+	return true
+}
+
+// cacheControlFor keeps shared caches from storing anything about a
+// competition that is not public.
+func cacheControlFor(visibility string, public string) string {
+	if visibility == visibilityPublic {
+		return public
+	}
+
+	return conditional.Private
+}
+
+// publishAccess tells leaderboard-service, through the outbox, who may see
+// the competition as of tx. Every change to the visibility, the organizers or
+// the allowlist publishes the whole list again, under the next access
+// version. Bumping the version locks the competition until tx ends, so
+// versions follow the order in which the changes commit.
+func publishAccess(tx pgx.Tx, competitionID int) error {
+	var visibility string
+	var accessVersion int
+	query := `UPDATE competitions SET access_version = access_version + 1 WHERE id = $1 RETURNING visibility, access_version`
+	if err := tx.QueryRow(ctx, query, competitionID).Scan(&visibility, &accessVersion); err != nil {
+		return err
+	}
+
+	event := events.CompetitionAccessChangedEvent{
+		CompetitionID: competitionID,
+		AccessVersion: accessVersion,
+		Visibility:    visibility,
+		UserIDs:       []int{},
+		Organizations: []string{},
+	}
+
+	rows, err := tx.Query(ctx, `SELECT user_id FROM competition_organizers WHERE competition_id = $1
+		UNION SELECT user_id FROM competition_allowlist WHERE competition_id = $1 AND user_id IS NOT NULL
+		ORDER BY 1`, competitionID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		event.UserIDs = append(event.UserIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT organization FROM competition_allowlist WHERE competition_id = $1 AND organization IS NOT NULL ORDER BY 1`, competitionID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var organization string
+		if err := rows.Scan(&organization); err != nil {
+			rows.Close()
+			return err
+		}
+		event.Organizations = append(event.Organizations, organization)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	payload, version, err := events.Marshal(events.CompetitionAccessChanged, event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.CompetitionAccessChanged, version, payload)
+	return err
+}
+
+const allowlistColumns = `id, competition_id, user_id, COALESCE(organization, ''), added_by, invite_id, created_at`
+
+func scanAllowlistEntry(row rowScanner, entry *AllowlistEntry) error {
+	return row.Scan(&entry.ID, &entry.CompetitionID, &entry.UserID, &entry.Organization, &entry.AddedBy, &entry.InviteID, &entry.CreatedAt)
+}
+
+func getAllowlist(c *gin.Context) {
+	rows, err := dbPool.Query(ctx, `SELECT `+allowlistColumns+` FROM competition_allowlist WHERE competition_id = $1 ORDER BY id`, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch allowlist"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []AllowlistEntry{}
+	for rows.Next() {
+		var entry AllowlistEntry
+		if err := scanAllowlistEntry(rows, &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	conditional.JSON(c, entries, time.Time{}, conditional.Private)
+}
+
+// addToAllowlist allows one user, given as user_id, or every member of an
+// organization, given as organization, into the competition.
+func addToAllowlist(c *gin.Context) {
+	var request struct {
+		UserID       *int   `json:"user_id"`
+		Organization string `json:"organization"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.Organization = strings.TrimSpace(request.Organization)
+	switch {
+	case (request.UserID == nil) == (request.Organization == ""):
+		respondWithFieldErrors(c, []fieldError{{Field: "user_id", Message: "exactly one of user_id and organization is required"}})
+		return
+	case request.UserID != nil && *request.UserID <= 0:
+		respondWithFieldErrors(c, []fieldError{{Field: "user_id", Message: "must be a positive user ID"}})
+		return
+	case utf8.RuneCountInString(request.Organization) > maxOrganizationLength:
+		respondWithFieldErrors(c, []fieldError{{Field: "organization", Message: "must be at most 100 characters"}})
+		return
+	}
+
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+	user, _ := auth.User(c)
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var organization *string
+	if request.Organization != "" {
+		organization = &request.Organization
+	}
+
+	var entry AllowlistEntry
+	query := `INSERT INTO competition_allowlist (competition_id, user_id, organization, added_by) VALUES ($1, $2, $3, $4) RETURNING ` + allowlistColumns
+	err = scanAllowlistEntry(tx.QueryRow(ctx, query, competitionID, request.UserID, organization, user.UserID()), &entry)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Already on the allowlist"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update allowlist"})
+		return
+	}
+
+	if err := publishAccess(tx, competitionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+// removeUserFromAllowlist takes a user off the allowlist. A user who already
+// registered keeps access to the competition.
+func removeUserFromAllowlist(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	removeFromAllowlist(c, `DELETE FROM competition_allowlist WHERE competition_id = $1 AND user_id = $2`, userID)
+}
+
+func removeOrganizationFromAllowlist(c *gin.Context) {
+	removeFromAllowlist(c, `DELETE FROM competition_allowlist WHERE competition_id = $1 AND organization = $2`, c.Param("organization"))
+}
+
+func removeFromAllowlist(c *gin.Context, query string, subject interface{}) {
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, query, competitionID, subject)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update allowlist"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not on the allowlist"})
+		return
+	}
+
+	if err := publishAccess(tx, competitionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	user, _ := auth.User(c)
+	log.Printf("User %d removed %v from the allowlist of competition %d\n", user.UserID(), subject, competitionID)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"shared/auth"
+	"shared/conditional"
+	"testing"
+	"time"
+)
+
+// TestCanView covers the decisions made without the database: only private
+// competitions look up organizers and the allowlist.
+func TestCanView(t *testing.T) {
+	admin := &auth.Claims{Roles: []string{auth.RoleAdmin}}
+
+	tests := []struct {
+		name       string
+		user       *auth.Claims
+		visibility string
+		want       bool
+	}{
+		{"public, anonymous", nil, visibilityPublic, true},
+		{"unlisted, anonymous", nil, visibilityUnlisted, true},
+		{"public, user", &auth.Claims{}, visibilityPublic, true},
+		{"private, anonymous", nil, visibilityPrivate, false},
+		{"private, administrator", admin, visibilityPrivate, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := canView(test.user, 1, test.visibility)
+			if err != nil {
+				t.Fatalf("canView() error = %v", err)
+			}
+			if allowed != test.want {
+				t.Errorf("canView() = %v, want %v", allowed, test.want)
+			}
+		})
+	}
+}
+
+func TestCacheControlFor(t *testing.T) {
+	public := conditional.Public(time.Minute)
+
+	tests := []struct {
+		visibility string
+		want       string
+	}{
+		{visibilityPublic, public},
+		{visibilityUnlisted, conditional.Private},
+		{visibilityPrivate, conditional.Private},
+	}
+
+	for _, test := range tests {
+		t.Run(test.visibility, func(t *testing.T) {
+			if got := cacheControlFor(test.visibility, public); got != test.want {
+				t.Errorf("cacheControlFor(%s) = %s, want %s", test.visibility, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"shared/events"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Cached competitions and problems are keyed by a generation number kept in
+// cache_gen:<kind>:<id>. Invalidating an entity bumps its generation instead
+// of deleting keys, so a fill that read the old row before the change and
+// writes after it lands under a key nobody reads any more. Orphaned entries
+// simply expire.
+//
+// A generation must outlive every entry written under it, otherwise it would
+// restart at zero while old zero-generation entries still exist.
+const generationTTL = 2 * problemStaleTTL
+
+const competitionCacheTTL = 10 * time.Minute
+
+// Concurrent misses for the same key share one database query or upstream
+// request instead of stampeding when a popular entry expires or is purged.
+var (
+	competitionFills singleflight.Group
+	problemFills     singleflight.Group
+)
+
+func generationKey(kind string, id int) string {
+	return fmt.Sprintf("cache_gen:%s:%d", kind, id)
+}
+
+// cacheGenerations returns the current generation of each ID, treating
+// missing counters and Redis errors as generation zero.
+func cacheGenerations(kind string, ids []int) map[int]int64 {
+	generations := make(map[int]int64, len(ids))
+	if len(ids) == 0 {
+		return generations
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = generationKey(kind, id)
+	}
+
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("Failed to read %s cache generations: %v", kind, err)
+		return generations
+	}
+
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			generations[ids[i]], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+
+	return generations
+}
+
+func bumpGeneration(kind string, id int) error {
+	key := generationKey(kind, id)
+
+	pipe := rdb.TxPipeline()
+	pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, generationTTL)
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+func competitionCacheKey(id int, generation int64) string {
+	return fmt.Sprintf("competition:%d:v%d", id, generation)
+}
+
+func problemCacheKey(id int, generation int64) string {
+	return fmt.Sprintf("problem:%d:v%d", id, generation)
+}
+
+func problemStaleKey(id int, generation int64) string {
+	return fmt.Sprintf("problem_stale:%d:v%d", id, generation)
+}
+
+func cachedCompetition(key string) (Competition, bool) {
+	var competition Competition
+
+	val, err := rdb.Get(ctx, key).Result()
+	if err != nil || val == "" {
+		return competition, false
+	}
+
+	if err := json.Unmarshal([]byte(val), &competition); err != nil {
+		return competition, false
+	}
+
+	return competition, true
+}
+
+func cacheCompetition(key string, competition Competition) {
+	body, err := json.Marshal(competition)
+	if err != nil {
+		return
+	}
+
+	rdb.Set(ctx, key, body, competitionCacheTTL)
+}
+
+// handleCacheInvalidation purges whatever an invalidation event refers to.
+func handleCacheInvalidation(eventType string, payload []byte) error {
+	switch eventType {
+	case events.ProblemUpdated:
+		var event events.ProblemUpdatedEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		return bumpGeneration("problem", event.ProblemID)
+	case events.ProblemDeleted:
+		var event events.ProblemDeletedEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		return bumpGeneration("problem", event.ProblemID)
+	case events.CompetitionDeleted:
+		var event events.CompetitionDeletedEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return err
+		}
+		return bumpGeneration("competition", event.CompetitionID)
+	}
+
+	return fmt.Errorf("not a cache invalidation event: %s", eventType)
+}
@@ -1,118 +1,245 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"shared/breaker"
+	"shared/httpclient"
+	"strconv"
+	"strings"
 	"time"
+)
+
+const (
+	// problemCacheTTL is how long a cached problem is served without asking
+	// the problem service again.
+	problemCacheTTL = 10 * time.Minute
+	// problemStaleTTL is how long a copy is kept for serving when the problem
+	// service cannot answer.
+	problemStaleTTL = 24 * time.Hour
+	// revalidateLockTTL stops concurrent requests from queueing the same
+	// refresh more than once.
+	revalidateLockTTL = time.Minute
+)
 
-	"github.com/sony/gobreaker"
+var (
+	breakers      *breaker.Registry
+	problemClient *httpclient.Client
 )
 
-var cb *gobreaker.CircuitBreaker
-var breakerState string
+// problemServiceAPIKey is the service credential competition-service presents
+// to problem-management-service; it must be listed in its SERVICE_API_KEYS.
+var problemServiceAPIKey = os.Getenv("PROBLEM_SERVICE_API_KEY")
+
+// errOutgoingLimited means we held a request back because of an earlier
+// Retry-After from the upstream.
+var errOutgoingLimited = errors.New("outgoing request rate limited")
 
 func initCircuitBreaker() {
-	settings := gobreaker.Settings{
-		Name:        "ProblemManagementCircuitBreaker",
-		Timeout:     5 * time.Second,
-		MaxRequests: 5,
-		Interval:    60 * time.Second,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > 3
-		},
-		OnStateChange: func(name string, from, to gobreaker.State) {
-			switch to {
-			case gobreaker.StateOpen:
-				breakerState = "open"
-			case gobreaker.StateHalfOpen:
-				breakerState = "half-open"
-			case gobreaker.StateClosed:
-				breakerState = "closed"
-			}
-		},
-	}
-	cb = gobreaker.NewCircuitBreaker(settings)
+	breakers = breaker.NewRegistry(breaker.Config{
+		Timeout:             5 * time.Second,
+		MaxRequests:         5,
+		Interval:            60 * time.Second,
+		ConsecutiveFailures: 3,
+		// Rate limits and client errors mean the upstream is healthy, so they
+		// must not trip the breaker.
+		IsSuccessful: httpclient.IsSuccessful,
+	})
+
+	problemClient = httpclient.New(httpclient.Config{
+		Service:      "problem_management",
+		BaseURLs:     httpclient.Discover("problem_management", "http://problem_management:8080"),
+		Header:       http.Header{"Authorization": {"Bearer " + problemServiceAPIKey}},
+		Timeout:      2 * time.Second,
+		MaxAttempts:  3,
+		RetryBackoff: 100 * time.Millisecond,
+		HedgeDelay:   500 * time.Millisecond,
+		Breakers:     breakers,
+		Limiter:      outgoingLimiter,
+	})
 }
 
-func fetchProblem(problemID int, serviceName string) (map[string]interface{}, error) {
-	cacheKey := fmt.Sprintf("problem:%d", problemID)
+// errProblemNotFound is reported for IDs the problem service does not know.
+var errProblemNotFound = errors.New("problem not found")
+
+// problemBatch is the response of GET /problems?ids=.
+type problemBatch struct {
+	Data    []Problem `json:"data"`
+	Missing []int     `json:"missing"`
+}
 
-	log.Printf("breakerState %s", breakerState)
+type problemFetch struct {
+	Problems map[int]Problem
+	// Missing are IDs the problem service reported as not existing.
+	Missing []int
+	// Stale are IDs served from an expired copy because the problem service
+	// could not answer; a refresh has been queued for them.
+	Stale []int
+}
 
-	if breakerState == "open" {
-		val, err := rdb.Get(ctx, cacheKey).Result()
-		if err == nil && val != "" {
-			var cachedProblem map[string]interface{}
-			json.Unmarshal([]byte(val), &cachedProblem)
-			return cachedProblem, nil
+// fetchProblems resolves a set of problems. Each problem is looked up in the
+// cache first and the misses are fetched with a single request, so a whole
+// problem set costs one token of the outgoing budget.
+//
+// When the problem service cannot answer for any reason, expired copies are
+// served instead (stale-while-revalidate). Problems without one are queued
+// under ticketID if the failure was rate limiting, and errRequestQueued is
+// returned along with everything that could be resolved.
+func fetchProblems(ctx context.Context, problemIDs []int, serviceName string, ticketID string) (problemFetch, error) {
+	result := problemFetch{Problems: make(map[int]Problem, len(problemIDs))}
+	generations := cacheGenerations("problem", problemIDs)
+	var misses []int
+
+	for _, problemID := range problemIDs {
+		if _, ok := result.Problems[problemID]; ok {
+			continue
 		}
+
+		if problem, ok := cachedProblem(problemCacheKey(problemID, generations[problemID])); ok {
+			result.Problems[problemID] = problem
+			continue
+		}
+		misses = append(misses, problemID)
+	}
+
+	if len(misses) == 0 {
+		return result, nil
 	}
 
-	log.Printf("rateLimiter problem ID %d", problemID)
+	batch, err := requestProblemsOnce(ctx, misses, serviceName)
+	if err == nil {
+		for _, problem := range batch.Data {
+			result.Problems[problem.ID] = problem
+			cacheProblem(problem, generations[problem.ID])
+		}
+		result.Missing = batch.Missing
 
-	canSend, err := rateLimiter(serviceName, false)
+		return result, nil
+	}
 
-	log.Printf("rateLimiter problem ID %d after", problemID)
+	log.Printf("Failed to fetch problems %v, serving stale copies: %v", misses, err)
 
-	if err != nil {
-		log.Printf("Error checking rate limit: %v", err)
-		return nil, fmt.Errorf("internal server error")
+	var unresolved []int
+	for _, problemID := range misses {
+		if problem, ok := cachedProblem(problemStaleKey(problemID, generations[problemID])); ok {
+			result.Problems[problemID] = problem
+			result.Stale = append(result.Stale, problemID)
+			continue
+		}
+		unresolved = append(unresolved, problemID)
 	}
 
-	if !canSend {
-		request := fmt.Sprintf("problem_id:%d", problemID)
+	var rateLimited *httpclient.RateLimitedError
+	if !errors.Is(err, errOutgoingLimited) && !errors.As(err, &rateLimited) {
+		// The breaker or the upstream failed; the next request retries.
+		if len(unresolved) == 0 {
+			return result, nil
+		}
+		if breaker.IsOpenError(err) {
+			return result, fmt.Errorf("service unavailable and no cached data found")
+		}
+		return result, err
+	}
 
-		if err := enqueueRequest(serviceName, request); err != nil {
-			log.Printf("Error enqueuing request: %v", err)
-			return nil, fmt.Errorf("rate limit exceeded and failed to queue request")
+	if len(unresolved) == 0 {
+		if revalidate := lockRevalidation(result.Stale); len(revalidate) > 0 {
+			if err := queueProblemRequest(serviceName, queuedRequest{ProblemIDs: revalidate}); !errors.Is(err, errRequestQueued) {
+				log.Printf("Error queueing revalidation of problems %v: %v", revalidate, err)
+			}
 		}
+		return result, nil
+	}
 
-		return nil, fmt.Errorf("rate limit exceeded, request queued")
+	// The ticket also receives fresh copies of the stale problems.
+	return result, queueProblemRequest(serviceName, queuedRequest{ProblemIDs: misses, TicketID: ticketID})
+}
+
+// requestProblemsOnce shares one request among concurrent callers asking for
+// the same problems. The request is detached from the first caller's context
+// so that one client going away does not fail the others; problemClient's
+// timeouts still bound it.
+func requestProblemsOnce(ctx context.Context, problemIDs []int, serviceName string) (*problemBatch, error) {
+	batch, err, _ := problemFills.Do(fmt.Sprint(problemIDs), func() (interface{}, error) {
+		return requestProblems(context.WithoutCancel(ctx), problemIDs, serviceName)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	problemData, err := cb.Execute(func() (interface{}, error) {
-		url := fmt.Sprintf("http://problem_management:8080/problems/%d", problemID)
-		req, err := http.NewRequest("GET", url, nil)
+	return batch.(*problemBatch), nil
+}
 
-		req.Header.Set("X-Client-ID", "123")
+// requestProblems fetches problems from the problem service, respecting any
+// Retry-After it sent earlier; problemClient enforces our outgoing budget.
+func requestProblems(ctx context.Context, problemIDs []int, serviceName string) (*problemBatch, error) {
+	if upstreamBackoff(serviceName) > 0 {
+		return nil, errOutgoingLimited
+	}
 
-		resp, err := http.DefaultClient.Do(req)
+	ids := make([]string, len(problemIDs))
+	for i, problemID := range problemIDs {
+		ids[i] = strconv.Itoa(problemID)
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	var batch problemBatch
+	err := problemClient.Get(ctx, "/problems", url.Values{"ids": {strings.Join(ids, ",")}}, &batch)
 
-		defer resp.Body.Close()
+	var rateLimited *httpclient.RateLimitedError
+	if errors.As(err, &rateLimited) && rateLimited.Upstream {
+		log.Printf("Problem service rate limited us, backing off for %v", rateLimited.RetryAfter)
+		setUpstreamBackoff(serviceName, rateLimited.RetryAfter)
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("failed to fetch problem: %s", resp.Status)
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
+	return &batch, nil
+}
 
-		var problem map[string]interface{}
-		if err := json.Unmarshal(body, &problem); err != nil {
-			return nil, err
-		}
+func cachedProblem(key string) (Problem, bool) {
+	var problem Problem
+
+	val, err := rdb.Get(ctx, key).Result()
+	if err != nil || val == "" {
+		return problem, false
+	}
 
-		rdb.Set(ctx, cacheKey, body, 10*time.Minute)
+	if err := json.Unmarshal([]byte(val), &problem); err != nil {
+		return problem, false
+	}
 
-		return problem, nil
-	})
+	return problem, true
+}
 
+// cacheProblem stores problem under the generation that was current before it
+// was fetched; see cache.go.
+func cacheProblem(problem Problem, generation int64) {
+	body, err := json.Marshal(problem)
 	if err != nil {
-		if breakerState == "closed" {
-			return nil, err
-		}
+		return
+	}
 
-		return nil, fmt.Errorf("service unavailable and no cached data found")
+	rdb.Set(ctx, problemCacheKey(problem.ID, generation), body, problemCacheTTL)
+	rdb.Set(ctx, problemStaleKey(problem.ID, generation), body, problemStaleTTL)
+	rdb.Del(ctx, fmt.Sprintf("problem_revalidating:%d", problem.ID))
+}
+
+// lockRevalidation returns the problems no other request is already refreshing.
+func lockRevalidation(problemIDs []int) []int {
+	var locked []int
+	for _, problemID := range problemIDs {
+		ok, err := rdb.SetNX(ctx, fmt.Sprintf("problem_revalidating:%d", problemID), 1, revalidateLockTTL).Result()
+		if err == nil && ok {
+			locked = append(locked, problemID)
+		}
 	}
 
-	return problemData.(map[string]interface{}), nil
+	return locked
 }
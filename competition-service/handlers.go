@@ -1,29 +1,72 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/lib/pq"
 	"log"
 	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"shared/events"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
+// Cache-Control policies. Competitions are the same for every caller;
+// registrations change constantly while a competition fills up.
+var (
+	competitionCacheControl = conditional.Public(30 * time.Second)
+	listCacheControl        = conditional.Public(10 * time.Second)
+	problemsCacheControl    = conditional.Public(time.Minute)
+)
+
+// createCompetition accepts the problem set either as problems, with labels,
+// points and limits, or as plain problem_ids that get default settings.
 func createCompetition(c *gin.Context) {
 	var competition struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		ProblemIDs  []int  `json:"problem_ids"`
-		ID          int    `json:"id"`
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		Problems    []problemSpec `json:"problems"`
+		ProblemIDs  []int         `json:"problem_ids"`
+		StartsAt    *time.Time    `json:"starts_at"`
+		EndsAt      *time.Time    `json:"ends_at"`
+		MaxTeamSize *int          `json:"max_team_size"`
+		Visibility  string        `json:"visibility"`
+		ID          int           `json:"id"`
 	}
 	if err := c.ShouldBindJSON(&competition); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
+	problemSet := resolveProblemSet(competition.Problems, competition.ProblemIDs)
+	if competition.Visibility == "" {
+		competition.Visibility = visibilityPublic
+	}
+
+	errs := validateName(competition.Name)
+	errs = append(errs, validateDescription(competition.Description)...)
+	errs = append(errs, validateProblemSet(problemSet)...)
+	errs = append(errs, validateTeamSize(competition.MaxTeamSize)...)
+	errs = append(errs, validateVisibility(competition.Visibility)...)
+	if !validSchedule(competition.StartsAt, competition.EndsAt) {
+		errs = append(errs, fieldError{Field: "ends_at", Message: "must be after starts_at"})
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(c, errs)
+		return
+	}
+
+	if !checkProblems(c, problemSet) {
+		return
+	}
+
 	tx, err := dbPool.Begin(ctx)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to begin transaction"})
@@ -31,28 +74,56 @@ func createCompetition(c *gin.Context) {
 	}
 	defer tx.Rollback(ctx)
 
-	query := `INSERT INTO competitions (name, description, problem_ids, created_at, updated_at) VALUES ($1, $2, $3, NOW(), NOW()) RETURNING id`
-	err = tx.QueryRow(ctx, query, competition.Name, competition.Description, pq.Array(competition.ProblemIDs)).Scan(&competition.ID)
+	user, _ := auth.User(c)
+
+	query := `INSERT INTO competitions (name, description, created_by, starts_at, ends_at, max_team_size, visibility, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW()) RETURNING id`
+	err = tx.QueryRow(ctx, query, competition.Name, competition.Description, user.UserID(), competition.StartsAt, competition.EndsAt, competition.MaxTeamSize, competition.Visibility).Scan(&competition.ID)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create competition"})
 		return
 	}
 
-	eventPayload := map[string]interface{}{
-		"id":          competition.ID,
-		"name":        competition.Name,
-		"description": competition.Description,
-		"problem_ids": competition.ProblemIDs,
+	if err := saveProblemSet(tx, competition.ID, problemSet); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save problem set"})
+		return
+	}
+
+	payload, version, err := events.Marshal(events.CompetitionCreated, events.CompetitionCreatedEvent{
+		CompetitionID: competition.ID,
+		Name:          competition.Name,
+		Description:   competition.Description,
+		ProblemIDs:    problemIDsOf(problemSet),
+		StartsAt:      competition.StartsAt,
+		EndsAt:        competition.EndsAt,
+		Visibility:    competition.Visibility,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.CompetitionCreated, err)
+		c.JSON(500, gin.H{"error": "Failed to encode event"})
+		return
 	}
-	payload, _ := json.Marshal(eventPayload)
 	eventID := uuid.New().String()
 
-	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, payload) VALUES ($1, $2, $3)`, eventID, "competition_created", payload)
+	_, err = tx.Exec(ctx, `INSERT INTO competition_organizers (competition_id, user_id) VALUES ($1, $2)`, competition.ID, user.UserID())
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to record organizer"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, eventID, events.CompetitionCreated, version, payload)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to write to outbox"})
 		return
 	}
 
+	// Leaderboard-service needs the organizers to show them a private
+	// leaderboard. The outbox publishes in order, so this follows the
+	// competition_created event that creates the leaderboard.
+	if err := publishAccess(tx, competition.ID); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		c.JSON(500, gin.H{"error": "Failed to commit transaction"})
 		return
@@ -63,90 +134,623 @@ func createCompetition(c *gin.Context) {
 	c.JSON(201, gin.H{"competition_id": competition.ID})
 }
 
+// getCompetitionProblems returns the problem set of a competition in display
+// order, each entry with its problem. The answer is 200 only when every
+// problem was resolved: problems that no longer exist or could not be fetched
+// are listed by ID and make it 206, or 503 when nothing could be fetched.
+// When some fetches are queued because of rate limiting, it answers 202 with
+// the problems fetched so far and a ticket to poll for the rest.
 func getCompetitionProblems(c *gin.Context) {
 	id := c.Param("id")
-	var problemIDs []int
+	var competitionID int
+	var visibility string
 
-	query := `SELECT problem_ids FROM competitions WHERE id = $1`
-	err := dbPool.QueryRow(ctx, query, id).Scan(&problemIDs)
+	err := dbPool.QueryRow(ctx, `SELECT id, visibility FROM competitions WHERE id = $1`, id).Scan(&competitionID, &visibility)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
 		return
 	}
 
-	var problems []map[string]interface{}
+	if !requireAccess(c, competitionID, visibility) {
+		return
+	}
+
+	sets, err := loadProblemSets(dbPool, []int{competitionID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch problem set"})
+		return
+	}
+	problemSet := sets[competitionID]
+	problemIDs := problemIDsOf(problemSet)
+
 	serviceName := "problem_management"
+	ticketID := uuid.New().String()
 
-	for _, problemID := range problemIDs {
-		problem, err := fetchProblem(problemID, serviceName)
+	result, err := fetchProblems(c.Request.Context(), problemIDs, serviceName, ticketID)
+	queued := errors.Is(err, errRequestQueued)
+	if err != nil && !queued {
+		log.Printf("Error fetching problems for competition %d: %v", competitionID, err)
+	}
+	if queued {
+		log.Printf("Problems of competition %d queued due to rate limiting", competitionID)
+	}
 
-		if err != nil {
-			if err.Error() == "rate limit exceeded, request queued" {
-				problem = map[string]interface{}{
-					"error": fmt.Sprintf("Problem ID %d request queued due to rate limiting", problemID),
-				}
+	missing := make(map[int]bool, len(result.Missing))
+	failed := make(map[int]string, len(result.Missing))
+	for _, problemID := range result.Missing {
+		missing[problemID] = true
+		failed[problemID] = errProblemNotFound.Error()
+	}
 
-				log.Printf("Problem ID %d request queued due to rate limiting", problemID)
-				continue
-			}
+	list := ProblemList{CompetitionID: competitionID, Problems: []CompetitionProblem{}, MissingIDs: []int{}, FailedIDs: []int{}}
+	for _, entry := range problemSet {
+		problem, ok := result.Problems[entry.ProblemID]
+		switch {
+		case ok:
+			entry.Problem = &problem
+			list.Problems = append(list.Problems, entry)
+		case missing[entry.ProblemID]:
+			list.MissingIDs = append(list.MissingIDs, entry.ProblemID)
+		default:
+			list.FailedIDs = append(list.FailedIDs, entry.ProblemID)
+		}
+	}
 
-			log.Printf("Error fetching problem ID %d: %v", problemID, err)
+	if !queued {
+		// No cache may keep a partial or stale answer, or clients would go
+		// on seeing it after the problem service recovers.
+		if len(result.Stale) > 0 {
+			c.Header("Warning", `110 - "Response is Stale"`)
+		}
+		switch {
+		case len(list.Problems) == 0 && len(list.FailedIDs) > 0:
+			c.Header("Cache-Control", conditional.NoStore)
+			c.JSON(http.StatusServiceUnavailable, list)
+			return
+		case len(list.MissingIDs) > 0 || len(list.FailedIDs) > 0:
+			c.Header("Cache-Control", conditional.NoStore)
+			c.JSON(http.StatusPartialContent, list)
+			return
+		}
 
-			continue
+		cacheControl := cacheControlFor(visibility, problemsCacheControl)
+		if len(result.Stale) > 0 {
+			cacheControl = conditional.NoStore
 		}
-		problems = append(problems, problem)
+		conditional.JSON(c, list, time.Time{}, cacheControl)
+		return
+	}
+
+	if err := createTicket(ticketID, competitionID, problemSet, result.Problems, failed); err != nil {
+		log.Printf("Error creating ticket %s: %v", ticketID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Problems are rate limited, try again later"})
+		return
 	}
 
-	c.JSON(http.StatusOK, problems)
+	respondWithTicket(c, ticketID)
 }
 
-func getCompetition(c *gin.Context) {
-	id := c.Param("id")
+// getProblemTicket returns the problems collected by a ticket: 200 once every
+// problem has been fetched or given up on, 202 while some are still queued.
+// Ticket IDs are not secret enough to stand in for access to a private
+// competition, so the caller must still be able to see it.
+func getProblemTicket(c *gin.Context) {
+	var competitionID int
+	var visibility string
 
-	cacheKey := fmt.Sprintf("competition:%s", id)
-	cachedCompetition, err := rdb.Get(ctx, cacheKey).Result()
-	if err == nil && cachedCompetition != "" {
-		var competition Competition
-		if err := json.Unmarshal([]byte(cachedCompetition), &competition); err == nil {
-			c.JSON(http.StatusOK, competition)
-			return
-		}
+	err := dbPool.QueryRow(ctx, `SELECT id, visibility FROM competitions WHERE id = $1`, c.Param("id")).Scan(&competitionID, &visibility)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
 	}
 
-	var competition Competition
-	query := `SELECT id, name, description, problem_ids, created_at, updated_at FROM competitions WHERE id = $1`
-	err = dbPool.QueryRow(ctx, query, id).Scan(
-		&competition.ID, &competition.Name, &competition.Description,
-		pq.Array(&competition.ProblemIDs), &competition.CreatedAt, &competition.UpdatedAt,
-	)
+	if !requireAccess(c, competitionID, visibility) {
+		return
+	}
+
+	respondWithTicket(c, c.Param("ticket"))
+}
+
+func respondWithTicket(c *gin.Context, ticketID string) {
+	ticket, err := loadTicket(ticketID)
+	if err == redis.Nil || (err == nil && strconv.Itoa(ticket.CompetitionID) != c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ticket"})
+		return
+	}
+
+	// A ticket changes until it completes and may hold failures, so it is
+	// never cached.
+	c.Header("Cache-Control", conditional.NoStore)
+	if ticket.Status == ticketComplete {
+		c.JSON(http.StatusOK, ticket)
+		return
+	}
+
+	retryAfter := max(upstreamBackoff("problem_management"), time.Second)
+	c.Header("Location", fmt.Sprintf("/competitions/%d/problems/tickets/%s", ticket.CompetitionID, ticket.ID))
+	c.Header("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	c.JSON(http.StatusAccepted, ticket)
+}
+
+func getCompetition(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
 		return
 	}
 
-	competitionJSON, err := json.Marshal(competition)
-	if err == nil {
-		rdb.Set(ctx, cacheKey, competitionJSON, 10*time.Minute)
+	cacheKey := competitionCacheKey(id, cacheGenerations("competition", []int{id})[id])
+	competition, ok := cachedCompetition(cacheKey)
+	if !ok {
+		loaded, err, _ := competitionFills.Do(cacheKey, func() (interface{}, error) {
+			var competition Competition
+			err := scanCompetition(dbPool.QueryRow(ctx, `SELECT `+competitionColumns+` FROM competitions WHERE id = $1`, id), &competition)
+			if err != nil {
+				return nil, err
+			}
+			if err := withProblemSet(dbPool, &competition); err != nil {
+				return nil, err
+			}
+
+			cacheCompetition(cacheKey, competition)
+			return competition, nil
+		})
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+			return
+		}
+		competition = loaded.(Competition)
 	}
 
-	c.JSON(http.StatusOK, competition)
+	if !requireAccess(c, competition.ID, competition.Visibility) {
+		return
+	}
+
+	// Status depends on the time of the request, so it is never cached.
+	competition.Status = competition.status(time.Now())
+	conditional.JSON(c, competition, competition.UpdatedAt, cacheControlFor(competition.Visibility, competitionCacheControl))
 }
 
+// getCompetitions lists public competitions. Signed-in users also see the
+// unlisted and private ones they organize, are allowlisted for or registered
+// for, and administrators see every competition.
 func getCompetitions(c *gin.Context) {
-	rows, err := dbPool.Query(ctx, "SELECT id, name, description, problem_ids, created_at, updated_at FROM competitions")
+	user, _ := auth.User(c)
+	cacheControl := listCacheControl
+	var userID int
+	var organization string
+	var admin bool
+	if user != nil {
+		cacheControl = conditional.Private
+		userID, organization, admin = user.UserID(), user.Organization, user.HasRole(auth.RoleAdmin)
+	}
+
+	query := `SELECT ` + competitionColumns + ` FROM competitions
+		WHERE visibility = $1 OR $4 OR id IN (
+			SELECT competition_id FROM competition_organizers WHERE user_id = $2
+			UNION SELECT competition_id FROM competition_allowlist WHERE user_id = $2 OR organization = NULLIF($3, '')
+			UNION SELECT competition_id FROM competition_registrations WHERE user_id = $2
+		)`
+	rows, err := dbPool.Query(ctx, query, visibilityPublic, userID, organization, admin)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competitions"})
 		return
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	var competitions []Competition
+	var ids []int
 	for rows.Next() {
 		var competition Competition
-		if err := rows.Scan(&competition.ID, &competition.Name, &competition.Description, &competition.ProblemIDs, &competition.CreatedAt, &competition.UpdatedAt); err == nil {
+		if err := scanCompetition(rows, &competition); err == nil {
+			competition.Status = competition.status(now)
 			competitions = append(competitions, competition)
+			ids = append(ids, competition.ID)
 		}
 	}
+	rows.Close()
+
+	sets, err := loadProblemSets(dbPool, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch problem sets"})
+		return
+	}
+	for i := range competitions {
+		competitions[i].setProblems(sets[competitions[i].ID])
+	}
+
+	conditional.JSON(c, competitions, time.Time{}, cacheControl)
+}
+
+// registerForCompetition signs the calling user up for a competition and
+// tells leaderboard-service through the outbox so that the user gets a
+// leaderboard entry.
+func registerForCompetition(c *gin.Context) {
+	id := c.Param("id")
+	user, _ := auth.User(c)
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// The share lock keeps the competition from being cancelled or ended
+	// between this check and the commit.
+	var competition Competition
+	err = tx.QueryRow(ctx, `SELECT id, ends_at, cancelled_at, max_team_size, visibility FROM competitions WHERE id = $1 FOR SHARE`, id).Scan(&competition.ID, &competition.EndsAt, &competition.CancelledAt, &competition.MaxTeamSize, &competition.Visibility)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	if !requireAccess(c, competition.ID, competition.Visibility) {
+		return
+	}
+
+	switch competition.status(time.Now()) {
+	case competitionCancelled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition was cancelled"})
+		return
+	case competitionEnded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition has ended"})
+		return
+	}
+
+	if competition.MaxTeamSize != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This is a team competition; register a team instead"})
+		return
+	}
+
+	registration := Registration{CompetitionID: competition.ID, UserID: user.UserID(), Username: user.Username}
+	query := `INSERT INTO competition_registrations (competition_id, user_id, username) VALUES ($1, $2, $3) RETURNING id, created_at`
+	err = tx.QueryRow(ctx, query, registration.CompetitionID, registration.UserID, registration.Username).Scan(&registration.ID, &registration.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Already registered"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register"})
+		return
+	}
+
+	payload, version, err := events.Marshal(events.ParticipantRegistered, events.ParticipantRegisteredEvent{
+		CompetitionID: registration.CompetitionID,
+		UserID:        registration.UserID,
+		Username:      registration.Username,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.ParticipantRegistered, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.ParticipantRegistered, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, registration)
+}
+
+func getRegistrations(c *gin.Context) {
+	id := c.Param("id")
+
+	var competitionID int
+	var visibility string
+	err := dbPool.QueryRow(ctx, `SELECT id, visibility FROM competitions WHERE id = $1`, id).Scan(&competitionID, &visibility)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+
+	if !requireAccess(c, competitionID, visibility) {
+		return
+	}
+
+	query := `SELECT id, competition_id, user_id, username, team_id, created_at FROM competition_registrations WHERE competition_id = $1 ORDER BY id`
+	rows, err := dbPool.Query(ctx, query, competitionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch registrations"})
+		return
+	}
+	defer rows.Close()
+
+	registrations := []Registration{}
+	for rows.Next() {
+		var registration Registration
+		if err := rows.Scan(&registration.ID, &registration.CompetitionID, &registration.UserID, &registration.Username, &registration.TeamID, &registration.CreatedAt); err == nil {
+			registrations = append(registrations, registration)
+		}
+	}
+
+	conditional.JSON(c, registrations, time.Time{}, cacheControlFor(visibility, listCacheControl))
+}
+
+// createSubmission records a solution from a registered participant. It stays
+// pending until a judge posts its verdict to judgeSubmission. A member of a
+// registered team submits for the team. Once the competition has ended, users
+// can still submit during their virtual run.
+func createSubmission(c *gin.Context) {
+	id := c.Param("id")
+	user, _ := auth.User(c)
+
+	var request struct {
+		ProblemID  int    `json:"problem_id"`
+		Language   string `json:"language"`
+		SourceCode string `json:"source_code"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var competition Competition
+	var registered bool
+	var teamID *int
+	var inProblemSet bool
+	var virtualID *int
+	var virtualStartsAt, virtualEndsAt *time.Time
+	query := `SELECT c.id, c.starts_at, c.ends_at, c.cancelled_at, r.id IS NOT NULL, r.team_id, EXISTS (
+			SELECT 1 FROM competition_problems p WHERE p.competition_id = c.id AND p.problem_id = $3
+		), v.id, v.starts_at, v.ends_at FROM competitions c
+		LEFT JOIN competition_registrations r ON r.competition_id = c.id AND r.user_id = $2
+		LEFT JOIN virtual_sessions v ON v.competition_id = c.id AND v.user_id = $2
+		WHERE c.id = $1`
+	err := dbPool.QueryRow(ctx, query, id, user.UserID(), request.ProblemID).Scan(
+		&competition.ID, &competition.StartsAt, &competition.EndsAt, &competition.CancelledAt, &registered, &teamID, &inProblemSet,
+		&virtualID, &virtualStartsAt, &virtualEndsAt,
+	)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	now := time.Now()
+	switch competition.status(now) {
+	case competitionCancelled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition was cancelled"})
+		return
+	case competitionScheduled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition has not started"})
+		return
+	case competitionEnded:
+		if virtualID == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Competition has ended"})
+			return
+		}
+		session := VirtualSession{StartsAt: *virtualStartsAt, EndsAt: *virtualEndsAt}
+		if !session.running(now) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Your virtual run has ended"})
+			return
+		}
+		// The virtual run stands in for a registration.
+		registered = true
+	}
+
+	if !registered {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Register for the competition before submitting"})
+		return
+	}
+
+	if !inProblemSet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Problem is not part of this competition"})
+		return
+	}
+
+	submission := Submission{
+		CompetitionID:    competition.ID,
+		ProblemID:        request.ProblemID,
+		UserID:           user.UserID(),
+		TeamID:           teamID,
+		VirtualSessionID: virtualID,
+		Language:         request.Language,
+		Status:           submissionPending,
+	}
+	query = `INSERT INTO submissions (competition_id, problem_id, user_id, team_id, virtual_session_id, language, source_code, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`
+	err = dbPool.QueryRow(ctx, query, submission.CompetitionID, submission.ProblemID, submission.UserID, submission.TeamID, submission.VirtualSessionID, submission.Language, request.SourceCode, submission.Status).Scan(&submission.ID, &submission.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create submission"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, submission)
+}
+
+// getSubmissions lists the calling user's own submissions to a competition,
+// along with their team's. Organizers and reviewers see every participant's
+// submissions.
+func getSubmissions(c *gin.Context) {
+	id := c.Param("id")
+	user, _ := auth.User(c)
+
+	seeAll := user.Can(auth.PermSubmissionsReview)
+	if !seeAll {
+		organizer, err := isOrganizer(user, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organizers"})
+			return
+		}
+		seeAll = organizer
+	}
+
+	query := `SELECT ` + submissionColumns + ` FROM submissions
+		WHERE competition_id = $1 AND ($2 OR user_id = $3 OR team_id = (
+			SELECT team_id FROM competition_registrations WHERE competition_id = $1 AND user_id = $3
+		)) ORDER BY id`
+	rows, err := dbPool.Query(ctx, query, id, seeAll, user.UserID())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch submissions"})
+		return
+	}
+	defer rows.Close()
+
+	submissions := []Submission{}
+	for rows.Next() {
+		var submission Submission
+		if err := scanSubmission(rows, &submission); err == nil {
+			submissions = append(submissions, submission)
+		}
+	}
+
+	conditional.JSON(c, submissions, time.Time{}, conditional.Private)
+}
+
+func getOrganizers(c *gin.Context) {
+	id := c.Param("id")
+
+	var competitionID int
+	var visibility string
+	err := dbPool.QueryRow(ctx, `SELECT id, visibility FROM competitions WHERE id = $1`, id).Scan(&competitionID, &visibility)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+
+	if !requireAccess(c, competitionID, visibility) {
+		return
+	}
+
+	rows, err := dbPool.Query(ctx, `SELECT user_id FROM competition_organizers WHERE competition_id = $1 ORDER BY user_id`, competitionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch organizers"})
+		return
+	}
+	defer rows.Close()
+
+	organizers := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err == nil {
+			organizers = append(organizers, userID)
+		}
+	}
+
+	conditional.JSON(c, organizers, time.Time{}, cacheControlFor(visibility, competitionCacheControl))
+}
+
+func addOrganizer(c *gin.Context) {
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+
+	var request struct {
+		UserID int `json:"user_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.UserID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `INSERT INTO competition_organizers (competition_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, competitionID, request.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add organizer"})
+		return
+	}
+
+	if tag.RowsAffected() > 0 {
+		if err := publishAccess(tx, competitionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"competition_id": competitionID, "user_id": request.UserID})
+}
+
+func removeOrganizer(c *gin.Context) {
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Concurrent removals each count the other's organizer under READ
+	// COMMITTED, so lock the competition to take them one at a time.
+	_, err = tx.Exec(ctx, `SELECT id FROM competitions WHERE id = $1 FOR UPDATE`, competitionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock competition"})
+		return
+	}
+
+	// Keep at least one organizer so the competition stays manageable without
+	// an admin.
+	query := `DELETE FROM competition_organizers WHERE competition_id = $1 AND user_id = $2
+		AND (SELECT COUNT(*) FROM competition_organizers WHERE competition_id = $1) > 1`
+	tag, err := tx.Exec(ctx, query, competitionID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove organizer"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Not an organizer, or the competition's last organizer"})
+		return
+	}
+
+	if err := publishAccess(tx, competitionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func healthCheck(c *gin.Context) {
+	status := http.StatusOK
+	rabbitMQStatus := "connected"
+	if !broker.Connected() {
+		status = http.StatusServiceUnavailable
+		rabbitMQStatus = "disconnected"
+	}
 
-	c.JSON(http.StatusOK, competitions)
+	c.JSON(status, gin.H{"rabbitmq": rabbitMQStatus})
 }
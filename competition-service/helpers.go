@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/json"
 	"github.com/google/uuid"
-	"github.com/streadway/amqp"
 	"log"
+	"shared/events"
 	"strconv"
 	"time"
 )
@@ -31,21 +31,16 @@ func monitorTimeout(eventID string, competitionID int) {
 func initiateRollback(eventID string, competitionID int) {
 	eventID = uuid.New().String()
 
-	rollbackEvent := map[string]interface{}{
-		"event_id":   eventID,
-		"event_type": "rollback_events",
-		"payload": map[string]interface{}{
-			"competition_id": competitionID,
-			"reason":         "Timeout expired",
-		},
+	payload, err := events.Encode(eventID, events.Rollback, events.RollbackEvent{
+		CompetitionID: competitionID,
+		Reason:        "Timeout expired",
+	})
+	if err != nil {
+		log.Printf("Failed to encode rollback event for competition ID %d: %v\n", competitionID, err)
+		return
 	}
 
-	payload, _ := json.Marshal(rollbackEvent)
-
-	err := rabbitMQChannel.Publish(
-		"rollback_exchange", "", false, false,
-		amqp.Publishing{ContentType: "application/json", Body: payload},
-	)
+	err = broker.Publish("rollback_exchange", "", payload)
 	if err != nil {
 		log.Printf("Failed to publish rollback event for competition ID %d: %v\n", competitionID, err)
 	} else {
@@ -54,30 +49,49 @@ func initiateRollback(eventID string, competitionID int) {
 }
 
 func handleRollback(payload []byte) error {
-	var rollbackEvent struct {
-		EventID       string `json:"event_id"`
-		CompetitionID int    `json:"competition_id"`
-		Reason        string `json:"reason"`
-	}
+	var rollbackEvent events.RollbackEvent
 
 	if err := json.Unmarshal(payload, &rollbackEvent); err != nil {
 		return err
 	}
 
-	_, err := dbPool.Exec(ctx, "DELETE FROM competitions WHERE id = $1", rollbackEvent.CompetitionID)
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "DELETE FROM competitions WHERE id = $1", rollbackEvent.CompetitionID)
 	if err != nil {
 		return err
 	}
 
+	// A redelivered rollback finds nothing to delete and has nothing to announce.
+	if tag.RowsAffected() > 0 {
+		payload, version, err := events.Marshal(events.CompetitionDeleted, events.CompetitionDeletedEvent{
+			CompetitionID: rollbackEvent.CompetitionID,
+			Reason:        rollbackEvent.Reason,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.CompetitionDeleted, version, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
 	log.Printf("Rollback completed for competition ID %d: %s\n", rollbackEvent.CompetitionID, rollbackEvent.Reason)
 	return nil
 }
 
 func handleLeaderboardSuccess(payload []byte) error {
-	var successEvent struct {
-		EventID       string `json:"event_id"`
-		CompetitionID int    `json:"competition_id"`
-	}
+	var successEvent events.LeaderboardSuccessEvent
 
 	if err := json.Unmarshal(payload, &successEvent); err != nil {
 		return err
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+const inviteColumns = `id, competition_id, created_by, expires_at, max_uses, uses, revoked_at, created_at`
+
+func scanInvite(row rowScanner, invite *Invite) error {
+	return row.Scan(&invite.ID, &invite.CompetitionID, &invite.CreatedBy, &invite.ExpiresAt, &invite.MaxUses, &invite.Uses, &invite.RevokedAt, &invite.CreatedAt)
+}
+
+func generateInviteCode() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashInviteCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func inviteLink(competitionID int, code string) string {
+	return fmt.Sprintf("/competitions/%d/invites/redeem?code=%s", competitionID, code)
+}
+
+// createInvite issues a code that admits whoever redeems it, until it
+// expires, runs out of uses or is revoked. Either limit may be left open. A
+// retry with the same Idempotency-Key gets the same code back, so the stored
+// response holds the code until the key expires.
+func createInvite(c *gin.Context) {
+	var request struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		MaxUses   *int       `json:"max_uses"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var errs []fieldError
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		errs = append(errs, fieldError{Field: "expires_at", Message: "must be in the future"})
+	}
+	if request.MaxUses != nil && *request.MaxUses < 1 {
+		errs = append(errs, fieldError{Field: "max_uses", Message: "must be at least 1"})
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(c, errs)
+		return
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invite code"})
+		return
+	}
+
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+	user, _ := auth.User(c)
+
+	var invite Invite
+	query := `INSERT INTO competition_invites (competition_id, code_hash, created_by, expires_at, max_uses) VALUES ($1, $2, $3, $4, $5) RETURNING ` + inviteColumns
+	err = scanInvite(dbPool.QueryRow(ctx, query, competitionID, hashInviteCode(code), user.UserID(), request.ExpiresAt, request.MaxUses), &invite)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+		return
+	}
+	invite.Code = code
+	invite.Link = inviteLink(competitionID, code)
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// getInvites lists a competition's invites. Codes are not stored, so they
+// cannot be shown again.
+func getInvites(c *gin.Context) {
+	rows, err := dbPool.Query(ctx, `SELECT `+inviteColumns+` FROM competition_invites WHERE competition_id = $1 ORDER BY id`, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invites"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var invite Invite
+		if err := scanInvite(rows, &invite); err == nil {
+			invites = append(invites, invite)
+		}
+	}
+
+	conditional.JSON(c, invites, time.Time{}, conditional.Private)
+}
+
+// revokeInvite stops an invite from being redeemed. Users who already
+// redeemed it stay on the allowlist.
+func revokeInvite(c *gin.Context) {
+	query := `UPDATE competition_invites SET revoked_at = NOW() WHERE id = $1 AND competition_id = $2 AND revoked_at IS NULL`
+	tag, err := dbPool.Exec(ctx, query, c.Param("inviteId"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found or already revoked"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// redeemInvite puts the calling user on the competition's allowlist. The
+// code comes in the body or, for invite links, in the query string. Users
+// already on the allowlist do not use up the invite.
+func redeemInvite(c *gin.Context) {
+	var request struct {
+		Code string `json:"code"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Code == "" {
+		request.Code = c.Query("code")
+	}
+	if request.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	user, _ := auth.User(c)
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// The row lock keeps concurrent redemptions from going past max_uses.
+	var invite Invite
+	query := `SELECT ` + inviteColumns + ` FROM competition_invites WHERE competition_id = $1 AND code_hash = $2 FOR UPDATE`
+	err = scanInvite(tx.QueryRow(ctx, query, c.Param("id"), hashInviteCode(request.Code)), &invite)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invite"})
+		return
+	}
+
+	switch {
+	case invite.RevokedAt != nil:
+		c.JSON(http.StatusGone, gin.H{"error": "Invite was revoked"})
+		return
+	case invite.ExpiresAt != nil && !invite.ExpiresAt.After(time.Now()):
+		c.JSON(http.StatusGone, gin.H{"error": "Invite has expired"})
+		return
+	case invite.MaxUses != nil && invite.Uses >= *invite.MaxUses:
+		c.JSON(http.StatusGone, gin.H{"error": "Invite has been used up"})
+		return
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO competition_allowlist (competition_id, user_id, added_by, invite_id) VALUES ($1, $2, $3, $4) ON CONFLICT (competition_id, user_id) DO NOTHING`,
+		invite.CompetitionID, user.UserID(), invite.CreatedBy, invite.ID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update allowlist"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusOK, gin.H{"competition_id": invite.CompetitionID, "user_id": user.UserID()})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE competition_invites SET uses = uses + 1 WHERE id = $1`, invite.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem invite"})
+		return
+	}
+
+	if err := publishAccess(tx, invite.CompetitionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	log.Printf("User %d joined competition %d with invite %d\n", user.UserID(), invite.CompetitionID, invite.ID)
+	c.JSON(http.StatusOK, gin.H{"competition_id": invite.CompetitionID, "user_id": user.UserID()})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"shared/events"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+const submissionColumns = `id, competition_id, problem_id, user_id, team_id, virtual_session_id, language, status, points, time_ms, memory_mb, judged_at, created_at`
+
+func scanSubmission(row rowScanner, submission *Submission) error {
+	return row.Scan(
+		&submission.ID, &submission.CompetitionID, &submission.ProblemID, &submission.UserID, &submission.TeamID, &submission.VirtualSessionID,
+		&submission.Language, &submission.Status, &submission.Points, &submission.TimeMs, &submission.MemoryMB, &submission.JudgedAt, &submission.CreatedAt,
+	)
+}
+
+func validVerdict(verdict string) bool {
+	switch verdict {
+	case submissionAccepted, submissionWrongAnswer, submissionTimeLimit, submissionMemoryLimit, submissionRuntimeError, submissionCompileError:
+		return true
+	}
+
+	return false
+}
+
+// applyLimits holds an accepted verdict to the competition's limits for the
+// problem, which are nil when the problem's own apply. A verdict other than
+// accepted stands as it is.
+func applyLimits(verdict string, timeMs *int, memoryMB *int, timeLimitMS *int, memoryLimitMB *int) string {
+	if verdict != submissionAccepted {
+		return verdict
+	}
+
+	switch {
+	case timeLimitMS != nil && timeMs != nil && *timeMs > *timeLimitMS:
+		return submissionTimeLimit
+	case memoryLimitMB != nil && memoryMB != nil && *memoryMB > *memoryLimitMB:
+		return submissionMemoryLimit
+	}
+
+	return verdict
+}
+
+// judgeSubmission records the verdict on a pending submission and tells
+// leaderboard-service, through the outbox, how many points it earned. Only
+// the first accepted submission to a problem earns the problem's points for
+// whoever it counts for: the team, the virtual run or the user. An accepted
+// submission that went over the competition's time or memory limit for the
+// problem is judged time_limit or memory_limit instead. A submission is
+// judged once; judging it again answers 409.
+func judgeSubmission(c *gin.Context) {
+	var request struct {
+		Verdict  string `json:"verdict"`
+		TimeMs   *int   `json:"time_ms"`
+		MemoryMB *int   `json:"memory_mb"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var errs []fieldError
+	if !validVerdict(request.Verdict) {
+		errs = append(errs, fieldError{Field: "verdict", Message: "must be one of accepted, wrong_answer, time_limit, memory_limit, runtime_error, compile_error"})
+	}
+	if request.TimeMs != nil && *request.TimeMs < 0 {
+		errs = append(errs, fieldError{Field: "time_ms", Message: "must not be negative"})
+	}
+	if request.MemoryMB != nil && *request.MemoryMB < 0 {
+		errs = append(errs, fieldError{Field: "memory_mb", Message: "must not be negative"})
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(c, errs)
+		return
+	}
+
+	competitionID, _ := strconv.Atoi(c.Param("id"))
+	submissionID, err := strconv.Atoi(c.Param("submissionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid submission ID"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var submission Submission
+	query := `SELECT ` + submissionColumns + ` FROM submissions WHERE id = $1 AND competition_id = $2 FOR UPDATE`
+	err = scanSubmission(tx.QueryRow(ctx, query, submissionID, competitionID), &submission)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Submission not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch submission"})
+		return
+	}
+
+	if submission.Status != submissionPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Submission was already judged"})
+		return
+	}
+
+	// The problem's row lock orders the judging of its submissions, so that
+	// two accepted submissions judged at once cannot both earn the points.
+	var points int
+	var timeLimitMS, memoryLimitMB *int
+	query = `SELECT points, time_limit_ms, memory_limit_mb FROM competition_problems WHERE competition_id = $1 AND problem_id = $2 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, competitionID, submission.ProblemID).Scan(&points, &timeLimitMS, &memoryLimitMB)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "Problem is no longer part of this competition"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch problem"})
+		return
+	}
+
+	if request.Verdict == submissionAccepted {
+		if timeLimitMS != nil && request.TimeMs == nil {
+			errs = append(errs, fieldError{Field: "time_ms", Message: "is required, the problem has a time limit"})
+		}
+		if memoryLimitMB != nil && request.MemoryMB == nil {
+			errs = append(errs, fieldError{Field: "memory_mb", Message: "is required, the problem has a memory limit"})
+		}
+		if len(errs) > 0 {
+			respondWithFieldErrors(c, errs)
+			return
+		}
+	}
+
+	submission.Status = applyLimits(request.Verdict, request.TimeMs, request.MemoryMB, timeLimitMS, memoryLimitMB)
+	submission.TimeMs = request.TimeMs
+	submission.MemoryMB = request.MemoryMB
+	submission.Points = 0
+	if submission.Status == submissionAccepted {
+		var solved bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM submissions WHERE competition_id = $1 AND problem_id = $2 AND status = $3 AND CASE
+				WHEN $4::INT IS NOT NULL THEN team_id = $4
+				WHEN $5::INT IS NOT NULL THEN virtual_session_id = $5
+				ELSE user_id = $6 AND team_id IS NULL AND virtual_session_id IS NULL
+			END)`,
+			competitionID, submission.ProblemID, submissionAccepted, submission.TeamID, submission.VirtualSessionID, submission.UserID,
+		).Scan(&solved)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check earlier submissions"})
+			return
+		}
+		if !solved {
+			submission.Points = points
+		}
+	}
+
+	query = `UPDATE submissions SET status = $2, points = $3, time_ms = $4, memory_mb = $5, judged_at = NOW() WHERE id = $1 RETURNING judged_at`
+	err = tx.QueryRow(ctx, query, submission.ID, submission.Status, submission.Points, submission.TimeMs, submission.MemoryMB).Scan(&submission.JudgedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to judge submission"})
+		return
+	}
+
+	payload, version, err := events.Marshal(events.SubmissionJudged, events.SubmissionJudgedEvent{
+		CompetitionID:    submission.CompetitionID,
+		SubmissionID:     submission.ID,
+		ProblemID:        submission.ProblemID,
+		UserID:           submission.UserID,
+		TeamID:           submission.TeamID,
+		VirtualSessionID: submission.VirtualSessionID,
+		Verdict:          submission.Status,
+		Points:           submission.Points,
+		JudgedAt:         *submission.JudgedAt,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.SubmissionJudged, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.SubmissionJudged, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	log.Printf("Submission %d to competition %d judged %s for %d points\n", submission.ID, submission.CompetitionID, submission.Status, submission.Points)
+	c.JSON(http.StatusOK, submission)
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestApplyLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		verdict       string
+		timeMs        *int
+		memoryMB      *int
+		timeLimitMS   *int
+		memoryLimitMB *int
+		want          string
+	}{
+		{"no limits", submissionAccepted, intPointer(5000), intPointer(512), nil, nil, submissionAccepted},
+		{"within the limits", submissionAccepted, intPointer(1000), intPointer(256), intPointer(1000), intPointer(256), submissionAccepted},
+		{"over the time limit", submissionAccepted, intPointer(1001), intPointer(256), intPointer(1000), intPointer(256), submissionTimeLimit},
+		{"over the memory limit", submissionAccepted, intPointer(1000), intPointer(257), intPointer(1000), intPointer(256), submissionMemoryLimit},
+		{"over both limits", submissionAccepted, intPointer(1001), intPointer(257), intPointer(1000), intPointer(256), submissionTimeLimit},
+		{"nothing measured", submissionAccepted, nil, nil, intPointer(1000), intPointer(256), submissionAccepted},
+		{"other verdicts stand", submissionWrongAnswer, intPointer(9000), nil, intPointer(1000), nil, submissionWrongAnswer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := applyLimits(test.verdict, test.timeMs, test.memoryMB, test.timeLimitMS, test.memoryLimitMB)
+			if got != test.want {
+				t.Errorf("applyLimits() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidVerdict(t *testing.T) {
+	tests := map[string]bool{
+		submissionAccepted:     true,
+		submissionWrongAnswer:  true,
+		submissionTimeLimit:    true,
+		submissionMemoryLimit:  true,
+		submissionRuntimeError: true,
+		submissionCompileError: true,
+		submissionPending:      false,
+		"":                     false,
+		"Accepted":             false,
+	}
+
+	for verdict, want := range tests {
+		if got := validVerdict(verdict); got != want {
+			t.Errorf("validVerdict(%q) = %v, want %v", verdict, got, want)
+		}
+	}
+}
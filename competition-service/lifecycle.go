@@ -0,0 +1,349 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"shared/events"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+const competitionColumns = `id, name, description, created_by, starts_at, ends_at, cancelled_at, COALESCE(cancellation_reason, ''), max_team_size, visibility, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanCompetition reads a row selected with competitionColumns. The problem
+// set lives in its own table; see withProblemSet.
+func scanCompetition(row rowScanner, competition *Competition) error {
+	return row.Scan(
+		&competition.ID, &competition.Name, &competition.Description, &competition.CreatedBy, &competition.StartsAt, &competition.EndsAt,
+		&competition.CancelledAt, &competition.CancellationReason, &competition.MaxTeamSize, &competition.Visibility,
+		&competition.CreatedAt, &competition.UpdatedAt,
+	)
+}
+
+// lockCompetition reads a competition for update, so that the checks made on
+// it hold until the transaction ends.
+func lockCompetition(tx pgx.Tx, id string) (Competition, error) {
+	var competition Competition
+	err := scanCompetition(tx.QueryRow(ctx, `SELECT `+competitionColumns+` FROM competitions WHERE id = $1 FOR UPDATE`, id), &competition)
+	if err != nil {
+		return competition, err
+	}
+	competition.Status = competition.status(time.Now())
+
+	return competition, withProblemSet(tx, &competition)
+}
+
+func validSchedule(startsAt *time.Time, endsAt *time.Time) bool {
+	return startsAt == nil || endsAt == nil || endsAt.After(*startsAt)
+}
+
+// updateCompetition edits a competition. Anything may change before it
+// starts; once it is running the start and the problem set are fixed and the
+// end may only move to a time still in the future. Ended and cancelled
+// competitions cannot be edited. A new problem set, given as problems or as
+// problem_ids, replaces the old one entirely.
+func updateCompetition(c *gin.Context) {
+	var request struct {
+		Name        *string        `json:"name"`
+		Description *string        `json:"description"`
+		Problems    *[]problemSpec `json:"problems"`
+		ProblemIDs  *[]int         `json:"problem_ids"`
+		StartsAt    *time.Time     `json:"starts_at"`
+		EndsAt      *time.Time     `json:"ends_at"`
+		MaxTeamSize *int           `json:"max_team_size"`
+		Visibility  *string        `json:"visibility"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var errs []fieldError
+	if request.Name != nil {
+		errs = append(errs, validateName(*request.Name)...)
+	}
+	if request.Description != nil {
+		errs = append(errs, validateDescription(*request.Description)...)
+	}
+	var problemSet []CompetitionProblem
+	if request.Problems != nil || request.ProblemIDs != nil {
+		var specs []problemSpec
+		var ids []int
+		if request.Problems != nil {
+			specs = *request.Problems
+		}
+		if request.ProblemIDs != nil {
+			ids = *request.ProblemIDs
+		}
+		problemSet = resolveProblemSet(specs, ids)
+		errs = append(errs, validateProblemSet(problemSet)...)
+	}
+	if request.MaxTeamSize != nil {
+		errs = append(errs, validateTeamSize(request.MaxTeamSize)...)
+	}
+	if request.Visibility != nil {
+		errs = append(errs, validateVisibility(*request.Visibility)...)
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(c, errs)
+		return
+	}
+
+	// Checked before taking the row lock so that it is not held across a
+	// request to problem-management-service.
+	if problemSet != nil && !checkProblems(c, problemSet) {
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockCompetition(tx, c.Param("id"))
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	if !conditional.IfMatch(c, current) {
+		return
+	}
+
+	switch current.Status {
+	case competitionCancelled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition was cancelled"})
+		return
+	case competitionEnded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition has ended"})
+		return
+	}
+
+	updated := current
+	if request.Name != nil {
+		updated.Name = *request.Name
+	}
+	if request.Description != nil {
+		updated.Description = *request.Description
+	}
+	if problemSet != nil {
+		updated.setProblems(problemSet)
+	}
+	if request.StartsAt != nil {
+		updated.StartsAt = request.StartsAt
+	}
+	if request.EndsAt != nil {
+		updated.EndsAt = request.EndsAt
+	}
+	if request.MaxTeamSize != nil {
+		updated.MaxTeamSize = request.MaxTeamSize
+	}
+	if request.Visibility != nil {
+		updated.Visibility = *request.Visibility
+	}
+
+	// Registrations were made under the current team size, so it is fixed
+	// from the first one on.
+	if !sameLimit(updated.MaxTeamSize, current.MaxTeamSize) {
+		var registered bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM competition_registrations WHERE competition_id = $1)`, current.ID).Scan(&registered)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check registrations"})
+			return
+		}
+		if registered {
+			c.JSON(http.StatusConflict, gin.H{"error": "The team size cannot change once participants have registered"})
+			return
+		}
+	}
+
+	now := time.Now()
+	if current.Status == competitionRunning {
+		if !sameProblemSet(updated.Problems, current.Problems) || !sameTime(updated.StartsAt, current.StartsAt) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The start and problem set cannot change once the competition is running"})
+			return
+		}
+		// Resubmitting the same problem set must not move its pinned revisions.
+		updated.setProblems(current.Problems)
+		problemSet = nil
+		if request.EndsAt != nil && !request.EndsAt.After(now) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A running competition can only end in the future"})
+			return
+		}
+	}
+
+	if !validSchedule(updated.StartsAt, updated.EndsAt) {
+		respondWithFieldErrors(c, []fieldError{{Field: "ends_at", Message: "must be after starts_at"}})
+		return
+	}
+
+	query := `UPDATE competitions SET name = $2, description = $3, starts_at = $4, ends_at = $5, max_team_size = $6, visibility = $7, updated_at = NOW()
+		WHERE id = $1 RETURNING updated_at`
+	err = tx.QueryRow(ctx, query, updated.ID, updated.Name, updated.Description, updated.StartsAt, updated.EndsAt, updated.MaxTeamSize, updated.Visibility).Scan(&updated.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update competition"})
+		return
+	}
+
+	if problemSet != nil {
+		if err := saveProblemSet(tx, updated.ID, problemSet); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update problem set"})
+			return
+		}
+	}
+
+	payload, version, err := events.Marshal(events.CompetitionUpdated, events.CompetitionUpdatedEvent{
+		CompetitionID: updated.ID,
+		Name:          updated.Name,
+		Description:   updated.Description,
+		ProblemIDs:    problemIDsOf(updated.Problems),
+		StartsAt:      updated.StartsAt,
+		EndsAt:        updated.EndsAt,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.CompetitionUpdated, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.CompetitionUpdated, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if updated.Visibility != current.Visibility {
+		if err := publishAccess(tx, updated.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	competitionChanged(updated.ID)
+
+	updated.Status = updated.status(now)
+	respondWithCompetition(c, updated)
+}
+
+// cancelCompetition calls off a competition that has not ended. The row is
+// kept so that participants can see what happened; leaderboard-service
+// archives the leaderboard when it receives competition_cancelled.
+func cancelCompetition(c *gin.Context) {
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	competition, err := lockCompetition(tx, c.Param("id"))
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	if !conditional.IfMatch(c, competition) {
+		return
+	}
+
+	switch competition.Status {
+	case competitionCancelled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition was already cancelled"})
+		return
+	case competitionEnded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition has ended"})
+		return
+	}
+
+	query := `UPDATE competitions SET cancelled_at = NOW(), cancellation_reason = $2, updated_at = NOW() WHERE id = $1 RETURNING cancelled_at, updated_at`
+	err = tx.QueryRow(ctx, query, competition.ID, request.Reason).Scan(&competition.CancelledAt, &competition.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel competition"})
+		return
+	}
+	competition.CancellationReason = request.Reason
+	competition.Status = competitionCancelled
+
+	user, _ := auth.User(c)
+	payload, version, err := events.Marshal(events.CompetitionCancelled, events.CompetitionCancelledEvent{
+		CompetitionID: competition.ID,
+		Reason:        request.Reason,
+		CancelledAt:   *competition.CancelledAt,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.CompetitionCancelled, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.CompetitionCancelled, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	competitionChanged(competition.ID)
+
+	log.Printf("Competition %d cancelled by user %d: %s\n", competition.ID, user.UserID(), request.Reason)
+	respondWithCompetition(c, competition)
+}
+
+// competitionChanged drops this service's cached copy right away; other
+// services learn about the change from the outbox event.
+func competitionChanged(id int) {
+	if err := bumpGeneration("competition", id); err != nil {
+		log.Printf("Failed to invalidate cached competition %d: %v\n", id, err)
+	}
+}
+
+func respondWithCompetition(c *gin.Context, competition Competition) {
+	if etag, err := conditional.ETag(competition); err == nil {
+		c.Header("ETag", etag)
+	}
+	c.JSON(http.StatusOK, competition)
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
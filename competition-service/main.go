@@ -6,9 +6,12 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/streadway/amqp"
 	"log"
 	"os"
+	"shared/auth"
+	"shared/idempotency"
+	"shared/rabbitmq"
+	"shared/retention"
 	"sync"
 )
 
@@ -16,80 +19,13 @@ var (
 	dbPool          *pgxpool.Pool
 	rdb             *redis.Client
 	ctx             = context.Background()
-	rabbitMQConn    *amqp.Connection
-	rabbitMQChannel *amqp.Channel
+	broker          *rabbitmq.Broker
 	timeoutRegistry = make(map[string]chan bool)
 	mutex           = &sync.Mutex{}
+	jwtSecret       []byte
+	idempotencyKeys *idempotency.Store
 )
 
-func initRabbitMQ() {
-	rabbitMQURL := os.Getenv("RABBITMQ_URL")
-	var err error
-	rabbitMQConn, err = amqp.Dial(rabbitMQURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to RabbitMQ: %v\n", err)
-	}
-
-	rabbitMQChannel, err = rabbitMQConn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to create RabbitMQ channel: %v\n", err)
-	}
-
-	_, err = rabbitMQChannel.QueueDeclare(
-		"competition_created", true, false, false, false, nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare RabbitMQ queue: %v\n", err)
-	}
-
-	err = rabbitMQChannel.ExchangeDeclare(
-		"rollback_exchange",
-		"fanout",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare rollback exchange: %v\n", err)
-	}
-
-	createAndBindQueue("rollback_events", "rollback_exchange")
-
-	_, err = rabbitMQChannel.QueueDeclare(
-		"leaderboard_success", true, false, false, false, nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare leaderboard_success queue: %v\n", err)
-	}
-}
-
-func createAndBindQueue(queueName string, exchangeName string) {
-	_, err := rabbitMQChannel.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare queue %s: %v\n", queueName, err)
-	}
-
-	err = rabbitMQChannel.QueueBind(
-		queueName,
-		"",
-		exchangeName,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to bind queue %s to exchange %s: %v\n", queueName, exchangeName, err)
-	}
-}
-
 func initDB() {
 	dbURL := os.Getenv("DATABASE_URL")
 	var err error
@@ -114,39 +50,79 @@ func initRedis() {
 	}
 }
 
-func startMessageConsumers() {
-	go consumeMessages("leaderboard_success")
-	go consumeMessages("rollback_events")
+func initJWT() {
+	var err error
+	jwtSecret, err = auth.SecretFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v\n", err)
+	}
 }
 
 func main() {
 	initDB()
+	idempotencyKeys = idempotency.NewStore(dbPool)
 	initRedis()
+	initJWT()
 	initRabbitMQ()
+	initRateLimiter()
 	initCircuitBreaker()
 	defer dbPool.Close()
 	defer rdb.Close()
-	defer rabbitMQConn.Close()
-	defer rabbitMQChannel.Close()
-
-	startMessageConsumers()
+	defer broker.Close()
 
 	go processOutbox()
 	go processInboxMessages()
+	go retention.Run(ctx, dbPool, retention.ConfigFromEnv(true))
+	go idempotencyKeys.RunRetention(idempotency.RetentionFromEnv())
 
 	r := gin.Default()
+	r.Use(auth.Middleware(jwtSecret))
 
 	println("Running on port 8080")
 
 	go processQueuedRequests("problem_management", sendRequest)
 
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/health", healthCheck)
+
+	idempotent := idempotencyKeys.Middleware(userScope)
 
-	r.POST("/competitions", createCompetition)
+	r.POST("/competitions", auth.RequirePermission(auth.PermCompetitionsCreate), idempotent, createCompetition)
 	r.GET("/competitions/:id", getCompetition)
+	r.PATCH("/competitions/:id", requireOrganizer(), updateCompetition)
+	r.DELETE("/competitions/:id", requireOrganizer(), cancelCompetition)
 	r.GET("/competitions/:id/problems", getCompetitionProblems)
+	r.GET("/competitions/:id/problems/tickets/:ticket", getProblemTicket)
 	r.GET("/competitions", getCompetitions)
 
+	r.POST("/competitions/:id/registrations", auth.RequirePermission(auth.PermCompetitionsParticipate), idempotent, registerForCompetition)
+	r.POST("/competitions/:id/team-registrations", auth.RequirePermission(auth.PermCompetitionsParticipate), idempotent, registerTeam)
+	r.GET("/competitions/:id/registrations", getRegistrations)
+	r.POST("/competitions/:id/submissions", auth.RequirePermission(auth.PermCompetitionsParticipate), idempotent, createSubmission)
+	r.GET("/competitions/:id/submissions", auth.RequireUser(), getSubmissions)
+	r.PUT("/competitions/:id/submissions/:submissionId/verdict", auth.RequirePermission(auth.PermSubmissionsReview), judgeSubmission)
+	r.POST("/competitions/:id/virtual-sessions", auth.RequirePermission(auth.PermCompetitionsParticipate), idempotent, startVirtualSession)
+	r.GET("/competitions/:id/virtual-sessions/me", auth.RequireUser(), getMyVirtualSession)
+
+	r.GET("/competitions/:id/organizers", getOrganizers)
+	r.POST("/competitions/:id/organizers", requireOrganizer(), addOrganizer)
+	r.DELETE("/competitions/:id/organizers/:userId", requireOrganizer(), removeOrganizer)
+
+	r.GET("/competitions/:id/allowlist", requireOrganizer(), getAllowlist)
+	r.POST("/competitions/:id/allowlist", requireOrganizer(), addToAllowlist)
+	r.DELETE("/competitions/:id/allowlist/users/:userId", requireOrganizer(), removeUserFromAllowlist)
+	r.DELETE("/competitions/:id/allowlist/organizations/:organization", requireOrganizer(), removeOrganizationFromAllowlist)
+	r.GET("/competitions/:id/invites", requireOrganizer(), getInvites)
+	r.POST("/competitions/:id/invites", requireOrganizer(), idempotent, createInvite)
+	r.DELETE("/competitions/:id/invites/:inviteId", requireOrganizer(), revokeInvite)
+	r.POST("/competitions/:id/invites/redeem", auth.RequireUser(), redeemInvite)
+
+	r.POST("/teams", auth.RequireUser(), idempotent, createTeam)
+	r.GET("/teams/:id", getTeam)
+	r.POST("/teams/:id/invitations", requireTeamCaptain(), idempotent, inviteTeamMember)
+	r.POST("/teams/:id/invitations/accept", auth.RequireUser(), acceptTeamInvitation)
+	r.DELETE("/teams/:id/members/:userId", auth.RequireUser(), removeTeamMember)
+
 	if err := r.Run(":8080"); err != nil {
 		log.Fatalf("Failed to run server: %v\n", err)
 	}
@@ -0,0 +1,47 @@
+-- Copies problem sets out of competitions.problem_ids, which databases
+-- created before competition_problems still have. Every problem gets the
+-- label of its position and the default 100 points; a problem listed twice
+-- keeps its first position. The revision the problem had when it was set is
+-- not known, so it is recorded as 0. The column is left in place so that
+-- instances still running the old code keep working during a rollout; drop
+-- it by hand once none are left. The script can be run more than once:
+-- competitions that already have a problem set are skipped.
+--
+--   psql "$DATABASE_URL" -f migrations/001_competition_problems.sql
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS competition_problems (
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    problem_id INT NOT NULL,
+    label VARCHAR(10) NOT NULL,
+    position INT NOT NULL,
+    points INT NOT NULL DEFAULT 100,
+    time_limit_ms INT,
+    memory_limit_mb INT,
+    revision INT NOT NULL,
+    PRIMARY KEY (competition_id, problem_id),
+    UNIQUE (competition_id, label),
+    UNIQUE (competition_id, position)
+);
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'competitions' AND column_name = 'problem_ids') THEN
+        INSERT INTO competition_problems (competition_id, problem_id, label, position, points, revision)
+        SELECT competition_id, problem_id, CASE WHEN position <= 26 THEN chr(64 + position) ELSE position::TEXT END, position, 100, 0
+        FROM (
+            SELECT competition_id, problem_id, ROW_NUMBER() OVER (PARTITION BY competition_id ORDER BY first_position)::INT AS position
+            FROM (
+                SELECT c.id AS competition_id, p.problem_id, MIN(p.ordinality) AS first_position
+                FROM competitions c, unnest(c.problem_ids) WITH ORDINALITY AS p (problem_id, ordinality)
+                WHERE p.problem_id IS NOT NULL
+                    AND NOT EXISTS (SELECT 1 FROM competition_problems cp WHERE cp.competition_id = c.id)
+                GROUP BY c.id, p.problem_id
+            ) listed
+        ) numbered
+        ON CONFLICT DO NOTHING;
+    END IF;
+END
+$$;
+
+COMMIT;
@@ -2,11 +2,206 @@ package main
 
 import "time"
 
+const (
+	competitionScheduled = "scheduled"
+	competitionRunning   = "running"
+	competitionEnded     = "ended"
+	competitionCancelled = "cancelled"
+)
+
 type Competition struct {
+	ID          int                  `json:"id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Problems    []CompetitionProblem `json:"problems"`
+	// ProblemIDs lists Problems' IDs in order, for clients that predate
+	// problem sets.
+	ProblemIDs         []int      `json:"problem_ids"`
+	CreatedBy          *int       `json:"created_by"`
+	StartsAt           *time.Time `json:"starts_at"`
+	EndsAt             *time.Time `json:"ends_at"`
+	Status             string     `json:"status"`
+	CancelledAt        *time.Time `json:"cancelled_at,omitempty"`
+	CancellationReason string     `json:"cancellation_reason,omitempty"`
+	// MaxTeamSize is set for team competitions.
+	MaxTeamSize *int      `json:"max_team_size"`
+	Visibility  string    `json:"visibility"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// status is where the competition stands at now. Without a start time a
+// competition is running from creation; without an end time it never ends.
+func (c *Competition) status(now time.Time) string {
+	switch {
+	case c.CancelledAt != nil:
+		return competitionCancelled
+	case c.EndsAt != nil && !now.Before(*c.EndsAt):
+		return competitionEnded
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return competitionScheduled
+	default:
+		return competitionRunning
+	}
+}
+
+// CompetitionProblem is one entry of a competition's problem set.
+type CompetitionProblem struct {
+	ProblemID int    `json:"problem_id"`
+	Label     string `json:"label"`
+	Position  int    `json:"position"`
+	Points    int    `json:"points"`
+	// Limits override the problem's own for this competition when set.
+	// judgeSubmission holds accepted submissions to them.
+	TimeLimitMS   *int `json:"time_limit_ms"`
+	MemoryLimitMB *int `json:"memory_limit_mb"`
+	// Revision is the problem revision the competition was set with.
+	Revision int `json:"revision"`
+	// Problem is only filled in by getCompetitionProblems.
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// ProblemList is a competition's problem set as getCompetitionProblems
+// answers it when nothing was queued. MissingIDs are problems that no longer
+// exist and FailedIDs problems the problem service could not provide.
+type ProblemList struct {
+	CompetitionID int                  `json:"competition_id"`
+	Problems      []CompetitionProblem `json:"problems"`
+	MissingIDs    []int                `json:"missing_problem_ids"`
+	FailedIDs     []int                `json:"failed_problem_ids"`
+}
+
+// Problem is a problem as served by problem-management-service.
+type Problem struct {
 	ID          int       `json:"id"`
-	Name        string    `json:"name"`
+	Title       string    `json:"title"`
 	Description string    `json:"description"`
-	ProblemIDs  []int     `json:"problem_ids"`
+	Difficulty  string    `json:"difficulty"`
+	Tags        []string  `json:"tags"`
+	CreatedBy   *int      `json:"created_by"`
+	Revision    int       `json:"revision"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
+
+type Registration struct {
+	ID            int       `json:"id"`
+	CompetitionID int       `json:"competition_id"`
+	UserID        int       `json:"user_id"`
+	Username      string    `json:"username"`
+	TeamID        *int      `json:"team_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityPrivate  = "private"
+)
+
+// Invite lets whoever holds its code into a private competition. Code is
+// only filled in when the invite is created.
+type Invite struct {
+	ID            int        `json:"id"`
+	CompetitionID int        `json:"competition_id"`
+	Code          string     `json:"code,omitempty"`
+	Link          string     `json:"link,omitempty"`
+	CreatedBy     int        `json:"created_by"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	MaxUses       *int       `json:"max_uses"`
+	Uses          int        `json:"uses"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// AllowlistEntry allows either one user or every member of an organization.
+type AllowlistEntry struct {
+	ID            int       `json:"id"`
+	CompetitionID int       `json:"competition_id"`
+	UserID        *int      `json:"user_id,omitempty"`
+	Organization  string    `json:"organization,omitempty"`
+	AddedBy       *int      `json:"added_by"`
+	InviteID      *int      `json:"invite_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const (
+	teamCaptain = "captain"
+	teamMember  = "member"
+)
+
+const (
+	memberInvited = "invited"
+	memberJoined  = "joined"
+)
+
+type Team struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	CreatedBy int          `json:"created_by"`
+	Members   []TeamMember `json:"members"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type TeamMember struct {
+	UserID    int        `json:"user_id"`
+	Username  *string    `json:"username"`
+	Role      string     `json:"role"`
+	Status    string     `json:"status"`
+	InvitedAt time.Time  `json:"invited_at"`
+	JoinedAt  *time.Time `json:"joined_at"`
+}
+
+const (
+	virtualRunning  = "running"
+	virtualFinished = "finished"
+)
+
+// VirtualSession is a user's run of a competition that has ended. It lasts
+// as long as the competition did, timed from when the user started it.
+type VirtualSession struct {
+	ID            int       `json:"id"`
+	CompetitionID int       `json:"competition_id"`
+	UserID        int       `json:"user_id"`
+	Username      string    `json:"username"`
+	StartsAt      time.Time `json:"starts_at"`
+	EndsAt        time.Time `json:"ends_at"`
+	Status        string    `json:"status"`
+	// RemainingSeconds counts down while the run is going.
+	RemainingSeconds int       `json:"remaining_seconds"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func (s *VirtualSession) running(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// A submission is pending until it is judged, then holds its verdict.
+const (
+	submissionPending      = "pending"
+	submissionAccepted     = "accepted"
+	submissionWrongAnswer  = "wrong_answer"
+	submissionTimeLimit    = "time_limit"
+	submissionMemoryLimit  = "memory_limit"
+	submissionRuntimeError = "runtime_error"
+	submissionCompileError = "compile_error"
+)
+
+type Submission struct {
+	ID            int  `json:"id"`
+	CompetitionID int  `json:"competition_id"`
+	ProblemID     int  `json:"problem_id"`
+	UserID        int  `json:"user_id"`
+	TeamID        *int `json:"team_id,omitempty"`
+	// VirtualSessionID is set for submissions made during a virtual run.
+	VirtualSessionID *int   `json:"virtual_session_id,omitempty"`
+	Language         string `json:"language"`
+	Status           string `json:"status"`
+	// Points are only awarded to the first accepted submission to a problem.
+	Points    int        `json:"points"`
+	TimeMs    *int       `json:"time_ms,omitempty"`
+	MemoryMB  *int       `json:"memory_mb,omitempty"`
+	JudgedAt  *time.Time `json:"judged_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"shared/auth"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+// isOrganizer reports whether the user organizes the competition. Admins
+// organize every competition.
+func isOrganizer(user *auth.Claims, competitionID string) (bool, error) {
+	if user.HasRole(auth.RoleAdmin) {
+		return true, nil
+	}
+
+	var organizer bool
+	query := `SELECT EXISTS (SELECT 1 FROM competition_organizers WHERE competition_id = $1 AND user_id = $2)`
+	err := dbPool.QueryRow(ctx, query, competitionID, user.UserID()).Scan(&organizer)
+	return organizer, err
+}
+
+// requireOrganizer limits a route on /competitions/:id to the competition's
+// organizers and administrators.
+func requireOrganizer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := auth.User(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		id := c.Param("id")
+		var competitionID int
+		err := dbPool.QueryRow(ctx, `SELECT id FROM competitions WHERE id = $1`, id).Scan(&competitionID)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid competition ID"})
+			c.Abort()
+			return
+		}
+
+		organizer, err := isOrganizer(user, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organizers"})
+			c.Abort()
+			return
+		}
+
+		if !organizer {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the competition's organizers can change it"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// userScope keeps each user's idempotency keys apart.
+func userScope(c *gin.Context) string {
+	user, _ := auth.User(c)
+	return "user:" + strconv.Itoa(user.UserID())
+}
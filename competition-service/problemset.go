@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultProblemPoints = 100
+	maxLabelLength       = 10
+	maxTimeLimitMS       = 60000
+	maxMemoryLimitMB     = 4096
+)
+
+const competitionProblemColumns = `problem_id, label, position, points, time_limit_ms, memory_limit_mb, revision`
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// problemSpec is how a request describes one problem of a problem set. Only
+// problem_id is required; labels default to A, B, C… by position.
+type problemSpec struct {
+	ProblemID     int     `json:"problem_id"`
+	Label         *string `json:"label"`
+	Points        *int    `json:"points"`
+	TimeLimitMS   *int    `json:"time_limit_ms"`
+	MemoryLimitMB *int    `json:"memory_limit_mb"`
+}
+
+// resolveProblemSet builds a problem set from a request, which lists either
+// full entries in problems or just IDs in problemIDs. Revisions are pinned
+// later, once the problems have been fetched.
+func resolveProblemSet(problems []problemSpec, problemIDs []int) []CompetitionProblem {
+	if len(problems) == 0 {
+		for _, problemID := range problemIDs {
+			problems = append(problems, problemSpec{ProblemID: problemID})
+		}
+	}
+
+	set := make([]CompetitionProblem, len(problems))
+	for i, spec := range problems {
+		entry := CompetitionProblem{
+			ProblemID:     spec.ProblemID,
+			Label:         positionLabel(i),
+			Position:      i + 1,
+			Points:        defaultProblemPoints,
+			TimeLimitMS:   spec.TimeLimitMS,
+			MemoryLimitMB: spec.MemoryLimitMB,
+		}
+		if spec.Label != nil {
+			entry.Label = *spec.Label
+		}
+		if spec.Points != nil {
+			entry.Points = *spec.Points
+		}
+		set[i] = entry
+	}
+
+	return set
+}
+
+// positionLabel returns A for position 0, B for 1 and so on, which is enough
+// for maxCompetitionProblems.
+func positionLabel(index int) string {
+	return string(rune('A' + index))
+}
+
+func problemIDsOf(set []CompetitionProblem) []int {
+	ids := make([]int, len(set))
+	for i, entry := range set {
+		ids[i] = entry.ProblemID
+	}
+
+	return ids
+}
+
+// pinRevisions records the revision of each problem as just fetched.
+func pinRevisions(set []CompetitionProblem, problems map[int]Problem) {
+	for i := range set {
+		set[i].Revision = problems[set[i].ProblemID].Revision
+	}
+}
+
+// sameProblemSet compares what participants see of two problem sets,
+// ignoring pinned revisions.
+func sameProblemSet(a []CompetitionProblem, b []CompetitionProblem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].ProblemID != b[i].ProblemID || a[i].Label != b[i].Label || a[i].Points != b[i].Points ||
+			!sameLimit(a[i].TimeLimitMS, b[i].TimeLimitMS) || !sameLimit(a[i].MemoryLimitMB, b[i].MemoryLimitMB) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameLimit(a *int, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// loadProblemSets returns the problem sets of several competitions, each in
+// display order.
+func loadProblemSets(db querier, competitionIDs []int) (map[int][]CompetitionProblem, error) {
+	sets := make(map[int][]CompetitionProblem, len(competitionIDs))
+	if len(competitionIDs) == 0 {
+		return sets, nil
+	}
+
+	query := `SELECT competition_id, ` + competitionProblemColumns + ` FROM competition_problems
+		WHERE competition_id = ANY($1) ORDER BY competition_id, position`
+	rows, err := db.Query(ctx, query, pq.Array(competitionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var competitionID int
+		var entry CompetitionProblem
+		err := rows.Scan(&competitionID, &entry.ProblemID, &entry.Label, &entry.Position, &entry.Points,
+			&entry.TimeLimitMS, &entry.MemoryLimitMB, &entry.Revision)
+		if err != nil {
+			return nil, err
+		}
+		sets[competitionID] = append(sets[competitionID], entry)
+	}
+
+	return sets, rows.Err()
+}
+
+// withProblemSet fills in the problem set of a competition that was just
+// scanned.
+func withProblemSet(db querier, competition *Competition) error {
+	sets, err := loadProblemSets(db, []int{competition.ID})
+	if err != nil {
+		return err
+	}
+
+	competition.setProblems(sets[competition.ID])
+	return nil
+}
+
+func (c *Competition) setProblems(set []CompetitionProblem) {
+	if set == nil {
+		set = []CompetitionProblem{}
+	}
+	c.Problems = set
+	c.ProblemIDs = problemIDsOf(set)
+}
+
+// saveProblemSet replaces a competition's problem set.
+func saveProblemSet(tx pgx.Tx, competitionID int, set []CompetitionProblem) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM competition_problems WHERE competition_id = $1`, competitionID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO competition_problems (competition_id, ` + competitionProblemColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	for _, entry := range set {
+		_, err := tx.Exec(ctx, query, competitionID, entry.ProblemID, entry.Label, entry.Position, entry.Points,
+			entry.TimeLimitMS, entry.MemoryLimitMB, entry.Revision)
+		if err != nil {
+			return fmt.Errorf("failed to save problem %d: %w", entry.ProblemID, err)
+		}
+	}
+
+	return nil
+}
@@ -1,89 +1,83 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
 	"log"
+	"shared/events"
+	"shared/notify"
+	"shared/rabbitmq"
 	"time"
 )
 
-func consumeMessages(queueName string) {
-	msgs, err := rabbitMQChannel.Consume(
-		queueName,
-		"",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to register consumer for queue %s: %v\n", queueName, err)
-	}
-
-	for msg := range msgs {
-		var message map[string]interface{}
-		if err := json.Unmarshal(msg.Body, &message); err != nil {
-			log.Printf("Failed to parse message from queue %s: %v\n", queueName, err)
-			continue
-		}
-
-		eventID := message["event_id"].(string)
-		payload := message["payload"]
-
-		payloadStr, err := json.Marshal(payload)
-
-		if err != nil {
-			log.Printf("Failed to marshal payload for event_id %s in queue %s: %v\n", eventID, queueName, err)
-			continue
-		}
+const (
+	consumerPrefetch  = 10
+	inboxBatchSize    = 10
+	inboxPollInterval = 5 * time.Second
+	// inboxRetryBackoff is how long a failed event waits before its second
+	// attempt; the wait doubles with every further attempt.
+	inboxRetryBackoff = 2 * time.Second
+)
 
-		_, err = dbPool.Exec(
-			ctx,
-			`INSERT INTO inbox (event_id, event_type, payload) VALUES ($1, $2, $3) ON CONFLICT (event_id) DO NOTHING`,
-			eventID, queueName, payloadStr,
-		)
+func consumeMessages(conn *amqp.Connection, queueName string) error {
+	return rabbitmq.Consume(conn, queueName, consumerPrefetch, storeInInbox)
+}
 
-		if err != nil {
-			log.Printf("Failed to insert message into inbox for queue %s: %v\n", queueName, err)
-		}
+// storeInInbox keeps a delivered event in the inbox, once per event ID.
+func storeInInbox(body []byte) error {
+	envelope, err := events.Decode(body)
+	if err != nil {
+		return fmt.Errorf("%w: %v", rabbitmq.ErrInvalidMessage, err)
 	}
+
+	_, err = dbPool.Exec(
+		ctx,
+		`INSERT INTO inbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4) ON CONFLICT (event_id) DO NOTHING`,
+		envelope.EventID, envelope.EventType, envelope.Version, []byte(envelope.Payload),
+	)
+	return err
 }
 
 func processInboxMessages() {
+	wakeup := make(chan struct{}, 1)
+	go notify.Listen(ctx, dbPool, "inbox_events", wakeup)
+
 	for {
-		rows, err := dbPool.Query(ctx, "SELECT id, event_id, event_type, payload, retries FROM inbox WHERE processed = FALSE AND retries < $1 LIMIT 10", maxRetries)
+		rows, err := dbPool.Query(ctx, "SELECT id, event_id, event_type, version, payload, retries FROM inbox WHERE processed = FALSE AND retries < $1 AND next_attempt_at <= NOW() ORDER BY id LIMIT $2", maxRetries, inboxBatchSize)
 		if err != nil {
 			log.Printf("Failed to fetch inbox messages: %v\n", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
+		handled := 0
 		for rows.Next() {
 			var id int
 			var eventID string
 			var eventType string
+			var version int
 			var payload []byte
 			var retries int
 
-			if err := rows.Scan(&id, &eventID, &eventType, &payload, &retries); err != nil {
+			if err := rows.Scan(&id, &eventID, &eventType, &version, &payload, &retries); err != nil {
 				log.Printf("Failed to scan inbox row: %v\n", err)
 				continue
 			}
 
-			var processErr error
-			switch eventType {
-			case "rollback_events":
-				processErr = handleRollback(payload)
-			case "leaderboard_success":
-				processErr = handleLeaderboardSuccess(payload)
-			default:
-				log.Printf("Unknown event type: %s\n", eventType)
-				continue
+			// Rows stored before a consumer upgrade may hold an older version.
+			// Rows that cannot be upcast or handled count as failed attempts,
+			// so they drop out of the batch instead of holding it up.
+			payload, _, err = events.Upcast(eventType, version, payload)
+			processErr := err
+			if err == nil {
+				processErr = handleInboxEvent(eventType, payload)
 			}
+			handled++
 
 			if processErr != nil {
 				log.Printf("Failed to process inbox event (attempt %d/%d): %v\n", retries+1, maxRetries, processErr)
-				_, updateErr := dbPool.Exec(ctx, "UPDATE inbox SET retries = retries + 1 WHERE id = $1", id)
+				backoff := inboxRetryBackoff << retries
+				_, updateErr := dbPool.Exec(ctx, "UPDATE inbox SET retries = retries + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second' WHERE id = $1", id, backoff.Seconds())
 				if updateErr != nil {
 					log.Printf("Failed to update retries for inbox event ID %s: %v\n", eventID, updateErr)
 				}
@@ -97,6 +91,28 @@ func processInboxMessages() {
 		}
 
 		rows.Close()
-		time.Sleep(1 * time.Second)
+
+		if handled == inboxBatchSize {
+			continue
+		}
+
+		select {
+		case <-wakeup:
+		case <-time.After(inboxPollInterval):
+		}
+	}
+}
+
+// handleInboxEvent applies one inbox event.
+func handleInboxEvent(eventType string, payload []byte) error {
+	switch eventType {
+	case events.Rollback:
+		return handleRollback(payload)
+	case events.LeaderboardSuccess:
+		return handleLeaderboardSuccess(payload)
+	case events.ProblemUpdated, events.ProblemDeleted, events.CompetitionDeleted:
+		return handleCacheInvalidation(eventType, payload)
+	default:
+		return fmt.Errorf("unknown event type: %s", eventType)
 	}
 }
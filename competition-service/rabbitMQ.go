@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"shared/rabbitmq"
+
+	"github.com/streadway/amqp"
+)
+
+// initRabbitMQ starts the connection manager in the background. The service
+// keeps serving HTTP while the broker is unavailable; publishes fail and are
+// retried by the outbox until the connection comes back.
+func initRabbitMQ() {
+	broker = rabbitmq.Connect(rabbitmq.Config{
+		URL:             os.Getenv("RABBITMQ_URL"),
+		DeclareTopology: declareTopology,
+		StartConsumers:  startMessageConsumers,
+		ConfirmBuffer:   outboxBatchSize,
+	})
+}
+
+func declareTopology(channel *amqp.Channel) error {
+	err := rabbitmq.DeclareQueues(channel,
+		"competition_created",
+		"leaderboard_success",
+		"participant_registered",
+		"team_registered",
+		"virtual_session_started",
+		"competition_updated",
+		"competition_cancelled",
+		"competition_access_changed",
+		"submission_judged",
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := rabbitmq.DeclareFanout(channel, "rollback_exchange"); err != nil {
+		return err
+	}
+
+	if err := rabbitmq.DeclareBoundQueue(channel, "rollback_events", "rollback_exchange"); err != nil {
+		return err
+	}
+
+	if err := rabbitmq.DeclareFanout(channel, "cache_invalidation"); err != nil {
+		return err
+	}
+
+	return rabbitmq.DeclareBoundQueue(channel, "competition_cache_invalidation", "cache_invalidation")
+}
+
+func startMessageConsumers(conn *amqp.Connection) {
+	go rabbitmq.RunConsumer(conn, "leaderboard_success", consumeMessages)
+	go rabbitmq.RunConsumer(conn, "rollback_events", consumeMessages)
+	go rabbitmq.RunConsumer(conn, "competition_cache_invalidation", consumeMessages)
+}
@@ -1,49 +1,83 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
+	"shared/ratelimit"
 	"time"
 )
 
 const (
-	clientRateLimit   = 4
-	clientWindow      = time.Minute
-	clientBucket      = 10 * time.Second
-	clientBucketCount = int(clientWindow / clientBucket)
+	clientRateLimit        = 4
+	clientWindow           = time.Minute
+	defaultUpstreamBackoff = 5 * time.Second
+	queueIdleWait          = 5 * time.Second
+	maxQueuedAttempts      = 5
 )
 
-func rateLimiter(serviceName string, checkOnly bool) (bool, error) {
-	now := time.Now().Unix()
-	currentBucket := now / int64(clientBucket.Seconds())
-	redisKey := fmt.Sprintf("outgoing_limit:%s:%d", serviceName, currentBucket)
+var errRequestQueued = errors.New("rate limit exceeded, request queued")
 
-	totalRequests := int64(0)
-	for i := 0; i < clientBucketCount; i++ {
-		bucketKey := fmt.Sprintf("outgoing_limit:%s:%d", serviceName, currentBucket-int64(i))
-		bucketCount, _ := rdb.Get(ctx, bucketKey).Int64()
-		totalRequests += bucketCount
+var outgoingLimiter ratelimit.Limiter
 
-		log.Printf("Bucket %s: %d", bucketKey, bucketCount)
+func initRateLimiter() {
+	outgoingLimiter = ratelimit.NewSlidingWindow(rdb, "outgoing_limit", clientRateLimit, clientWindow)
+}
+
+// rateLimiter checks whether a request to serviceName fits in the outgoing
+// budget. Unless checkOnly is set, a slot is consumed atomically with the check.
+func rateLimiter(serviceName string, checkOnly bool) (ratelimit.Result, error) {
+	var result ratelimit.Result
+	var err error
+	if checkOnly {
+		result, err = outgoingLimiter.Peek(ctx, serviceName)
+	} else {
+		result, err = outgoingLimiter.Allow(ctx, serviceName)
+	}
+	if err != nil {
+		return result, err
 	}
 
-	log.Printf("Total requests: %d", totalRequests)
+	log.Printf("Outgoing limit for %s: %d/%d remaining, resets in %v", serviceName, result.Remaining, result.Limit, result.ResetAfter)
+
+	return result, nil
+}
 
-	if totalRequests >= clientRateLimit {
-		return false, nil
+// setUpstreamBackoff records that serviceName asked us to wait, so that both
+// fetchProblem and the queue processor hold off until the period has passed.
+func setUpstreamBackoff(serviceName string, wait time.Duration) {
+	if wait <= 0 {
+		wait = defaultUpstreamBackoff
 	}
 
-	if !checkOnly {
-		_, err := rdb.Incr(ctx, redisKey).Result()
-		if err != nil {
-			return false, err
-		}
+	if err := rdb.Set(ctx, fmt.Sprintf("upstream_backoff:%s", serviceName), 1, wait).Err(); err != nil {
+		log.Printf("Error recording backoff for %s: %v", serviceName, err)
+	}
+}
 
-		rdb.Expire(ctx, redisKey, clientWindow)
+func upstreamBackoff(serviceName string) time.Duration {
+	wait, err := rdb.PTTL(ctx, fmt.Sprintf("upstream_backoff:%s", serviceName)).Result()
+	if err != nil || wait < 0 {
+		return 0
 	}
 
-	return true, nil
+	return wait
+}
+
+func queueProblemRequest(serviceName string, request queuedRequest) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	if err := enqueueRequest(serviceName, string(body)); err != nil {
+		log.Printf("Error enqueuing request: %v", err)
+		return fmt.Errorf("rate limit exceeded and failed to queue request")
+	}
+
+	return errRequestQueued
 }
 
 func enqueueRequest(serviceName string, request string) error {
@@ -53,54 +87,106 @@ func enqueueRequest(serviceName string, request string) error {
 	return err
 }
 
+// dequeueRequest blocks for up to queueIdleWait waiting for a request.
 func dequeueRequest(serviceName string) (string, error) {
 	queueKey := fmt.Sprintf("request_queue:%s", serviceName)
-	request, err := rdb.RPop(ctx, queueKey).Result()
+	result, err := rdb.BRPop(ctx, queueIdleWait, queueKey).Result()
+	if err != nil {
+		return "", err
+	}
 
-	return request, err
+	return result[1], nil
 }
 
+// processQueuedRequests replays queued requests as soon as both our own
+// outgoing budget and the upstream's Retry-After allow it. sendRequest owns
+// retrying: it re-queues a request itself when that makes sense.
 func processQueuedRequests(serviceName string, sendRequest func(request string, serviceName string) error) {
 	for {
-		canSend, err := rateLimiter(serviceName, true)
-		if err != nil || !canSend {
+		if wait := upstreamBackoff(serviceName); wait > 0 {
+			time.Sleep(wait)
+
+			continue
+		}
+
+		result, err := rateLimiter(serviceName, true)
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
 			time.Sleep(1 * time.Second)
 
 			continue
 		}
 
+		if !result.Allowed {
+			time.Sleep(max(result.RetryAfter, 100*time.Millisecond))
+
+			continue
+		}
+
 		request, err := dequeueRequest(serviceName)
 		if err == redis.Nil {
-			time.Sleep(1 * time.Second)
-
 			continue
 		}
 
 		if err != nil {
 			log.Printf("Error dequeuing request: %v", err)
+			time.Sleep(1 * time.Second)
 			continue
 		}
 
 		if err := sendRequest(request, serviceName); err != nil {
-			log.Printf("Error sending request: %v", err)
-			enqueueRequest(serviceName, request)
+			log.Printf("Error sending request %s: %v", request, err)
 		}
 	}
 }
 
+// sendRequest replays a queued problem fetch and files the results under its
+// ticket. fetchProblems re-queues the problems itself when it is rate limited
+// again; other failures are retried up to maxQueuedAttempts times before the
+// ticket records the problems as failed.
 func sendRequest(request string, serviceName string) error {
-	var problemID int
-	_, err := fmt.Sscanf(request, "problem_id:%d", &problemID)
-
+	queued, err := parseQueuedRequest(request)
 	if err != nil {
 		return fmt.Errorf("invalid request format: %v", err)
 	}
 
-	log.Printf("Sending request for problem ID %d", problemID)
+	problemIDs := queued.ProblemIDs
+	log.Printf("Sending request for problem IDs %v", problemIDs)
+
+	result, err := fetchProblems(ctx, problemIDs, serviceName, queued.TicketID)
+	if err != nil && !errors.Is(err, errRequestQueued) {
+		queued.Attempts++
+		if queued.Attempts < maxQueuedAttempts {
+			if queueErr := queueProblemRequest(serviceName, queued); !errors.Is(queueErr, errRequestQueued) {
+				return queueErr
+			}
+			return err
+		}
+
+		failed := make(map[int]string, len(problemIDs))
+		for _, problemID := range problemIDs {
+			if _, ok := result.Problems[problemID]; !ok {
+				failed[problemID] = err.Error()
+			}
+		}
+		if queued.TicketID != "" {
+			if err := recordTicketResults(queued.TicketID, result.Problems, failed); err != nil {
+				log.Printf("Error recording failure on ticket %s: %v", queued.TicketID, err)
+			}
+		}
+		return fmt.Errorf("giving up on problem IDs %v after %d attempts: %w", problemIDs, queued.Attempts, err)
+	}
+
+	log.Printf("Fetched %d of %d problems", len(result.Problems), len(problemIDs))
 
-	problem, err := fetchProblem(problemID, serviceName)
+	if queued.TicketID == "" {
+		return nil
+	}
 
-	log.Printf("Fetched problem ID %d: %v", problemID, problem)
+	failed := make(map[int]string, len(result.Missing))
+	for _, problemID := range result.Missing {
+		failed[problemID] = errProblemNotFound.Error()
+	}
 
-	return err
+	return recordTicketResults(queued.TicketID, result.Problems, failed)
 }
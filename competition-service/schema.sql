@@ -2,15 +2,169 @@ CREATE TABLE competitions (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255),
     description TEXT,
-    problem_ids INT[],
+    created_by INT,
+    starts_at TIMESTAMP,
+    ends_at TIMESTAMP,
+    cancelled_at TIMESTAMP,
+    cancellation_reason TEXT,
+    -- Set for team competitions, which only accept team registrations.
+    max_team_size INT,
+    -- public competitions are listed; unlisted ones are open to anyone with
+    -- the link; private ones only to organizers and the allowlist.
+    visibility VARCHAR(20) NOT NULL DEFAULT 'public',
+    -- Bumped with every competition_access_changed event; see publishAccess.
+    access_version INT NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+-- Databases created while problem sets were kept in competitions.problem_ids
+-- are moved over by migrations/001_competition_problems.sql.
+CREATE TABLE competition_problems (
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    problem_id INT NOT NULL,
+    label VARCHAR(10) NOT NULL,
+    position INT NOT NULL,
+    points INT NOT NULL DEFAULT 100,
+    -- NULL keeps the problem's own limit.
+    time_limit_ms INT,
+    memory_limit_mb INT,
+    revision INT NOT NULL,
+    PRIMARY KEY (competition_id, problem_id),
+    UNIQUE (competition_id, label),
+    UNIQUE (competition_id, position)
+);
+
+CREATE TABLE competition_organizers (
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    user_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (competition_id, user_id)
+);
+
+-- Only a hash of each code is kept; the code itself is shown once, when the
+-- invite is created.
+CREATE TABLE competition_invites (
+    id SERIAL PRIMARY KEY,
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    created_by INT NOT NULL,
+    expires_at TIMESTAMP,
+    max_uses INT,
+    uses INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Users and organizations allowed into a private competition. Redeeming an
+-- invite adds the user here.
+CREATE TABLE competition_allowlist (
+    id SERIAL PRIMARY KEY,
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    user_id INT,
+    organization VARCHAR(100),
+    added_by INT,
+    invite_id INT REFERENCES competition_invites (id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (competition_id, user_id),
+    UNIQUE (competition_id, organization),
+    CHECK ((user_id IS NULL) <> (organization IS NULL))
+);
+
+CREATE TABLE teams (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_by INT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Invited users have no joined_at, and no username until they accept.
+CREATE TABLE team_members (
+    team_id INT NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+    user_id INT NOT NULL,
+    username VARCHAR(50),
+    -- The member's organization when they joined, for private competitions'
+    -- allowlists.
+    organization VARCHAR(100),
+    role VARCHAR(20) NOT NULL DEFAULT 'member',
+    invited_by INT,
+    invited_at TIMESTAMP DEFAULT NOW(),
+    joined_at TIMESTAMP,
+    PRIMARY KEY (team_id, user_id)
+);
+
+-- A team registration adds a row for every member, so that each user is
+-- registered once per competition whether alone or in a team.
+CREATE TABLE competition_registrations (
+    id SERIAL PRIMARY KEY,
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    user_id INT NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    team_id INT REFERENCES teams (id),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (competition_id, user_id)
+);
+
+-- A user's run of a competition that has ended, lasting as long as the
+-- competition did but timed from when the user started it.
+CREATE TABLE virtual_sessions (
+    id SERIAL PRIMARY KEY,
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    user_id INT NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (competition_id, user_id)
+);
+
+CREATE TABLE submissions (
+    id SERIAL PRIMARY KEY,
+    competition_id INT NOT NULL REFERENCES competitions (id) ON DELETE CASCADE,
+    problem_id INT NOT NULL,
+    user_id INT NOT NULL,
+    -- The team the user was registered with, if any; the submission counts
+    -- for the team.
+    team_id INT,
+    -- Set for submissions made during a virtual run.
+    virtual_session_id INT REFERENCES virtual_sessions (id) ON DELETE CASCADE,
+    language VARCHAR(50) NOT NULL,
+    source_code TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    -- Filled in when the submission is judged.
+    points INT NOT NULL DEFAULT 0,
+    time_ms INT,
+    memory_mb INT,
+    judged_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX submissions_user_idx ON submissions (competition_id, user_id);
+
+-- Responses to requests sent with an Idempotency-Key, replayed when the
+-- request is retried. Rows are deleted after IDEMPOTENCY_RETENTION.
+CREATE TABLE idempotency_keys (
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    claim_token CHAR(32) NOT NULL,
+    status_code INT,
+    content_type TEXT,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys (created_at);
+
 CREATE TABLE outbox (
     id SERIAL PRIMARY KEY,
     event_id UUID NOT NULL UNIQUE,
     event_type TEXT NOT NULL,
+    version INT NOT NULL DEFAULT 1,
     payload JSONB NOT NULL,
     created_at TIMESTAMP DEFAULT NOW(),
     processed BOOLEAN DEFAULT FALSE,
@@ -21,9 +175,51 @@ CREATE TABLE inbox (
     id SERIAL PRIMARY KEY,
     event_id UUID NOT NULL UNIQUE,
     event_type TEXT NOT NULL,
+    version INT NOT NULL DEFAULT 1,
     payload JSONB NOT NULL,
     processed BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT NOW(),
     processed_at TIMESTAMP,
-    retries INT DEFAULT 0
+    retries INT DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
+
+CREATE INDEX outbox_archivable_idx ON outbox (created_at) WHERE processed = TRUE;
+CREATE INDEX inbox_archivable_idx ON inbox (processed_at) WHERE processed = TRUE;
+
+-- Processed rows are moved here by the retention job. Monthly partitions are
+-- created on demand and dropped once older than ARCHIVE_RETENTION.
+CREATE TABLE outbox_archive (
+    id INT NOT NULL,
+    event_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    version INT NOT NULL,
+    payload JSONB NOT NULL,
+    retries INT,
+    created_at TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE TABLE inbox_archive (
+    id INT NOT NULL,
+    event_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    version INT NOT NULL,
+    payload JSONB NOT NULL,
+    retries INT,
+    created_at TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE FUNCTION notify_channel() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify(TG_ARGV[0], '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER outbox_notify AFTER INSERT ON outbox
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_channel('outbox_events');
+
+CREATE TRIGGER inbox_notify AFTER INSERT ON inbox
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_channel('inbox_events');
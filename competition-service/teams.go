@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"shared/events"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Teams exist independently of competitions so that the same team can enter
+// several. The user who creates a team is its captain; the captain invites
+// members by user ID, and an invitation counts towards the team's size until
+// it is accepted or withdrawn.
+
+type teamQuerier interface {
+	querier
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// loadTeam returns pgx.ErrNoRows if the team does not exist. Inside a
+// transaction, lock decides whether the team row is locked for update.
+func loadTeam(db teamQuerier, id string, lock bool) (Team, error) {
+	var team Team
+	query := `SELECT id, name, created_by, created_at, updated_at FROM teams WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	err := db.QueryRow(ctx, query, id).Scan(&team.ID, &team.Name, &team.CreatedBy, &team.CreatedAt, &team.UpdatedAt)
+	if err != nil {
+		return team, err
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT user_id, username, role, invited_at, joined_at FROM team_members WHERE team_id = $1 ORDER BY joined_at IS NULL, joined_at, invited_at, user_id`,
+		team.ID,
+	)
+	if err != nil {
+		return team, err
+	}
+	defer rows.Close()
+
+	team.Members = []TeamMember{}
+	for rows.Next() {
+		var member TeamMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Role, &member.InvitedAt, &member.JoinedAt); err != nil {
+			return team, err
+		}
+		member.Status = memberInvited
+		if member.JoinedAt != nil {
+			member.Status = memberJoined
+		}
+		team.Members = append(team.Members, member)
+	}
+
+	return team, rows.Err()
+}
+
+func (t *Team) captain() int {
+	for _, member := range t.Members {
+		if member.Role == teamCaptain {
+			return member.UserID
+		}
+	}
+
+	return 0
+}
+
+// joined returns the members who have accepted their invitation.
+func (t *Team) joined() []TeamMember {
+	var members []TeamMember
+	for _, member := range t.Members {
+		if member.Status == memberJoined {
+			members = append(members, member)
+		}
+	}
+
+	return members
+}
+
+// requireTeamCaptain limits a route on /teams/:id to the team's captain and
+// administrators.
+func requireTeamCaptain() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := auth.User(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		teamID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid team ID"})
+			c.Abort()
+			return
+		}
+
+		var captain bool
+		query := `SELECT EXISTS (SELECT 1 FROM team_members WHERE team_id = $1 AND user_id = $2 AND role = $3)`
+		err = dbPool.QueryRow(ctx, query, teamID, user.UserID(), teamCaptain).Scan(&captain)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check team membership"})
+			c.Abort()
+			return
+		}
+
+		if !captain && !user.HasRole(auth.RoleAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the team's captain can do this"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func createTeam(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if errs := validateTeamName(request.Name); len(errs) > 0 {
+		respondWithFieldErrors(c, errs)
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var teamID int
+	err = tx.QueryRow(ctx, `INSERT INTO teams (name, created_by) VALUES ($1, $2) RETURNING id`, request.Name, user.UserID()).Scan(&teamID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create team"})
+		return
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO team_members (team_id, user_id, username, organization, role, invited_by, joined_at) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $2, NOW())`,
+		teamID, user.UserID(), user.Username, user.Organization, teamCaptain,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add captain"})
+		return
+	}
+
+	team, err := loadTeam(tx, strconv.Itoa(teamID), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, team)
+}
+
+func getTeam(c *gin.Context) {
+	team, err := loadTeam(dbPool, c.Param("id"), false)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	conditional.JSON(c, team, team.UpdatedAt, listCacheControl)
+}
+
+// inviteTeamMember invites a user to the team. Members and pending
+// invitations together may not exceed maxTeamMembers.
+func inviteTeamMember(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	var request struct {
+		UserID int `json:"user_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.UserID <= 0 {
+		respondWithFieldErrors(c, []fieldError{{Field: "user_id", Message: "must be a positive user ID"}})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	team, err := loadTeam(tx, c.Param("id"), true)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	if len(team.Members) >= maxTeamMembers {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A team has at most %d members, including invitations", maxTeamMembers)})
+		return
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO team_members (team_id, user_id, role, invited_by) VALUES ($1, $2, $3, $4)`,
+		team.ID, request.UserID, teamMember, user.UserID(),
+	)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "User is already a member or invited"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invite member"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE teams SET updated_at = NOW() WHERE id = $1`, team.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update team"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"team_id": team.ID, "user_id": request.UserID, "status": memberInvited})
+}
+
+// acceptTeamInvitation lets the calling user join a team that invited them.
+func acceptTeamInvitation(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Locked so that a team registration sees either the old or the new roster.
+	if _, err := loadTeam(tx, c.Param("id"), true); err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE team_members SET username = $3, organization = NULLIF($4, ''), joined_at = NOW() WHERE team_id = $1 AND user_id = $2 AND joined_at IS NULL`,
+		c.Param("id"), user.UserID(), user.Username, user.Organization,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No pending invitation for this team"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE teams SET updated_at = NOW() WHERE id = $1`, c.Param("id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update team"})
+		return
+	}
+
+	team, err := loadTeam(tx, c.Param("id"), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, team)
+}
+
+// removeTeamMember withdraws an invitation or removes a member. The captain
+// may remove anyone else; other users may only remove themselves, which is
+// also how an invitation is declined. Competitions the team already entered
+// keep the roster it was registered with.
+func removeTeamMember(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	team, err := loadTeam(tx, c.Param("id"), true)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	captain := team.captain()
+	if userID != user.UserID() && captain != user.UserID() && !user.HasRole(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the team's captain can remove other members"})
+		return
+	}
+
+	if userID == captain {
+		c.JSON(http.StatusConflict, gin.H{"error": "The captain cannot leave the team"})
+		return
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM team_members WHERE team_id = $1 AND user_id = $2`, team.ID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this team"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE teams SET updated_at = NOW() WHERE id = $1`, team.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update team"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// registerTeam enters a team into a team competition. Only the captain may
+// register it, and only members who have joined are registered; the roster
+// must fit the competition's max_team_size. Every member gets a registration
+// of their own, so none of them may already be registered, alone or in
+// another team, and in a private competition every one of them must be
+// allowed in.
+func registerTeam(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	var request struct {
+		TeamID int `json:"team_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var competition Competition
+	err = tx.QueryRow(ctx,
+		`SELECT id, ends_at, cancelled_at, max_team_size, visibility FROM competitions WHERE id = $1 FOR SHARE`, c.Param("id"),
+	).Scan(&competition.ID, &competition.EndsAt, &competition.CancelledAt, &competition.MaxTeamSize, &competition.Visibility)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	// The other members are checked once the team is loaded, since
+	// registering gives every one of them access.
+	if !requireAccess(c, competition.ID, competition.Visibility) {
+		return
+	}
+
+	switch competition.status(time.Now()) {
+	case competitionCancelled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition was cancelled"})
+		return
+	case competitionEnded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Competition has ended"})
+		return
+	}
+
+	if competition.MaxTeamSize == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This competition is for individuals; register yourself instead"})
+		return
+	}
+
+	team, err := loadTeam(tx, strconv.Itoa(request.TeamID), true)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team"})
+		return
+	}
+
+	if team.captain() != user.UserID() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the team's captain can register it"})
+		return
+	}
+
+	members := team.joined()
+	if len(members) > *competition.MaxTeamSize {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Teams in this competition have at most %d members", *competition.MaxTeamSize)})
+		return
+	}
+
+	if competition.Visibility == visibilityPrivate {
+		excluded, err := membersNotAllowed(tx, competition.ID, team.ID, user.UserID())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+			return
+		}
+		if len(excluded) > 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Some team members are not on this competition's allowlist", "user_ids": excluded})
+			return
+		}
+	}
+
+	registrations := make([]Registration, 0, len(members))
+	event := events.TeamRegisteredEvent{CompetitionID: competition.ID, TeamID: team.ID, TeamName: team.Name}
+	query := `INSERT INTO competition_registrations (competition_id, user_id, username, team_id) VALUES ($1, $2, $3, $4) RETURNING id, created_at`
+	for _, member := range members {
+		registration := Registration{CompetitionID: competition.ID, UserID: member.UserID, Username: *member.Username, TeamID: &team.ID}
+		err := tx.QueryRow(ctx, query, registration.CompetitionID, registration.UserID, registration.Username, registration.TeamID).Scan(&registration.ID, &registration.CreatedAt)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("User %d is already registered for this competition", member.UserID)})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register"})
+			return
+		}
+		registrations = append(registrations, registration)
+		event.Members = append(event.Members, events.TeamMemberV1{UserID: member.UserID, Username: registration.Username})
+	}
+
+	payload, version, err := events.Marshal(events.TeamRegistered, event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.TeamRegistered, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.TeamRegistered, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"competition_id": competition.ID, "team_id": team.ID, "registrations": registrations})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// A ticket collects the problems of one getCompetitionProblems call whose
+// fetch was queued because of rate limiting. It lives in a Redis hash:
+//
+//	competition_id  - competition the problems belong to
+//	problems        - JSON array of the competition's problem set entries
+//	result:<id>     - JSON body of a fetched problem
+//	error:<id>      - why a problem could not be fetched
+//
+// The queue processor writes results as it replays requests, and clients poll
+// the ticket until every problem has a result or an error.
+const ticketTTL = time.Hour
+
+const (
+	ticketPending  = "pending"
+	ticketComplete = "complete"
+)
+
+type ProblemTicket struct {
+	ID            string               `json:"ticket_id"`
+	CompetitionID int                  `json:"competition_id"`
+	Status        string               `json:"status"`
+	Problems      []CompetitionProblem `json:"problems"`
+	PendingIDs    []int                `json:"pending_problem_ids"`
+	Errors        map[string]string    `json:"errors,omitempty"`
+	ExpiresIn     int                  `json:"expires_in_seconds"`
+}
+
+func ticketKey(ticketID string) string {
+	return "problem_ticket:" + ticketID
+}
+
+// createTicket stores the ticket's problem set along with the problems that
+// were fetched or failed straight away. Replayed requests may already have
+// written their results, so only the fields owned by the caller are set.
+func createTicket(ticketID string, competitionID int, problemSet []CompetitionProblem, fetched map[int]Problem, failed map[int]string) error {
+	entries, err := json.Marshal(problemSet)
+	if err != nil {
+		return err
+	}
+
+	fields, err := resultFields(fetched, failed)
+	if err != nil {
+		return err
+	}
+	fields["competition_id"] = competitionID
+	fields["problems"] = entries
+
+	return setTicketFields(ticketID, fields)
+}
+
+// recordTicketResults files the outcome of a replayed request.
+func recordTicketResults(ticketID string, fetched map[int]Problem, failed map[int]string) error {
+	fields, err := resultFields(fetched, failed)
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+
+	return setTicketFields(ticketID, fields)
+}
+
+func resultFields(fetched map[int]Problem, failed map[int]string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(fetched)+len(failed))
+	for problemID, problem := range fetched {
+		body, err := json.Marshal(problem)
+		if err != nil {
+			return nil, err
+		}
+		fields[fmt.Sprintf("result:%d", problemID)] = body
+	}
+	for problemID, reason := range failed {
+		fields[fmt.Sprintf("error:%d", problemID)] = reason
+	}
+
+	return fields, nil
+}
+
+func setTicketFields(ticketID string, fields map[string]interface{}) error {
+	key := ticketKey(ticketID)
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, ticketTTL)
+		return nil
+	})
+
+	return err
+}
+
+// loadTicket returns redis.Nil if the ticket does not exist or has expired.
+func loadTicket(ticketID string) (*ProblemTicket, error) {
+	key := ticketKey(ticketID)
+
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// A replay finishing after the ticket expired recreates a hash with only
+	// its own result; without the problem list it is not a usable ticket.
+	problemSet, err := ticketProblemSet(fields)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt ticket %s: %w", ticketID, err)
+	}
+	if problemSet == nil {
+		return nil, redis.Nil
+	}
+
+	ticket := &ProblemTicket{ID: ticketID, Problems: []CompetitionProblem{}, PendingIDs: []int{}}
+	ticket.CompetitionID, _ = strconv.Atoi(fields["competition_id"])
+
+	for _, entry := range problemSet {
+		problemID := entry.ProblemID
+		if body, ok := fields[fmt.Sprintf("result:%d", problemID)]; ok {
+			var problem Problem
+			if err := json.Unmarshal([]byte(body), &problem); err == nil {
+				entry.Problem = &problem
+				ticket.Problems = append(ticket.Problems, entry)
+				continue
+			}
+		}
+
+		if reason, ok := fields[fmt.Sprintf("error:%d", problemID)]; ok {
+			if ticket.Errors == nil {
+				ticket.Errors = map[string]string{}
+			}
+			ticket.Errors[strconv.Itoa(problemID)] = reason
+			continue
+		}
+
+		ticket.PendingIDs = append(ticket.PendingIDs, problemID)
+	}
+
+	ticket.Status = ticketComplete
+	if len(ticket.PendingIDs) > 0 {
+		ticket.Status = ticketPending
+	}
+
+	if ttl, err := rdb.TTL(ctx, key).Result(); err == nil && ttl > 0 {
+		ticket.ExpiresIn = int(ttl.Seconds())
+	}
+
+	return ticket, nil
+}
+
+// ticketProblemSet returns nil if the ticket has no problem list.
+func ticketProblemSet(fields map[string]string) ([]CompetitionProblem, error) {
+	body := fields["problems"]
+	if body == "" {
+		return nil, nil
+	}
+
+	var problemSet []CompetitionProblem
+	err := json.Unmarshal([]byte(body), &problemSet)
+	return problemSet, err
+}
+
+// queuedRequest is one entry in a service's request queue.
+type queuedRequest struct {
+	ProblemIDs []int  `json:"problem_ids,omitempty"`
+	TicketID   string `json:"ticket_id,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+}
+
+func parseQueuedRequest(request string) (queuedRequest, error) {
+	var queued queuedRequest
+	err := json.Unmarshal([]byte(request), &queued)
+	return queued, err
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"shared/httpclient"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxNameLength        = 255
+	maxDescriptionLength = 10000
+	// maxCompetitionProblems is how many problems positionLabel can label,
+	// A to Z.
+	maxCompetitionProblems = 26
+	maxTeamNameLength      = 100
+	// maxTeamMembers bounds teams, counting pending invitations, and the
+	// team size a competition may allow.
+	maxTeamMembers = 10
+)
+
+// fieldError describes one invalid field of a request body.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// invalidProblem is a referenced problem that cannot be used in a
+// competition.
+type invalidProblem struct {
+	ID     int    `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func validateName(name string) []fieldError {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return []fieldError{{Field: "name", Message: "is required"}}
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return []fieldError{{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxNameLength)}}
+	}
+
+	return nil
+}
+
+func validateDescription(description string) []fieldError {
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return []fieldError{{Field: "description", Message: fmt.Sprintf("must be at most %d characters", maxDescriptionLength)}}
+	}
+
+	return nil
+}
+
+func validateProblemSet(set []CompetitionProblem) []fieldError {
+	if len(set) == 0 {
+		return []fieldError{{Field: "problems", Message: "must list at least one problem"}}
+	}
+	if len(set) > maxCompetitionProblems {
+		return []fieldError{{Field: "problems", Message: fmt.Sprintf("must list at most %d problems", maxCompetitionProblems)}}
+	}
+
+	var errs []fieldError
+	seenIDs := make(map[int]bool, len(set))
+	seenLabels := make(map[string]bool, len(set))
+	for i, entry := range set {
+		field := fmt.Sprintf("problems[%d]", i)
+		switch {
+		case entry.ProblemID <= 0:
+			errs = append(errs, fieldError{Field: field + ".problem_id", Message: "must be a positive problem ID"})
+		case seenIDs[entry.ProblemID]:
+			errs = append(errs, fieldError{Field: field + ".problem_id", Message: fmt.Sprintf("duplicates problem %d", entry.ProblemID)})
+		}
+		seenIDs[entry.ProblemID] = true
+
+		switch {
+		case !validLabel(entry.Label):
+			errs = append(errs, fieldError{Field: field + ".label", Message: fmt.Sprintf("must be 1 to %d letters or digits", maxLabelLength)})
+		case seenLabels[entry.Label]:
+			errs = append(errs, fieldError{Field: field + ".label", Message: fmt.Sprintf("duplicates label %s", entry.Label)})
+		}
+		seenLabels[entry.Label] = true
+
+		if entry.Points < 0 {
+			errs = append(errs, fieldError{Field: field + ".points", Message: "must not be negative"})
+		}
+		if entry.TimeLimitMS != nil && (*entry.TimeLimitMS <= 0 || *entry.TimeLimitMS > maxTimeLimitMS) {
+			errs = append(errs, fieldError{Field: field + ".time_limit_ms", Message: fmt.Sprintf("must be between 1 and %d", maxTimeLimitMS)})
+		}
+		if entry.MemoryLimitMB != nil && (*entry.MemoryLimitMB <= 0 || *entry.MemoryLimitMB > maxMemoryLimitMB) {
+			errs = append(errs, fieldError{Field: field + ".memory_limit_mb", Message: fmt.Sprintf("must be between 1 and %d", maxMemoryLimitMB)})
+		}
+	}
+
+	return errs
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLength {
+		return false
+	}
+
+	for _, r := range label {
+		if !('A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func validateTeamSize(maxTeamSize *int) []fieldError {
+	if maxTeamSize != nil && (*maxTeamSize < 1 || *maxTeamSize > maxTeamMembers) {
+		return []fieldError{{Field: "max_team_size", Message: fmt.Sprintf("must be between 1 and %d", maxTeamMembers)}}
+	}
+
+	return nil
+}
+
+func validateVisibility(visibility string) []fieldError {
+	switch visibility {
+	case visibilityPublic, visibilityUnlisted, visibilityPrivate:
+		return nil
+	}
+
+	return []fieldError{{Field: "visibility", Message: "must be public, unlisted or private"}}
+}
+
+func validateTeamName(name string) []fieldError {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return []fieldError{{Field: "name", Message: "is required"}}
+	case utf8.RuneCountInString(name) > maxTeamNameLength:
+		return []fieldError{{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxTeamNameLength)}}
+	}
+
+	return nil
+}
+
+// verifyProblems asks problem-management-service whether every problem
+// exists and has a statement participants can read. Unlike fetchProblems it
+// always asks the service itself: no cached or stale copy is trusted, and
+// nothing is queued when the service is rate limited. An error means the
+// check could not be made; callers must not assume the problems are valid.
+// The problems are returned so that their revisions can be pinned.
+func verifyProblems(ctx context.Context, problemIDs []int) (map[int]Problem, []invalidProblem, error) {
+	problems := make(map[int]Problem, len(problemIDs))
+	if len(problemIDs) == 0 {
+		return problems, nil, nil
+	}
+
+	batch, err := requestProblemsOnce(ctx, problemIDs, "problem_management")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, problem := range batch.Data {
+		problems[problem.ID] = problem
+	}
+
+	missing := make(map[int]bool, len(batch.Missing))
+	for _, problemID := range batch.Missing {
+		missing[problemID] = true
+	}
+
+	var invalid []invalidProblem
+	for _, problemID := range problemIDs {
+		problem, ok := problems[problemID]
+		switch {
+		case missing[problemID] || !ok:
+			invalid = append(invalid, invalidProblem{ID: problemID, Reason: errProblemNotFound.Error()})
+		case strings.TrimSpace(problem.Title) == "" || strings.TrimSpace(problem.Description) == "":
+			invalid = append(invalid, invalidProblem{ID: problemID, Reason: "problem has no statement"})
+		}
+	}
+
+	return problems, invalid, nil
+}
+
+// checkProblems verifies the problems of set and pins their revisions. It
+// answers the request if they cannot be used, reporting whether the handler
+// may go on.
+func checkProblems(c *gin.Context, set []CompetitionProblem) bool {
+	problemIDs := problemIDsOf(set)
+	problems, invalid, err := verifyProblems(c.Request.Context(), problemIDs)
+	if err != nil {
+		log.Printf("Failed to verify problems %v: %v\n", problemIDs, err)
+		if retryAfter := verifyRetryAfter(err); retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not verify the problems, try again later"})
+		return false
+	}
+
+	if len(invalid) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Some problems cannot be used in a competition", "invalid_problems": invalid})
+		return false
+	}
+
+	pinRevisions(set, problems)
+	return true
+}
+
+// verifyRetryAfter is how long a client should wait before trying again
+// after verifyProblems failed with err, or zero if there is nothing to go on.
+// Rate limits pass on the problem service's Retry-After, or ours.
+func verifyRetryAfter(err error) time.Duration {
+	var rateLimited *httpclient.RateLimitedError
+	switch {
+	case errors.As(err, &rateLimited):
+		return rateLimited.RetryAfter
+	case errors.Is(err, errOutgoingLimited):
+		return upstreamBackoff("problem_management")
+	default:
+		return 0
+	}
+}
+
+func respondWithFieldErrors(c *gin.Context, errs []fieldError) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "details": errs})
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"shared/httpclient"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPointer(value int) *int {
+	return &value
+}
+
+func TestValidateVisibility(t *testing.T) {
+	tests := []struct {
+		visibility string
+		wantErr    bool
+	}{
+		{visibilityPublic, false},
+		{visibilityUnlisted, false},
+		{visibilityPrivate, false},
+		{"", true},
+		{"Public", true},
+		{"secret", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.visibility, func(t *testing.T) {
+			if errs := validateVisibility(test.visibility); (len(errs) > 0) != test.wantErr {
+				t.Errorf("validateVisibility(%q) = %v, want error %v", test.visibility, errs, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateProblemSet(t *testing.T) {
+	tooMany := make([]CompetitionProblem, maxCompetitionProblems+1)
+	for i := range tooMany {
+		tooMany[i] = CompetitionProblem{ProblemID: i + 1, Label: positionLabel(i % 26)}
+	}
+
+	tests := []struct {
+		name       string
+		set        []CompetitionProblem
+		wantFields []string
+	}{
+		{
+			name: "valid",
+			set: []CompetitionProblem{
+				{ProblemID: 1, Label: "A", Points: 100},
+				{ProblemID: 2, Label: "B2", Points: 0, TimeLimitMS: intPointer(2000), MemoryLimitMB: intPointer(256)},
+			},
+		},
+		{name: "empty", set: nil, wantFields: []string{"problems"}},
+		{name: "too many", set: tooMany, wantFields: []string{"problems"}},
+		{
+			name:       "invalid problem ID",
+			set:        []CompetitionProblem{{ProblemID: 0, Label: "A"}},
+			wantFields: []string{"problems[0].problem_id"},
+		},
+		{
+			name:       "duplicate problem",
+			set:        []CompetitionProblem{{ProblemID: 1, Label: "A"}, {ProblemID: 1, Label: "B"}},
+			wantFields: []string{"problems[1].problem_id"},
+		},
+		{
+			name:       "duplicate label",
+			set:        []CompetitionProblem{{ProblemID: 1, Label: "A"}, {ProblemID: 2, Label: "A"}},
+			wantFields: []string{"problems[1].label"},
+		},
+		{
+			name:       "invalid labels",
+			set:        []CompetitionProblem{{ProblemID: 1, Label: ""}, {ProblemID: 2, Label: "A-1"}, {ProblemID: 3, Label: strings.Repeat("A", maxLabelLength+1)}},
+			wantFields: []string{"problems[0].label", "problems[1].label", "problems[2].label"},
+		},
+		{
+			name:       "negative points",
+			set:        []CompetitionProblem{{ProblemID: 1, Label: "A", Points: -1}},
+			wantFields: []string{"problems[0].points"},
+		},
+		{
+			name: "limits out of range",
+			set: []CompetitionProblem{
+				{ProblemID: 1, Label: "A", TimeLimitMS: intPointer(0), MemoryLimitMB: intPointer(maxMemoryLimitMB + 1)},
+				{ProblemID: 2, Label: "B", TimeLimitMS: intPointer(maxTimeLimitMS + 1)},
+			},
+			wantFields: []string{"problems[0].time_limit_ms", "problems[0].memory_limit_mb", "problems[1].time_limit_ms"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validateProblemSet(test.set)
+
+			var fields []string
+			for _, err := range errs {
+				fields = append(fields, err.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(test.wantFields, ",") {
+				t.Errorf("validateProblemSet() fields = %v, want %v", fields, test.wantFields)
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"plain", "Spring Cup", false},
+		{"longest", strings.Repeat("ü", maxNameLength), false},
+		{"empty", "", true},
+		{"blank", "   ", true},
+		{"too long", strings.Repeat("a", maxNameLength+1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errs := validateName(test.value); (len(errs) > 0) != test.wantErr {
+				t.Errorf("validateName() = %v, want error %v", errs, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDescription(t *testing.T) {
+	if errs := validateDescription(strings.Repeat("a", maxDescriptionLength)); len(errs) > 0 {
+		t.Errorf("validateDescription() = %v, want no error at the limit", errs)
+	}
+	if errs := validateDescription(strings.Repeat("a", maxDescriptionLength+1)); len(errs) == 0 {
+		t.Error("validateDescription() accepted a description over the limit")
+	}
+}
+
+func TestValidateTeamSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    *int
+		wantErr bool
+	}{
+		{"individual", nil, false},
+		{"one", intPointer(1), false},
+		{"largest", intPointer(maxTeamMembers), false},
+		{"zero", intPointer(0), true},
+		{"too large", intPointer(maxTeamMembers + 1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errs := validateTeamSize(test.size); (len(errs) > 0) != test.wantErr {
+				t.Errorf("validateTeamSize() = %v, want error %v", errs, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidSchedule(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		startsAt *time.Time
+		endsAt   *time.Time
+		want     bool
+	}{
+		{"open", nil, nil, true},
+		{"start only", &now, nil, true},
+		{"end only", nil, &now, true},
+		{"end after start", &now, &later, true},
+		{"end at start", &now, &now, false},
+		{"end before start", &later, &now, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := validSchedule(test.startsAt, test.endsAt); got != test.want {
+				t.Errorf("validSchedule() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveProblemSet(t *testing.T) {
+	label := "X"
+	points := 250
+
+	tests := []struct {
+		name       string
+		problems   []problemSpec
+		problemIDs []int
+		want       []CompetitionProblem
+	}{
+		{
+			name:       "plain IDs get default settings",
+			problemIDs: []int{7, 3},
+			want: []CompetitionProblem{
+				{ProblemID: 7, Label: "A", Position: 1, Points: defaultProblemPoints},
+				{ProblemID: 3, Label: "B", Position: 2, Points: defaultProblemPoints},
+			},
+		},
+		{
+			name:       "entries win over IDs",
+			problems:   []problemSpec{{ProblemID: 5, Label: &label, Points: &points, TimeLimitMS: intPointer(1000)}},
+			problemIDs: []int{7},
+			want:       []CompetitionProblem{{ProblemID: 5, Label: "X", Position: 1, Points: 250, TimeLimitMS: intPointer(1000)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := resolveProblemSet(test.problems, test.problemIDs)
+			if !sameProblemSet(got, test.want) {
+				t.Errorf("resolveProblemSet() = %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if got[i].Position != test.want[i].Position {
+					t.Errorf("position of %d = %d, want %d", got[i].ProblemID, got[i].Position, test.want[i].Position)
+				}
+			}
+		})
+	}
+}
+
+func TestPositionLabel(t *testing.T) {
+	tests := map[int]string{0: "A", 1: "B", 25: "Z"}
+	for index, want := range tests {
+		if got := positionLabel(index); got != want {
+			t.Errorf("positionLabel(%d) = %s, want %s", index, got, want)
+		}
+	}
+}
+
+func TestSameProblemSet(t *testing.T) {
+	base := []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 100, TimeLimitMS: intPointer(1000)}}
+
+	tests := []struct {
+		name  string
+		other []CompetitionProblem
+		want  bool
+	}{
+		{"equal", []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 100, TimeLimitMS: intPointer(1000)}}, true},
+		{"other problem", []CompetitionProblem{{ProblemID: 2, Label: "A", Points: 100, TimeLimitMS: intPointer(1000)}}, false},
+		{"other label", []CompetitionProblem{{ProblemID: 1, Label: "B", Points: 100, TimeLimitMS: intPointer(1000)}}, false},
+		{"other points", []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 50, TimeLimitMS: intPointer(1000)}}, false},
+		{"limit removed", []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 100}}, false},
+		{"other limit", []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 100, TimeLimitMS: intPointer(2000)}}, false},
+		{"other revision", []CompetitionProblem{{ProblemID: 1, Label: "A", Points: 100, TimeLimitMS: intPointer(1000), Revision: 3}}, true},
+		{"extra problem", append([]CompetitionProblem{}, base[0], CompetitionProblem{ProblemID: 2, Label: "B"}), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameProblemSet(base, test.other); got != test.want {
+				t.Errorf("sameProblemSet() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPinRevisions(t *testing.T) {
+	set := []CompetitionProblem{{ProblemID: 1, Label: "A"}, {ProblemID: 2, Label: "B"}}
+	pinRevisions(set, map[int]Problem{1: {ID: 1, Revision: 4}, 2: {ID: 2, Revision: 1}})
+
+	if set[0].Revision != 4 || set[1].Revision != 1 {
+		t.Errorf("pinRevisions() revisions = %d, %d, want 4, 1", set[0].Revision, set[1].Revision)
+	}
+}
+
+func TestVerifyRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"upstream rate limit", &httpclient.RateLimitedError{RetryAfter: 7 * time.Second, Upstream: true}, 7 * time.Second},
+		{"wrapped rate limit", fmt.Errorf("fetch: %w", &httpclient.RateLimitedError{RetryAfter: time.Second}), time.Second},
+		{"other failure", errors.New("connection refused"), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verifyRetryAfter(test.err); got != test.want {
+				t.Errorf("verifyRetryAfter() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"shared/events"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const virtualSessionColumns = `id, competition_id, user_id, username, starts_at, ends_at, created_at`
+
+func scanVirtualSession(row rowScanner, session *VirtualSession) error {
+	return row.Scan(&session.ID, &session.CompetitionID, &session.UserID, &session.Username, &session.StartsAt, &session.EndsAt, &session.CreatedAt)
+}
+
+// setStatus fills in the fields that depend on the time of the request.
+func (s *VirtualSession) setStatus(now time.Time) {
+	s.Status = virtualFinished
+	s.RemainingSeconds = 0
+	if s.running(now) {
+		s.Status = virtualRunning
+		s.RemainingSeconds = int(s.EndsAt.Sub(now).Seconds())
+	}
+}
+
+// virtualDuration is how long a virtual run of the competition lasts: as
+// long as the competition itself, which ran from creation if it had no start
+// time.
+func virtualDuration(competition Competition) time.Duration {
+	startsAt := competition.CreatedAt
+	if competition.StartsAt != nil {
+		startsAt = *competition.StartsAt
+	}
+
+	return competition.EndsAt.Sub(startsAt)
+}
+
+// startVirtualSession starts the calling user's virtual run of a competition
+// that has ended. The run starts right away and lets the user submit until
+// it ends; leaderboard-service ranks it against the final standings. Each
+// user gets one run per competition, and only if they did not take part in
+// it. Team competitions have no virtual runs, since a run is one user's.
+func startVirtualSession(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var competition Competition
+	err = scanCompetition(tx.QueryRow(ctx, `SELECT `+competitionColumns+` FROM competitions WHERE id = $1 FOR SHARE`, c.Param("id")), &competition)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Competition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch competition"})
+		return
+	}
+
+	if !requireAccess(c, competition.ID, competition.Visibility) {
+		return
+	}
+
+	switch {
+	case competition.status(time.Now()) != competitionEnded:
+		c.JSON(http.StatusConflict, gin.H{"error": "Only competitions that have ended can be run virtually"})
+		return
+	case competition.MaxTeamSize != nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "Team competitions cannot be run virtually"})
+		return
+	}
+
+	var registered bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM competition_registrations WHERE competition_id = $1 AND user_id = $2)`, competition.ID, user.UserID()).Scan(&registered)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check registrations"})
+		return
+	}
+	if registered {
+		c.JSON(http.StatusConflict, gin.H{"error": "You took part in this competition"})
+		return
+	}
+
+	var session VirtualSession
+	query := `INSERT INTO virtual_sessions (competition_id, user_id, username, starts_at, ends_at)
+		VALUES ($1, $2, $3, NOW(), NOW() + $4 * INTERVAL '1 second') RETURNING ` + virtualSessionColumns
+	err = scanVirtualSession(tx.QueryRow(ctx, query, competition.ID, user.UserID(), user.Username, int(virtualDuration(competition).Seconds())), &session)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "You already ran this competition virtually"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start virtual run"})
+		return
+	}
+
+	payload, version, err := events.Marshal(events.VirtualSessionStarted, events.VirtualSessionStartedEvent{
+		CompetitionID: session.CompetitionID,
+		SessionID:     session.ID,
+		UserID:        session.UserID,
+		Username:      session.Username,
+		StartsAt:      session.StartsAt,
+		EndsAt:        session.EndsAt,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", events.VirtualSessionStarted, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode event"})
+		return
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), events.VirtualSessionStarted, version, payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	log.Printf("User %d started a virtual run of competition %d until %s\n", session.UserID, session.CompetitionID, session.EndsAt.Format(time.RFC3339))
+	session.setStatus(time.Now())
+	c.JSON(http.StatusCreated, session)
+}
+
+// getMyVirtualSession returns the calling user's virtual run of a
+// competition, with the time it has left.
+func getMyVirtualSession(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	var session VirtualSession
+	query := `SELECT ` + virtualSessionColumns + ` FROM virtual_sessions WHERE competition_id = $1 AND user_id = $2`
+	err := scanVirtualSession(dbPool.QueryRow(ctx, query, c.Param("id"), user.UserID()), &session)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No virtual run of this competition"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch virtual run"})
+		return
+	}
+
+	session.setStatus(time.Now())
+	conditional.JSON(c, session, time.Time{}, conditional.Private)
+}
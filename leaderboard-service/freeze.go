@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// freezeInterval is how often ended competitions are looked for. A virtual
+// run freezes its leaderboard right away, so the standings only wait this
+// long when nobody runs the competition virtually.
+const freezeInterval = time.Minute
+
+// freezeEndedLeaderboards copies the standings of every competition that has
+// ended into final_standings, so that virtual runs are ranked against the
+// standings as they were at ends_at rather than the live entries.
+func freezeEndedLeaderboards() {
+	for {
+		rows, err := dbPool.Query(ctx, "SELECT id FROM leaderboards WHERE frozen_at IS NULL AND ends_at <= NOW()")
+		if err != nil {
+			log.Printf("Failed to fetch ended leaderboards: %v\n", err)
+			time.Sleep(freezeInterval)
+			continue
+		}
+
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if err := freezeLeaderboardNow(id); err != nil {
+				log.Printf("Failed to freeze leaderboard %d: %v\n", id, err)
+			}
+		}
+
+		time.Sleep(freezeInterval)
+	}
+}
+
+func freezeLeaderboardNow(leaderboardID int) error {
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := freezeLeaderboard(tx, leaderboardID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// freezeLeaderboard copies the leaderboard's entries into final_standings
+// unless that was done already. The row lock keeps the copy from racing a
+// judged submission, which reads frozen_at under a shared lock to decide
+// whether its points also belong in the final standings.
+func freezeLeaderboard(tx pgx.Tx, leaderboardID int) error {
+	var frozen bool
+	err := tx.QueryRow(ctx, "SELECT frozen_at IS NOT NULL FROM leaderboards WHERE id = $1 FOR UPDATE", leaderboardID).Scan(&frozen)
+	if err != nil || frozen {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO final_standings (leaderboard_id, user_id, username, team_id, team_name, score, updated_at)
+		SELECT leaderboard_id, user_id, username, team_id, team_name, score, updated_at FROM leaderboard_entries WHERE leaderboard_id = $1 ORDER BY id`,
+		leaderboardID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE leaderboards SET frozen_at = NOW() WHERE id = $1", leaderboardID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Froze the final standings of leaderboard %d\n", leaderboardID)
+	return nil
+}
@@ -3,10 +3,64 @@ package main
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"shared/auth"
+	"shared/conditional"
+	"time"
 )
 
+// Standings move with every judged submission, so shared caches may only
+// hold them briefly. Leaderboards carry no Last-Modified because removing an
+// entry changes them without touching any updated_at.
+var leaderboardCacheControl = conditional.Public(5 * time.Second)
+
+const (
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+// canView reports whether user may read a leaderboard. Public and unlisted
+// leaderboards are open to everyone. A private one is open to moderators, the
+// viewers competition-service announced, and everyone with an entry, alone or
+// as a team member. user is nil for anonymous requests.
+func canView(user *auth.Claims, leaderboard Leaderboard) (bool, error) {
+	if leaderboard.Visibility != visibilityPrivate {
+		return true, nil
+	}
+	if user == nil {
+		return false, nil
+	}
+	if user.Can(auth.PermLeaderboardsModerate) {
+		return true, nil
+	}
+
+	var allowed bool
+	query := `SELECT EXISTS (SELECT 1 FROM leaderboard_viewers WHERE leaderboard_id = $1 AND (user_id = $2 OR organization = NULLIF($3, '')))
+		OR EXISTS (SELECT 1 FROM leaderboard_entries WHERE leaderboard_id = $1 AND user_id = $2)
+		OR EXISTS (SELECT 1 FROM leaderboard_team_members WHERE leaderboard_id = $1 AND user_id = $2)`
+	err := dbPool.QueryRow(ctx, query, leaderboard.ID, user.UserID(), user.Organization).Scan(&allowed)
+	return allowed, err
+}
+
+// getLeaderboards lists public leaderboards. Signed-in users also see the
+// others they may read, and moderators see every leaderboard.
 func getLeaderboards(c *gin.Context) {
-	rows, err := dbPool.Query(ctx, "SELECT id, competition_id, created_at, updated_at FROM leaderboards")
+	user, _ := auth.User(c)
+	cacheControl := leaderboardCacheControl
+	var userID int
+	var organization string
+	var moderator bool
+	if user != nil {
+		cacheControl = conditional.Private
+		userID, organization, moderator = user.UserID(), user.Organization, user.Can(auth.PermLeaderboardsModerate)
+	}
+
+	query := `SELECT ` + leaderboardColumns + ` FROM leaderboards
+		WHERE visibility = $1 OR $4 OR id IN (
+			SELECT leaderboard_id FROM leaderboard_viewers WHERE user_id = $2 OR organization = NULLIF($3, '')
+			UNION SELECT leaderboard_id FROM leaderboard_entries WHERE user_id = $2
+			UNION SELECT leaderboard_id FROM leaderboard_team_members WHERE user_id = $2
+		)`
+	rows, err := dbPool.Query(ctx, query, visibilityPublic, userID, organization, moderator)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch leaderboards"})
 		return
@@ -16,28 +70,242 @@ func getLeaderboards(c *gin.Context) {
 	var leaderboards []Leaderboard
 	for rows.Next() {
 		var leaderboard Leaderboard
-		if err := rows.Scan(&leaderboard.ID, &leaderboard.CompetitionID, &leaderboard.CreatedAt, &leaderboard.UpdatedAt); err != nil {
+		if err := scanLeaderboard(rows, &leaderboard); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan leaderboards"})
 			return
 		}
 		leaderboards = append(leaderboards, leaderboard)
 	}
 
-	c.JSON(http.StatusOK, leaderboards)
+	conditional.JSON(c, leaderboards, time.Time{}, cacheControl)
 }
 
+// loadVisibleLeaderboard loads the leaderboard of the request if the caller
+// may read it, answering the request otherwise. Private leaderboards answer
+// 404 so that they do not reveal they exist.
+func loadVisibleLeaderboard(c *gin.Context) (Leaderboard, bool) {
+	var leaderboard Leaderboard
+	err := scanLeaderboard(dbPool.QueryRow(ctx, `SELECT `+leaderboardColumns+` FROM leaderboards WHERE id = $1`, c.Param("id")), &leaderboard)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard not found"})
+		return leaderboard, false
+	}
+
+	user, _ := auth.User(c)
+	allowed, err := canView(user, leaderboard)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return leaderboard, false
+	}
+	if !allowed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard not found"})
+		return leaderboard, false
+	}
+
+	return leaderboard, true
+}
+
+// getLeaderboard returns the standings. With ?virtual=true, once the
+// competition has ended, it returns the final standings instead, with virtual
+// runs overlaid on them, each ranked against the final standings only.
 func getLeaderboard(c *gin.Context) {
+	leaderboard, ok := loadVisibleLeaderboard(c)
+	if !ok {
+		return
+	}
+
+	query := `SELECT ` + entryColumns + `, RANK() OVER (ORDER BY score DESC), updated_at, FALSE
+		FROM leaderboard_entries WHERE leaderboard_id = $1 ORDER BY score DESC, id`
+	if c.Query("virtual") == "true" && leaderboard.FrozenAt != nil {
+		query = `SELECT user_id, username, team_id, team_name, score, rank, updated_at, is_virtual FROM (
+			SELECT ` + entryColumns + `, RANK() OVER (ORDER BY score DESC) AS rank, updated_at, FALSE AS is_virtual, id
+			FROM final_standings WHERE leaderboard_id = $1
+			UNION ALL
+			SELECT ` + virtualEntryColumns + `, TRUE, id FROM virtual_entries v WHERE leaderboard_id = $1
+		) standings ORDER BY score DESC, is_virtual, id`
+	}
+
+	rows, err := dbPool.Query(ctx, query, leaderboard.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch leaderboard entries"})
+		return
+	}
+	defer rows.Close()
+
+	leaderboard.Entries = []LeaderboardEntry{}
+	for rows.Next() {
+		var entry LeaderboardEntry
+		if err := rows.Scan(&entry.UserID, &entry.Username, &entry.TeamID, &entry.TeamName, &entry.Score, &entry.Rank, &entry.UpdatedAt, &entry.Virtual); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan leaderboard entries"})
+			return
+		}
+		leaderboard.Entries = append(leaderboard.Entries, entry)
+	}
+	rows.Close()
+
+	members, err := loadTeamMembers(leaderboard.ID, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team members"})
+		return
+	}
+	for i, entry := range leaderboard.Entries {
+		if entry.TeamID != nil {
+			leaderboard.Entries[i].Members = members[*entry.TeamID]
+		}
+	}
+
+	cacheControl := leaderboardCacheControl
+	if leaderboard.Visibility != visibilityPublic {
+		cacheControl = conditional.Private
+	}
+	conditional.JSON(c, leaderboard, time.Time{}, cacheControl)
+}
+
+// getMyEntry returns the calling user's standing on a leaderboard, or their
+// team's in a team competition. Having an entry is enough to see a private
+// leaderboard, so no access check is needed.
+func getMyEntry(c *gin.Context) {
 	id := c.Param("id")
-	var leaderboard Leaderboard
+	user, _ := auth.User(c)
+
+	var entry LeaderboardEntry
+	err := scanEntry(dbPool.QueryRow(ctx,
+		`SELECT user_id, username, team_id, team_name, score, rank, updated_at FROM (
+			SELECT `+entryColumns+`, RANK() OVER (ORDER BY score DESC) AS rank, updated_at
+			FROM leaderboard_entries WHERE leaderboard_id = $1
+		) ranked WHERE user_id = $2 OR team_id = (
+			SELECT team_id FROM leaderboard_team_members WHERE leaderboard_id = $1 AND user_id = $2
+		)`,
+		id, user.UserID(),
+	), &entry)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard entry not found"})
+		return
+	}
+
+	if entry.TeamID != nil {
+		members, err := loadTeamMembers(id, entry.TeamID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch team members"})
+			return
+		}
+		entry.Members = members[*entry.TeamID]
+	}
 
+	conditional.JSON(c, entry, time.Time{}, conditional.Private)
+}
+
+// getMyVirtualEntry returns the calling user's virtual run, with the rank it
+// would have had in the final standings and how many entries those hold.
+func getMyVirtualEntry(c *gin.Context) {
+	user, _ := auth.User(c)
+
+	var entry VirtualEntry
 	err := dbPool.QueryRow(ctx,
-		"SELECT id, competition_id, created_at, updated_at FROM leaderboards WHERE id = $1",
-		id,
-	).Scan(&leaderboard.ID, &leaderboard.CompetitionID, &leaderboard.CreatedAt, &leaderboard.UpdatedAt)
+		`SELECT v.user_id, v.username, v.score,
+			1 + (SELECT COUNT(*) FROM final_standings f WHERE f.leaderboard_id = v.leaderboard_id AND f.score > v.score),
+			(SELECT COUNT(*) FROM final_standings f WHERE f.leaderboard_id = v.leaderboard_id),
+			v.starts_at, v.ends_at, v.updated_at
+		FROM virtual_entries v WHERE v.leaderboard_id = $1 AND v.user_id = $2`,
+		c.Param("id"), user.UserID(),
+	).Scan(&entry.UserID, &entry.Username, &entry.Score, &entry.Rank, &entry.Participants, &entry.StartsAt, &entry.EndsAt, &entry.UpdatedAt)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard not found"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Virtual entry not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, leaderboard)
+	conditional.JSON(c, entry, time.Time{}, conditional.Private)
+}
+
+// removeEntry takes a participant off a leaderboard, e.g. after a
+// disqualification.
+func removeEntry(c *gin.Context) {
+	id := c.Param("id")
+	userID := c.Param("userId")
+
+	tag, err := dbPool.Exec(ctx, "DELETE FROM leaderboard_entries WHERE leaderboard_id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove leaderboard entry"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard entry not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// removeTeamEntry takes a team and its roster off a leaderboard.
+func removeTeamEntry(c *gin.Context) {
+	id := c.Param("id")
+	teamID := c.Param("teamId")
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "DELETE FROM leaderboard_entries WHERE leaderboard_id = $1 AND team_id = $2", id, teamID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove leaderboard entry"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Leaderboard entry not found"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM leaderboard_team_members WHERE leaderboard_id = $1 AND team_id = $2", id, teamID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove team members"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// loadTeamMembers returns the registered rosters of a leaderboard's teams,
+// or of one team if teamID is set.
+func loadTeamMembers(leaderboardID interface{}, teamID *int) (map[int][]TeamMember, error) {
+	rows, err := dbPool.Query(ctx,
+		`SELECT team_id, user_id, username FROM leaderboard_team_members
+		WHERE leaderboard_id = $1 AND ($2::INT IS NULL OR team_id = $2) ORDER BY team_id, user_id`,
+		leaderboardID, teamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[int][]TeamMember)
+	for rows.Next() {
+		var teamID int
+		var member TeamMember
+		if err := rows.Scan(&teamID, &member.UserID, &member.Username); err != nil {
+			return nil, err
+		}
+		members[teamID] = append(members[teamID], member)
+	}
+
+	return members, rows.Err()
+}
+
+func healthCheck(c *gin.Context) {
+	status := http.StatusOK
+	rabbitMQStatus := "connected"
+	if !broker.Connected() {
+		status = http.StatusServiceUnavailable
+		rabbitMQStatus = "disconnected"
+	}
+
+	c.JSON(status, gin.H{"rabbitmq": rabbitMQStatus})
 }
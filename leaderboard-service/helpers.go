@@ -2,39 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"shared/events"
 )
 
+// errNoLeaderboard reports an event that reached the inbox before the
+// competition_created event of its competition, which comes on another queue.
+// The inbox defers such events rather than counting them as failures.
+var errNoLeaderboard = errors.New("no leaderboard yet")
+
+// errNoEntry reports a judged submission that reached the inbox before the
+// registration or virtual run it counts for. The inbox defers it like an event
+// without a leaderboard.
+var errNoEntry = errors.New("no entry yet")
+
 func handleCompetitionCreated(payload []byte) error {
-	var event struct {
-		CompetitionID int `json:"id"`
-	}
+	var event events.CompetitionCreatedEvent
 
 	if err := json.Unmarshal(payload, &event); err != nil {
 		return err
 	}
 
-	_, err := dbPool.Exec(ctx, "INSERT INTO leaderboards (competition_id, created_at, updated_at) VALUES ($1, NOW(), NOW())", event.CompetitionID)
+	var leaderboardID int
+	err := dbPool.QueryRow(ctx,
+		"INSERT INTO leaderboards (competition_id, competition_name, starts_at, ends_at, visibility, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, NOW(), NOW()) RETURNING id",
+		event.CompetitionID, event.Name, event.StartsAt, event.EndsAt, event.Visibility,
+	).Scan(&leaderboardID)
 	if err != nil {
 		return err
 	}
 
-	eventId := uuid.New().String()
-
-	successEvent := map[string]interface{}{
-		"event_id":       eventId,
-		"competition_id": event.CompetitionID,
+	successPayload, version, err := events.Marshal(events.LeaderboardSuccess, events.LeaderboardSuccessEvent{
+		CompetitionID: event.CompetitionID,
+		LeaderboardID: leaderboardID,
+	})
+	if err != nil {
+		return err
 	}
 
-	payload, _ = json.Marshal(successEvent)
-	_, err = dbPool.Exec(ctx, "INSERT INTO outbox (event_id, event_type, payload) VALUES ($1, $2, $3)", uuid.New().String(), "leaderboard_success", payload)
+	_, err = dbPool.Exec(ctx, "INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)", uuid.New().String(), events.LeaderboardSuccess, version, successPayload)
 	return err
 }
 
 func handleRollback(payload []byte) error {
-	var event struct {
-		CompetitionID int `json:"competition_id"`
-	}
+	var event events.RollbackEvent
 
 	if err := json.Unmarshal(payload, &event); err != nil {
 		return err
@@ -43,3 +58,305 @@ func handleRollback(payload []byte) error {
 	_, err := dbPool.Exec(ctx, "DELETE FROM leaderboards WHERE competition_id = $1", event.CompetitionID)
 	return err
 }
+
+// handleParticipantRegistered adds a zero-score entry for a newly registered
+// user. Registrations travel on their own queue and can overtake the
+// competition_created event, so a missing leaderboard is returned as an error
+// and the inbox retries the event.
+func handleParticipantRegistered(payload []byte) error {
+	var event events.ParticipantRegisteredEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	var leaderboardID int
+	err := dbPool.QueryRow(ctx, "SELECT id FROM leaderboards WHERE competition_id = $1", event.CompetitionID).Scan(&leaderboardID)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = dbPool.Exec(ctx,
+		"INSERT INTO leaderboard_entries (leaderboard_id, user_id, username) VALUES ($1, $2, $3) ON CONFLICT (leaderboard_id, user_id) DO NOTHING",
+		leaderboardID, event.UserID, event.Username,
+	)
+	return err
+}
+
+// handleTeamRegistered adds a zero-score entry for a team along with the
+// roster it was registered with. Like registrations, it waits for the
+// leaderboard to exist.
+func handleTeamRegistered(payload []byte) error {
+	var event events.TeamRegisteredEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	var leaderboardID int
+	err := dbPool.QueryRow(ctx, "SELECT id FROM leaderboards WHERE competition_id = $1", event.CompetitionID).Scan(&leaderboardID)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO leaderboard_entries (leaderboard_id, team_id, team_name) VALUES ($1, $2, $3) ON CONFLICT (leaderboard_id, team_id) DO NOTHING",
+		leaderboardID, event.TeamID, event.TeamName,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range event.Members {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO leaderboard_team_members (leaderboard_id, team_id, user_id, username) VALUES ($1, $2, $3, $4) ON CONFLICT (leaderboard_id, user_id) DO NOTHING",
+			leaderboardID, event.TeamID, member.UserID, member.Username,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// handleVirtualSessionStarted adds a zero-score virtual entry. Like
+// registrations, it waits for the leaderboard to exist. Virtual runs only
+// start once the competition has ended, so the standings are frozen here
+// rather than left to freezeEndedLeaderboards.
+func handleVirtualSessionStarted(payload []byte) error {
+	var event events.VirtualSessionStartedEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	var leaderboardID int
+	err := dbPool.QueryRow(ctx, "SELECT id FROM leaderboards WHERE competition_id = $1", event.CompetitionID).Scan(&leaderboardID)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := freezeLeaderboard(tx, leaderboardID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO virtual_entries (leaderboard_id, session_id, user_id, username, starts_at, ends_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (session_id) DO NOTHING",
+		leaderboardID, event.SessionID, event.UserID, event.Username, event.StartsAt, event.EndsAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// handleSubmissionJudged adds a judged submission's points to the entry it
+// counts for: the virtual entry of a virtual run, the team's in team
+// competitions and the user's otherwise. A submission made before the end
+// but judged after the standings were frozen counts in the final standings
+// too. The points are recorded per submission, so that an event handled
+// twice is only counted once.
+func handleSubmissionJudged(payload []byte) error {
+	var event events.SubmissionJudgedEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	if event.Points == 0 {
+		return nil
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// The shared lock keeps freezeLeaderboard from copying the entries
+	// between the check of frozen_at and the update below.
+	var leaderboardID int
+	var frozen bool
+	err = tx.QueryRow(ctx, "SELECT id, frozen_at IS NOT NULL FROM leaderboards WHERE competition_id = $1 FOR SHARE", event.CompetitionID).Scan(&leaderboardID, &frozen)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx,
+		"INSERT INTO scored_submissions (submission_id, leaderboard_id, points) VALUES ($1, $2, $3) ON CONFLICT (submission_id) DO NOTHING",
+		event.SubmissionID, leaderboardID, event.Points,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	if event.VirtualSessionID != nil {
+		tag, err = tx.Exec(ctx,
+			"UPDATE virtual_entries SET score = score + $2, updated_at = NOW() WHERE session_id = $1",
+			*event.VirtualSessionID, event.Points,
+		)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("submission %d: %w", event.SubmissionID, errNoEntry)
+		}
+
+		return tx.Commit(ctx)
+	}
+
+	const scoreEntry = `SET score = score + $4, updated_at = NOW()
+		WHERE leaderboard_id = $1 AND CASE WHEN $2::INT IS NOT NULL THEN team_id = $2 ELSE user_id = $3 END`
+	tag, err = tx.Exec(ctx, "UPDATE leaderboard_entries "+scoreEntry, leaderboardID, event.TeamID, event.UserID, event.Points)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("submission %d: %w", event.SubmissionID, errNoEntry)
+	}
+
+	if frozen {
+		if _, err := tx.Exec(ctx, "UPDATE final_standings "+scoreEntry, leaderboardID, event.TeamID, event.UserID, event.Points); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// handleCompetitionUpdated copies the competition's new name and schedule.
+// Like registrations, updates can overtake competition_created, so a missing
+// leaderboard is an error and the inbox retries.
+func handleCompetitionUpdated(payload []byte) error {
+	var event events.CompetitionUpdatedEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	tag, err := dbPool.Exec(ctx,
+		"UPDATE leaderboards SET competition_name = $2, starts_at = $3, ends_at = $4, updated_at = NOW() WHERE competition_id = $1",
+		event.CompetitionID, event.Name, event.StartsAt, event.EndsAt,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+
+	return nil
+}
+
+// handleCompetitionCancelled archives the competition's leaderboard. The
+// entries are kept so that the standings at the time of cancellation remain
+// visible.
+func handleCompetitionCancelled(payload []byte) error {
+	var event events.CompetitionCancelledEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	tag, err := dbPool.Exec(ctx,
+		"UPDATE leaderboards SET archived_at = COALESCE(archived_at, $2), archive_reason = $3, updated_at = NOW() WHERE competition_id = $1",
+		event.CompetitionID, event.CancelledAt, event.Reason,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+
+	return nil
+}
+
+// handleCompetitionAccessChanged replaces a leaderboard's visibility and
+// viewers with those in the event. Like updates, it waits for the
+// leaderboard to exist. An event older than the last one applied is dropped,
+// so a retried or reordered event cannot bring back access that was revoked.
+func handleCompetitionAccessChanged(payload []byte) error {
+	var event events.CompetitionAccessChangedEvent
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var leaderboardID, accessVersion int
+	err = tx.QueryRow(ctx,
+		"SELECT id, access_version FROM leaderboards WHERE competition_id = $1 FOR UPDATE",
+		event.CompetitionID,
+	).Scan(&leaderboardID, &accessVersion)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("competition %d: %w", event.CompetitionID, errNoLeaderboard)
+	}
+	if err != nil {
+		return err
+	}
+
+	if event.AccessVersion < accessVersion {
+		log.Printf("Ignoring access version %d of competition %d, already at %d\n", event.AccessVersion, event.CompetitionID, accessVersion)
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE leaderboards SET visibility = $2, access_version = $3, updated_at = NOW() WHERE id = $1",
+		leaderboardID, event.Visibility, event.AccessVersion,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM leaderboard_viewers WHERE leaderboard_id = $1", leaderboardID); err != nil {
+		return err
+	}
+
+	for _, userID := range event.UserIDs {
+		if _, err := tx.Exec(ctx, "INSERT INTO leaderboard_viewers (leaderboard_id, user_id) VALUES ($1, $2)", leaderboardID, userID); err != nil {
+			return err
+		}
+	}
+	for _, organization := range event.Organizations {
+		if _, err := tx.Exec(ctx, "INSERT INTO leaderboard_viewers (leaderboard_id, organization) VALUES ($1, $2)", leaderboardID, organization); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -4,17 +4,19 @@ import (
 	"context"
 	"log"
 	"os"
+	"shared/auth"
+	"shared/rabbitmq"
+	"shared/retention"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/streadway/amqp"
 )
 
 var (
-	dbPool          *pgxpool.Pool
-	ctx             = context.Background()
-	rabbitMQConn    *amqp.Connection
-	rabbitMQChannel *amqp.Channel
+	dbPool    *pgxpool.Pool
+	ctx       = context.Background()
+	broker    *rabbitmq.Broker
+	jwtSecret []byte
 )
 
 const maxRetries = 5
@@ -28,95 +30,37 @@ func initDB() {
 	}
 }
 
-func initRabbitMQ() {
-	rabbitMQURL := os.Getenv("RABBITMQ_URL")
+func initJWT() {
 	var err error
-	rabbitMQConn, err = amqp.Dial(rabbitMQURL)
+	jwtSecret, err = auth.SecretFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to connect to RabbitMQ: %v\n", err)
+		log.Fatalf("Invalid JWT configuration: %v\n", err)
 	}
-
-	rabbitMQChannel, err = rabbitMQConn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to create RabbitMQ channel: %v\n", err)
-	}
-
-	_, err = rabbitMQChannel.QueueDeclare(
-		"competition_created", true, false, false, false, nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare competition_events queue: %v\n", err)
-	}
-
-	err = rabbitMQChannel.ExchangeDeclare(
-		"rollback_exchange",
-		"fanout",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare rollback exchange: %v\n", err)
-	}
-
-	createAndBindQueue("leaderboard_rollback_queue", "rollback_exchange")
-
-	_, err = rabbitMQChannel.QueueDeclare(
-		"leaderboard_success", true, false, false, false, nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare leaderboard_success queue: %v\n", err)
-	}
-}
-
-func createAndBindQueue(queueName string, exchangeName string) {
-	_, err := rabbitMQChannel.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare queue %s: %v\n", queueName, err)
-	}
-
-	err = rabbitMQChannel.QueueBind(
-		queueName,
-		"",
-		exchangeName,
-		false,
-		nil,
-	)
-	if err != nil {
-		log.Fatalf("Failed to bind queue %s to exchange %s: %v\n", queueName, exchangeName, err)
-	}
-}
-
-func startMessageConsumers() {
-	go consumeMessages("competition_created")
-	go consumeMessages("leaderboard_rollback_queue")
 }
 
 func main() {
 	initDB()
+	initJWT()
 	initRabbitMQ()
 
 	defer dbPool.Close()
-	defer rabbitMQConn.Close()
-	defer rabbitMQChannel.Close()
-
-	startMessageConsumers()
+	defer broker.Close()
 
 	go processInboxMessages()
 	go processOutbox()
+	go freezeEndedLeaderboards()
+	go retention.Run(ctx, dbPool, retention.ConfigFromEnv(true))
 
 	r := gin.Default()
+	r.Use(auth.Middleware(jwtSecret))
+
 	r.GET("/leaderboards/:id", getLeaderboard)
+	r.GET("/leaderboards/:id/me", auth.RequireUser(), getMyEntry)
+	r.GET("/leaderboards/:id/virtual/me", auth.RequireUser(), getMyVirtualEntry)
+	r.DELETE("/leaderboards/:id/entries/:userId", auth.RequirePermission(auth.PermLeaderboardsModerate), removeEntry)
+	r.DELETE("/leaderboards/:id/teams/:teamId", auth.RequirePermission(auth.PermLeaderboardsModerate), removeTeamEntry)
 	r.GET("/leaderboards", getLeaderboards)
+	r.GET("/health", healthCheck)
 
 	log.Println("Leaderboard Service running on port 8081")
 	if err := r.Run(":8080"); err != nil {
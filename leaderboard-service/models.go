@@ -3,8 +3,78 @@ package main
 import "time"
 
 type Leaderboard struct {
-	ID            int       `json:"id"`
-	CompetitionID int       `json:"competition_id"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID              int        `json:"id"`
+	CompetitionID   int        `json:"competition_id"`
+	CompetitionName string     `json:"competition_name"`
+	StartsAt        *time.Time `json:"starts_at"`
+	EndsAt          *time.Time `json:"ends_at"`
+	ArchivedAt      *time.Time `json:"archived_at,omitempty"`
+	ArchiveReason   string     `json:"archive_reason,omitempty"`
+	Visibility      string     `json:"visibility"`
+	// FrozenAt is when the final standings were taken, once the competition
+	// has ended.
+	FrozenAt  *time.Time         `json:"frozen_at,omitempty"`
+	Entries   []LeaderboardEntry `json:"entries,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+const leaderboardColumns = `id, competition_id, competition_name, starts_at, ends_at, archived_at, COALESCE(archive_reason, ''), visibility, frozen_at, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLeaderboard reads a row selected with leaderboardColumns.
+func scanLeaderboard(row rowScanner, leaderboard *Leaderboard) error {
+	return row.Scan(
+		&leaderboard.ID, &leaderboard.CompetitionID, &leaderboard.CompetitionName,
+		&leaderboard.StartsAt, &leaderboard.EndsAt, &leaderboard.ArchivedAt, &leaderboard.ArchiveReason, &leaderboard.Visibility,
+		&leaderboard.FrozenAt, &leaderboard.CreatedAt, &leaderboard.UpdatedAt,
+	)
+}
+
+// LeaderboardEntry ranks a user, or a team together with its members.
+type LeaderboardEntry struct {
+	UserID   *int         `json:"user_id,omitempty"`
+	Username string       `json:"username,omitempty"`
+	TeamID   *int         `json:"team_id,omitempty"`
+	TeamName string       `json:"team_name,omitempty"`
+	Members  []TeamMember `json:"members,omitempty"`
+	Score    int          `json:"score"`
+	Rank     int          `json:"rank"`
+	// Virtual marks a virtual run overlaid on the standings; its rank is
+	// where it would have placed among the real entries.
+	Virtual   bool      `json:"virtual,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type TeamMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+const entryColumns = `user_id, COALESCE(username, '') AS username, team_id, COALESCE(team_name, '') AS team_name, score`
+
+// virtualEntryColumns selects a virtual entry, aliased v, like entryColumns
+// followed by a rank selects a real one. The rank counts only the final
+// standings.
+const virtualEntryColumns = `v.user_id, v.username, NULL::INT, '', v.score,
+	1 + (SELECT COUNT(*) FROM final_standings f WHERE f.leaderboard_id = v.leaderboard_id AND f.score > v.score), v.updated_at`
+
+// VirtualEntry is a user's virtual run as ranked against the final
+// standings.
+type VirtualEntry struct {
+	UserID       int       `json:"user_id"`
+	Username     string    `json:"username"`
+	Score        int       `json:"score"`
+	Rank         int       `json:"rank"`
+	Participants int       `json:"participants"`
+	StartsAt     time.Time `json:"starts_at"`
+	EndsAt       time.Time `json:"ends_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func scanEntry(row rowScanner, entry *LeaderboardEntry) error {
+	return row.Scan(&entry.UserID, &entry.Username, &entry.TeamID, &entry.TeamName, &entry.Score, &entry.Rank, &entry.UpdatedAt)
 }
@@ -1,71 +1,99 @@
 package main
 
 import (
-	"encoding/json"
-	"github.com/streadway/amqp"
 	"log"
+	"shared/events"
+	"shared/notify"
+	"shared/rabbitmq"
 	"time"
 )
 
+const (
+	outboxBatchSize    = 100
+	outboxPollInterval = 5 * time.Second
+)
+
+// processOutbox publishes pending outbox events as soon as a NOTIFY reports a
+// new row, falling back to polling every outboxPollInterval.
 func processOutbox() {
+	wakeup := make(chan struct{}, 1)
+	go notify.Listen(ctx, dbPool, "outbox_events", wakeup)
+
 	for {
-		rows, err := dbPool.Query(ctx, "SELECT id, event_id, event_type, payload, retries FROM outbox WHERE processed = FALSE AND retries < $1 LIMIT 10", maxRetries)
+		if dispatchOutboxBatch() == outboxBatchSize {
+			continue
+		}
+
+		select {
+		case <-wakeup:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// dispatchOutboxBatch publishes up to outboxBatchSize events and returns how
+// many rows it picked up, so the caller can drain a backlog without waiting.
+func dispatchOutboxBatch() int {
+	rows, err := dbPool.Query(ctx, "SELECT id, event_id, event_type, version, payload, retries FROM outbox WHERE processed = FALSE AND retries < $1 ORDER BY id LIMIT $2", maxRetries, outboxBatchSize)
+	if err != nil {
+		log.Printf("Failed to fetch outbox events: %v\n", err)
+		return 0
+	}
+
+	var ids, retries []int
+	var messages []rabbitmq.Message
+	fetched := 0
+
+	for rows.Next() {
+		var id, version, retryCount int
+		var eventID, eventType string
+		var payload []byte
+
+		if err := rows.Scan(&id, &eventID, &eventType, &version, &payload, &retryCount); err != nil {
+			log.Printf("Failed to scan outbox row: %v\n", err)
+			continue
+		}
+		fetched++
+
+		eventPayload, err := events.NewEnvelope(eventID, eventType, version, payload)
 		if err != nil {
-			log.Printf("Failed to fetch outbox events: %v\n", err)
-			time.Sleep(1 * time.Second)
+			log.Printf("Failed to build envelope for outbox event ID %s: %v\n", eventID, err)
 			continue
 		}
 
-		for rows.Next() {
-			var id, retries int
-			var eventID, eventType string
-			var payload []byte
-
-			if err := rows.Scan(&id, &eventID, &eventType, &payload, &retries); err != nil {
-				log.Printf("Failed to scan outbox row: %v\n", err)
-				continue
-			}
-
-			var payloadMap map[string]interface{}
-
-			if err := json.Unmarshal(payload, &payloadMap); err != nil {
-				log.Printf("Failed to unmarshal payload for event ID %s: %v\n", eventID, err)
-				continue
-			}
-
-			event := map[string]interface{}{
-				"event_id":   eventID,
-				"event_type": eventType,
-				"payload":    payloadMap,
-			}
-
-			eventPayload, err := json.Marshal(event)
-
-			if err != nil {
-				log.Printf("Failed to marshal outbox event: %v\n", err)
-				continue
-			}
-
-			err = rabbitMQChannel.Publish(
-				"", "leaderboard_success", false, false,
-				amqp.Publishing{ContentType: "application/json", Body: eventPayload},
-			)
-			if err != nil {
-				log.Printf("Failed to publish outbox event (attempt %d/%d): %v\n", retries+1, maxRetries, err)
-				_, updateErr := dbPool.Exec(ctx, "UPDATE outbox SET retries = retries + 1 WHERE id = $1", id)
-				if updateErr != nil {
-					log.Printf("Failed to update retries for outbox event ID %s: %v\n", eventID, updateErr)
-				}
-				continue
-			}
-
-			_, err = dbPool.Exec(ctx, "UPDATE outbox SET processed = TRUE WHERE id = $1", id)
-			if err != nil {
-				log.Printf("Failed to mark outbox event as processed: %v\n", err)
-			}
+		ids = append(ids, id)
+		retries = append(retries, retryCount)
+		messages = append(messages, rabbitmq.Message{RoutingKey: "leaderboard_success", Body: eventPayload})
+	}
+	rows.Close()
+
+	if len(messages) == 0 {
+		return fetched
+	}
+
+	var publishedIDs, failedIDs []int
+	for i, err := range broker.PublishBatch(messages) {
+		if err != nil {
+			log.Printf("Failed to publish outbox event (attempt %d/%d): %v\n", retries[i]+1, maxRetries, err)
+			failedIDs = append(failedIDs, ids[i])
+			continue
 		}
+		publishedIDs = append(publishedIDs, ids[i])
+	}
 
-		rows.Close()
-		time.Sleep(1 * time.Second)
+	if len(failedIDs) > 0 {
+		_, err := dbPool.Exec(ctx, "UPDATE outbox SET retries = retries + 1 WHERE id = ANY($1)", failedIDs)
+		if err != nil {
+			log.Printf("Failed to update retries for outbox events: %v\n", err)
+		}
 	}
+
+	if len(publishedIDs) > 0 {
+		_, err := dbPool.Exec(ctx, "UPDATE outbox SET processed = TRUE WHERE id = ANY($1)", publishedIDs)
+		if err != nil {
+			log.Printf("Failed to mark outbox events as processed: %v\n", err)
+		}
+	}
+
+	return fetched
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"shared/rabbitmq"
+
+	"github.com/streadway/amqp"
+)
+
+// initRabbitMQ starts the connection manager in the background. The service
+// keeps serving HTTP while the broker is unavailable; publishes fail and are
+// retried by the outbox until the connection comes back.
+func initRabbitMQ() {
+	broker = rabbitmq.Connect(rabbitmq.Config{
+		URL:             os.Getenv("RABBITMQ_URL"),
+		DeclareTopology: declareTopology,
+		StartConsumers:  startMessageConsumers,
+		ConfirmBuffer:   outboxBatchSize,
+	})
+}
+
+func declareTopology(channel *amqp.Channel) error {
+	err := rabbitmq.DeclareQueues(channel,
+		"competition_created",
+		"leaderboard_success",
+		"participant_registered",
+		"team_registered",
+		"virtual_session_started",
+		"competition_updated",
+		"competition_cancelled",
+		"competition_access_changed",
+		"submission_judged",
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := rabbitmq.DeclareFanout(channel, "rollback_exchange"); err != nil {
+		return err
+	}
+
+	return rabbitmq.DeclareBoundQueue(channel, "leaderboard_rollback_queue", "rollback_exchange")
+}
+
+func startMessageConsumers(conn *amqp.Connection) {
+	for _, queueName := range []string{
+		"competition_created",
+		"leaderboard_rollback_queue",
+		"participant_registered",
+		"team_registered",
+		"virtual_session_started",
+		"competition_updated",
+		"competition_cancelled",
+		"competition_access_changed",
+		"submission_judged",
+	} {
+		go rabbitmq.RunConsumer(conn, queueName, consumeMessages)
+	}
+}
@@ -1,14 +1,104 @@
 CREATE TABLE leaderboards (
     id SERIAL PRIMARY KEY,
     competition_id INT NOT NULL UNIQUE,
+    competition_name TEXT NOT NULL DEFAULT '',
+    starts_at TIMESTAMP,
+    ends_at TIMESTAMP,
+    -- Set when the competition is cancelled; the standings stay readable.
+    archived_at TIMESTAMP,
+    archive_reason TEXT,
+    -- Copied from the competition; see leaderboard_viewers.
+    visibility VARCHAR(20) NOT NULL DEFAULT 'public',
+    -- Access version of the last competition_access_changed event applied.
+    access_version INT NOT NULL DEFAULT 0,
+    -- Set once the entries were copied into final_standings.
+    frozen_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT NOW(),
     updated_at TIMESTAMP DEFAULT NOW()
 );
 
+-- An entry ranks either a user or, in team competitions, a team.
+CREATE TABLE leaderboard_entries (
+    id SERIAL PRIMARY KEY,
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    user_id INT,
+    username VARCHAR(50),
+    team_id INT,
+    team_name VARCHAR(100),
+    score INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (leaderboard_id, user_id),
+    UNIQUE (leaderboard_id, team_id),
+    CHECK ((user_id IS NULL) <> (team_id IS NULL))
+);
+
+-- The roster each team was registered with, so that members find their
+-- team's entry.
+CREATE TABLE leaderboard_team_members (
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    team_id INT NOT NULL,
+    user_id INT NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    PRIMARY KEY (leaderboard_id, user_id)
+);
+
+-- Who besides participants and moderators may read a private leaderboard,
+-- as last announced by competition_access_changed.
+CREATE TABLE leaderboard_viewers (
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    user_id INT,
+    organization VARCHAR(100),
+    UNIQUE (leaderboard_id, user_id),
+    UNIQUE (leaderboard_id, organization),
+    CHECK ((user_id IS NULL) <> (organization IS NULL))
+);
+
+-- The standings as they were when the competition ended, copied from
+-- leaderboard_entries. Submissions made before the end but judged after it
+-- are added here too; removing or changing a live entry is not.
+CREATE TABLE final_standings (
+    id SERIAL PRIMARY KEY,
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    user_id INT,
+    username VARCHAR(50),
+    team_id INT,
+    team_name VARCHAR(100),
+    score INT NOT NULL,
+    updated_at TIMESTAMP,
+    UNIQUE (leaderboard_id, user_id),
+    UNIQUE (leaderboard_id, team_id)
+);
+
+-- Virtual runs of a competition that has ended. They are ranked against
+-- final_standings without being part of the standings.
+CREATE TABLE virtual_entries (
+    id SERIAL PRIMARY KEY,
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    session_id INT NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    score INT NOT NULL DEFAULT 0,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (leaderboard_id, user_id)
+);
+
+-- Judged submissions whose points were added to an entry.
+CREATE TABLE scored_submissions (
+    submission_id INT PRIMARY KEY,
+    leaderboard_id INT NOT NULL REFERENCES leaderboards (id) ON DELETE CASCADE,
+    points INT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
 CREATE TABLE outbox (
     id SERIAL PRIMARY KEY,
     event_id UUID NOT NULL UNIQUE,
     event_type TEXT NOT NULL,
+    version INT NOT NULL DEFAULT 1,
     payload JSONB NOT NULL,
     processed BOOLEAN DEFAULT FALSE,
     retries INT DEFAULT 0,
@@ -19,11 +109,51 @@ CREATE TABLE inbox (
     id SERIAL PRIMARY KEY,
     event_id UUID NOT NULL UNIQUE,
     event_type TEXT NOT NULL,
+    version INT NOT NULL DEFAULT 1,
     payload JSONB NOT NULL,
     processed BOOLEAN DEFAULT FALSE,
     retries INT DEFAULT 0,
     created_at TIMESTAMP DEFAULT NOW(),
-    processed_at TIMESTAMP
+    processed_at TIMESTAMP,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
+CREATE INDEX outbox_archivable_idx ON outbox (created_at) WHERE processed = TRUE;
+CREATE INDEX inbox_archivable_idx ON inbox (processed_at) WHERE processed = TRUE;
+
+-- Processed rows are moved here by the retention job. Monthly partitions are
+-- created on demand and dropped once older than ARCHIVE_RETENTION.
+CREATE TABLE outbox_archive (
+    id INT NOT NULL,
+    event_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    version INT NOT NULL,
+    payload JSONB NOT NULL,
+    retries INT,
+    created_at TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE TABLE inbox_archive (
+    id INT NOT NULL,
+    event_id UUID NOT NULL,
+    event_type TEXT NOT NULL,
+    version INT NOT NULL,
+    payload JSONB NOT NULL,
+    retries INT,
+    created_at TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE FUNCTION notify_channel() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify(TG_ARGV[0], '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER outbox_notify AFTER INSERT ON outbox
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_channel('outbox_events');
 
+CREATE TRIGGER inbox_notify AFTER INSERT ON inbox
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_channel('inbox_events');
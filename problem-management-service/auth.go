@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"shared/auth"
+	"shared/ratelimit"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/lib/pq"
+)
+
+const (
+	apiKeyPrefix = "lck_"
+
+	principalClient  = "client"
+	principalService = "service"
+	principalUser    = "user"
+
+	scopeProblemsRead   = "problems:read"
+	scopeProblemsWrite  = "problems:write"
+	scopeAPIKeysManage  = "api_keys:manage"
+	principalContextKey = "principal"
+)
+
+// Principal is the authenticated caller of a request: an API key holder or a
+// user signed in through user-service. Requests without credentials get an
+// anonymous principal identified by client IP.
+type Principal struct {
+	KeyID  int
+	UserID int
+	Name   string
+	Type   string
+	Tier   string
+	Scopes []string
+}
+
+func (p *Principal) Anonymous() bool {
+	return p.KeyID == 0 && p.UserID == 0
+}
+
+// rateLimitKey names the bucket the principal's requests draw from. API key
+// holders and users are keyed by ID and anonymous callers by IP, so a key
+// whose principal name looks like another caller's still gets its own bucket.
+// Every key of a service shares the service's bucket.
+func (p *Principal) rateLimitKey() string {
+	switch {
+	case p.Type == principalService:
+		return "service:" + p.Name
+	case p.KeyID != 0:
+		return "key:" + strconv.Itoa(p.KeyID)
+	case p.UserID != 0:
+		return "user:" + strconv.Itoa(p.UserID)
+	default:
+		return p.Name
+	}
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashAPIKey uses a plain SHA-256: keys carry 256 bits of entropy, so a slow
+// password hash would only add latency to every request.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func credentialsFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+
+	return ""
+}
+
+// userPrincipal maps a user access token onto a principal on the free tier.
+// Scopes follow the user's roles: problem setters may author problems and
+// administrators may also manage API keys.
+func userPrincipal(claims *auth.Claims) *Principal {
+	scopes := []string{scopeProblemsRead}
+	if claims.Can(auth.PermProblemsCreate) {
+		scopes = append(scopes, scopeProblemsWrite)
+	}
+	if claims.HasRole(auth.RoleAdmin) {
+		scopes = append(scopes, scopeAPIKeysManage)
+	}
+
+	return &Principal{
+		UserID: claims.UserID(),
+		Name:   "user:" + strconv.Itoa(claims.UserID()),
+		Type:   principalUser,
+		Tier:   ratelimit.TierFree,
+		Scopes: scopes,
+	}
+}
+
+// authMiddleware resolves the API key sent in X-API-Key or an Authorization
+// bearer token. Bearer tokens without the API key prefix are verified as user
+// access tokens. Missing credentials yield an anonymous principal; invalid,
+// revoked or expired credentials are rejected.
+func authMiddleware(jwtSecret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := credentialsFromRequest(c)
+		if key == "" {
+			c.Set(principalContextKey, &Principal{
+				Name:   "ip:" + c.ClientIP(),
+				Type:   principalClient,
+				Tier:   ratelimit.TierAnonymous,
+				Scopes: []string{scopeProblemsRead},
+			})
+			c.Next()
+			return
+		}
+
+		if !strings.HasPrefix(key, apiKeyPrefix) {
+			claims, err := auth.Verify(jwtSecret, key)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+				c.Abort()
+				return
+			}
+
+			auth.SetUser(c, claims)
+			c.Set(principalContextKey, userPrincipal(claims))
+			c.Next()
+			return
+		}
+
+		var principal Principal
+		query := `SELECT id, principal, principal_type, tier, scopes FROM api_keys
+			WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`
+		err := dbPool.QueryRow(ctx, query, hashAPIKey(key)).Scan(
+			&principal.KeyID, &principal.Name, &principal.Type, &principal.Tier, pq.Array(&principal.Scopes),
+		)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up API key: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+			c.Abort()
+			return
+		}
+
+		c.Set(principalContextKey, &principal)
+		c.Next()
+	}
+}
+
+func currentPrincipal(c *gin.Context) *Principal {
+	return c.MustGet(principalContextKey).(*Principal)
+}
+
+// principalScope keeps each API key's and user's idempotency keys apart.
+func principalScope(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	if principal.KeyID != 0 {
+		return "key:" + strconv.Itoa(principal.KeyID)
+	}
+
+	return "user:" + strconv.Itoa(principal.UserID)
+}
+
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := currentPrincipal(c)
+		if principal.HasScope(scope) {
+			c.Next()
+			return
+		}
+
+		status := http.StatusForbidden
+		if principal.Anonymous() {
+			status = http.StatusUnauthorized
+		}
+		c.JSON(status, gin.H{"error": "Missing scope " + scope})
+		c.Abort()
+	}
+}
+
+// requireProblemOwner limits a route on /problems/:id to the problem's owners
+// and administrators. API keys are not tied to a user, so those holding
+// problems:write may change any problem.
+func requireProblemOwner() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := currentPrincipal(c)
+		if principal.UserID == 0 {
+			requireScope(scopeProblemsWrite)(c)
+			return
+		}
+
+		if user, ok := auth.User(c); ok && user.HasRole(auth.RoleAdmin) {
+			c.Next()
+			return
+		}
+
+		var exists, owner bool
+		query := `SELECT EXISTS (SELECT 1 FROM problems WHERE id = $1),
+			EXISTS (SELECT 1 FROM problem_owners WHERE problem_id = $1 AND user_id = $2)`
+		if err := dbPool.QueryRow(ctx, query, c.Param("id"), principal.UserID).Scan(&exists, &owner); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid problem ID"})
+			c.Abort()
+			return
+		}
+
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
+			c.Abort()
+			return
+		}
+
+		if !owner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the problem's owners can change it"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// bootstrapCredentials registers keys configured through the environment so
+// that services and the first administrator can authenticate without a
+// manual database step:
+//
+//	SERVICE_API_KEYS=competition:<key>,other:<key>
+//	ADMIN_API_KEY=<key>
+func bootstrapCredentials() {
+	for _, entry := range strings.Split(os.Getenv("SERVICE_API_KEYS"), ",") {
+		name, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || key == "" {
+			continue
+		}
+
+		upsertStaticKey(name, principalService, key, []string{scopeProblemsRead})
+	}
+
+	if key := os.Getenv("ADMIN_API_KEY"); key != "" {
+		upsertStaticKey("admin", principalClient, key, []string{scopeProblemsRead, scopeProblemsWrite, scopeAPIKeysManage})
+	}
+}
+
+func upsertStaticKey(name string, principalType string, key string, scopes []string) {
+	query := `INSERT INTO api_keys (name, principal, principal_type, tier, scopes, key_hash)
+		VALUES ($1, $1, $2, $3, $4, $5)
+		ON CONFLICT (key_hash) DO UPDATE SET scopes = EXCLUDED.scopes, revoked_at = NULL`
+	_, err := dbPool.Exec(ctx, query, name, principalType, ratelimit.TierInternal, pq.Array(scopes), hashAPIKey(key))
+	if err != nil {
+		log.Fatalf("Failed to register credentials for %s: %v\n", name, err)
+	}
+}
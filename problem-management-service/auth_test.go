@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal Principal
+		want      string
+	}{
+		{"anonymous", Principal{Name: "ip:1.2.3.4", Type: principalClient}, "ip:1.2.3.4"},
+		{"user", Principal{UserID: 42, Name: "user:42", Type: principalUser}, "user:42"},
+		{"client key", Principal{KeyID: 7, Name: "acme", Type: principalClient}, "key:7"},
+		{"client key named like a user", Principal{KeyID: 7, Name: "user:42", Type: principalClient}, "key:7"},
+		{"client key named like an address", Principal{KeyID: 8, Name: "ip:1.2.3.4", Type: principalClient}, "key:8"},
+		{"service key", Principal{KeyID: 9, Name: "competition-service", Type: principalService}, "service:competition-service"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.principal.rateLimitKey(); got != test.want {
+				t.Errorf("rateLimitKey() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
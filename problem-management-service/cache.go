@@ -0,0 +1,371 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+// Problem reads go through two tiers: a small in-process LRU that absorbs the
+// burst of identical reads at contest start, and Redis, shared by every
+// replica. Writes go through to both tiers of the replica that made them;
+// other replicas see the change once their local copy expires, which is why
+// the local TTLs are kept short.
+const (
+	localCacheSize = 10000
+
+	localProblemTTL = 5 * time.Second
+	redisProblemTTL = 10 * time.Minute
+
+	// Search results are versioned by searchGenerationKey, which every write
+	// bumps, so they can be cached for as long as they are popular.
+	localSearchTTL = 5 * time.Second
+	redisSearchTTL = 5 * time.Minute
+
+	searchGenerationKey = "problem_search_gen"
+
+	// A deleted problem's key holds a tombstone for as long as a copy could
+	// have lived, so that a read which loaded the problem just before it was
+	// deleted cannot cache it again.
+	tombstone    = "deleted"
+	tombstoneTTL = redisProblemTTL
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "problem_cache_requests_total",
+	Help: "Problem cache lookups by cache, tier and result.",
+}, []string{"cache", "tier", "result"})
+
+var (
+	problemCache = newTieredCache("problem", localProblemTTL, redisProblemTTL)
+	searchCache  = newTieredCache("search", localSearchTTL, redisSearchTTL)
+
+	// Concurrent misses for the same key share one database query.
+	cacheFills singleflight.Group
+)
+
+// lruCache is a size-bounded map that evicts the least recently used entry.
+// Entries also expire after their TTL.
+type lruCache struct {
+	mutex    sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (l *lruCache) get(key string) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		l.order.Remove(element)
+		delete(l.items, key)
+		return nil, false
+	}
+
+	l.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (l *lruCache) set(key string, value []byte, ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, ok := l.items[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = time.Now().Add(ttl)
+		l.order.MoveToFront(element)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	if l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (l *lruCache) remove(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, ok := l.items[key]; ok {
+		l.order.Remove(element)
+		delete(l.items, key)
+	}
+}
+
+// tieredCache stores JSON values in the local LRU in front of Redis.
+type tieredCache struct {
+	name     string
+	local    *lruCache
+	localTTL time.Duration
+	redisTTL time.Duration
+}
+
+func newTieredCache(name string, localTTL time.Duration, redisTTL time.Duration) *tieredCache {
+	return &tieredCache{name: name, local: newLRUCache(localCacheSize), localTTL: localTTL, redisTTL: redisTTL}
+}
+
+// get decodes the cached value of key into out. A Redis hit is copied into the
+// local tier. Redis errors count as misses so that reads fall back to the
+// database.
+func (t *tieredCache) get(key string, out interface{}) bool {
+	if value, ok := t.local.get(key); ok && json.Unmarshal(value, out) == nil {
+		cacheRequests.WithLabelValues(t.name, "local", "hit").Inc()
+		return true
+	}
+	cacheRequests.WithLabelValues(t.name, "local", "miss").Inc()
+
+	value, err := rdb.Get(ctx, key).Bytes()
+	if err == nil && string(value) != tombstone && json.Unmarshal(value, out) == nil {
+		cacheRequests.WithLabelValues(t.name, "redis", "hit").Inc()
+		t.local.set(key, value, t.localTTL)
+		return true
+	}
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to read %s cache: %v\n", t.name, err)
+	}
+	cacheRequests.WithLabelValues(t.name, "redis", "miss").Inc()
+
+	return false
+}
+
+// getMany looks up several keys at once and returns the raw values found,
+// asking Redis only for what the local tier does not have.
+func (t *tieredCache) getMany(keys []string) map[string][]byte {
+	found := make(map[string][]byte, len(keys))
+
+	var remote []string
+	for _, key := range keys {
+		if value, ok := t.local.get(key); ok {
+			cacheRequests.WithLabelValues(t.name, "local", "hit").Inc()
+			found[key] = value
+			continue
+		}
+		cacheRequests.WithLabelValues(t.name, "local", "miss").Inc()
+		remote = append(remote, key)
+	}
+
+	if len(remote) == 0 {
+		return found
+	}
+
+	values, err := rdb.MGet(ctx, remote...).Result()
+	if err != nil {
+		log.Printf("Failed to read %s cache: %v\n", t.name, err)
+		values = make([]interface{}, len(remote))
+	}
+
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok || s == tombstone {
+			cacheRequests.WithLabelValues(t.name, "redis", "miss").Inc()
+			continue
+		}
+		cacheRequests.WithLabelValues(t.name, "redis", "hit").Inc()
+		found[remote[i]] = []byte(s)
+		t.local.set(remote[i], []byte(s), t.localTTL)
+	}
+
+	return found
+}
+
+// fill caches a value just read from the database. It does not replace a
+// cached value or a tombstone, so a read that started before a write or a
+// delete cannot overwrite what the write stored. The local tier only takes
+// the value once Redis has, so that it never holds a copy Redis rejected.
+func (t *tieredCache) fill(key string, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	stored, err := rdb.SetNX(ctx, key, body, t.redisTTL).Result()
+	if err != nil {
+		log.Printf("Failed to write %s cache: %v\n", t.name, err)
+		return
+	}
+	if stored {
+		t.local.set(key, body, t.localTTL)
+	}
+}
+
+// set writes value through to both tiers, replacing whatever is cached. As in
+// fill, the local tier only takes the value once Redis has; if Redis fails,
+// the local copy is dropped rather than left to disagree with it.
+func (t *tieredCache) set(key string, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	if err := rdb.Set(ctx, key, body, t.redisTTL).Err(); err != nil {
+		log.Printf("Failed to write %s cache: %v\n", t.name, err)
+		t.local.remove(key)
+		return
+	}
+
+	t.local.set(key, body, t.localTTL)
+}
+
+// bury replaces whatever is cached under key with a tombstone, which reads
+// treat as a miss and fills cannot replace.
+func (t *tieredCache) bury(key string) {
+	t.local.remove(key)
+	if err := rdb.Set(ctx, key, tombstone, tombstoneTTL).Err(); err != nil {
+		log.Printf("Failed to delete from %s cache: %v\n", t.name, err)
+	}
+}
+
+func problemCacheKey(id int) string {
+	return fmt.Sprintf("problem:%d", id)
+}
+
+// loadProblem returns pgx.ErrNoRows if the problem does not exist.
+func loadProblem(id int) (Problem, error) {
+	var problem Problem
+	key := problemCacheKey(id)
+	if problemCache.get(key, &problem) {
+		return problem, nil
+	}
+
+	loaded, err, _ := cacheFills.Do(key, func() (interface{}, error) {
+		var problem Problem
+		query := `SELECT id, title, description, difficulty, tags, created_by, revision, created_at, updated_at FROM problems WHERE id = $1`
+		err := dbPool.QueryRow(ctx, query, id).Scan(
+			&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty,
+			pq.Array(&problem.Tags), &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		problemCache.fill(key, problem)
+		return problem, nil
+	})
+	if err != nil {
+		return problem, err
+	}
+
+	return loaded.(Problem), nil
+}
+
+// loadProblems returns the problems among ids that exist, reading the
+// database only for those neither cache tier holds.
+func loadProblems(ids []int) (map[int]Problem, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = problemCacheKey(id)
+	}
+	cached := problemCache.getMany(keys)
+
+	found := make(map[int]Problem, len(ids))
+	var misses []int
+	for i, id := range ids {
+		var problem Problem
+		if body, ok := cached[keys[i]]; ok && json.Unmarshal(body, &problem) == nil {
+			found[id] = problem
+			continue
+		}
+		misses = append(misses, id)
+	}
+
+	if len(misses) == 0 {
+		return found, nil
+	}
+
+	query := `SELECT id, title, description, difficulty, tags, created_by, revision, created_at, updated_at FROM problems WHERE id = ANY($1)`
+	rows, err := dbPool.Query(ctx, query, pq.Array(misses))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var problem Problem
+		err := rows.Scan(&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty, pq.Array(&problem.Tags), &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		found[problem.ID] = problem
+		problemCache.fill(problemCacheKey(problem.ID), problem)
+	}
+
+	return found, rows.Err()
+}
+
+// cachedSearch returns the cached result of the search identified by query,
+// running search on a miss. Keys carry the current search generation, so a
+// write anywhere retires every cached result at once.
+func cachedSearch(query string, search func() ([]Problem, error)) ([]Problem, error) {
+	generation, err := rdb.Get(ctx, searchGenerationKey).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Failed to read search generation: %v\n", err)
+	}
+	key := fmt.Sprintf("search:%d:%s", generation, query)
+
+	var problems []Problem
+	if searchCache.get(key, &problems) {
+		return problems, nil
+	}
+
+	loaded, err, _ := cacheFills.Do(key, func() (interface{}, error) {
+		problems, err := search()
+		if err != nil {
+			return nil, err
+		}
+
+		searchCache.fill(key, problems)
+		return problems, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return loaded.([]Problem), nil
+}
+
+// problemWritten writes a created or updated problem through to the cache.
+func problemWritten(problem Problem) {
+	problemCache.set(problemCacheKey(problem.ID), problem)
+	invalidateSearches()
+}
+
+func problemDeleted(id int) {
+	problemCache.bury(problemCacheKey(id))
+	invalidateSearches()
+}
+
+func invalidateSearches() {
+	if err := rdb.Incr(ctx, searchGenerationKey).Err(); err != nil {
+		log.Printf("Failed to invalidate cached searches: %v\n", err)
+	}
+}
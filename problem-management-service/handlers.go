@@ -1,9 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/lib/pq"
 	"net/http"
+	"net/url"
+	"shared/conditional"
+	"shared/events"
+	"shared/ratelimit"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func createProblem(c *gin.Context) {
@@ -13,55 +24,354 @@ func createProblem(c *gin.Context) {
 		return
 	}
 
-	query := `INSERT INTO problems (title, description, difficulty, tags, created_at, updated_at) VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING id`
-	err := dbPool.QueryRow(ctx, query, problem.Title, problem.Description, problem.Difficulty, pq.Array(problem.Tags)).Scan(&problem.ID)
+	problem.CreatedBy = nil
+	if principal := currentPrincipal(c); principal.UserID != 0 {
+		problem.CreatedBy = &principal.UserID
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO problems (title, description, difficulty, tags, created_by, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, NOW(), NOW()) RETURNING id, revision, created_at, updated_at`
+	err = tx.QueryRow(ctx, query, problem.Title, problem.Description, problem.Difficulty, pq.Array(problem.Tags), problem.CreatedBy).Scan(&problem.ID, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create problem"})
 		return
 	}
 
+	if problem.CreatedBy != nil {
+		_, err = tx.Exec(ctx, `INSERT INTO problem_owners (problem_id, user_id) VALUES ($1, $2)`, problem.ID, *problem.CreatedBy)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record problem owner"})
+			return
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	problemWritten(problem)
+
 	c.JSON(http.StatusCreated, problem)
 }
 
-func getProblem(c *gin.Context) {
-	id := c.Param("id")
+// Cache-Control policies. A problem looks the same to every caller and rarely
+// changes; lists change with any write, so they are kept for less time.
+var (
+	problemCacheControl = conditional.Public(time.Minute)
+	listCacheControl    = conditional.Public(30 * time.Second)
+)
 
+// lockProblem reads a problem for update, so that an If-Match check against
+// it holds until the transaction ends.
+func lockProblem(tx pgx.Tx, id string) (Problem, error) {
 	var problem Problem
-	query := `SELECT id, title, description, difficulty, tags, created_at, updated_at FROM problems WHERE id = $1`
-	err := dbPool.QueryRow(ctx, query, id).Scan(
+	query := `SELECT id, title, description, difficulty, tags, created_by, revision, created_at, updated_at FROM problems WHERE id = $1 FOR UPDATE`
+	err := tx.QueryRow(ctx, query, id).Scan(
 		&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty,
-		pq.Array(&problem.Tags), &problem.CreatedAt, &problem.UpdatedAt,
+		pq.Array(&problem.Tags), &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt,
 	)
+
+	return problem, err
+}
+
+// updateProblem and deleteProblem publish the change through the outbox in
+// the same transaction, so that caches elsewhere are invalidated exactly when
+// the change commits. Both honour If-Match.
+func updateProblem(c *gin.Context) {
+	id := c.Param("id")
+
+	var problem Problem
+	if err := c.ShouldBindJSON(&problem); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockProblem(tx, id)
+	if err == pgx.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch problem"})
+		return
+	}
+
+	if !conditional.IfMatch(c, current) {
+		return
+	}
 
+	query := `UPDATE problems SET title = $2, description = $3, difficulty = $4, tags = $5, revision = revision + 1, updated_at = NOW()
+		WHERE id = $1 RETURNING id, created_by, revision, created_at, updated_at`
+	err = tx.QueryRow(ctx, query, id, problem.Title, problem.Description, problem.Difficulty, pq.Array(problem.Tags)).Scan(
+		&problem.ID, &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update problem"})
+		return
+	}
+
+	if err := enqueueEvent(tx, events.ProblemUpdated, events.ProblemUpdatedEvent{ProblemID: problem.ID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	problemWritten(problem)
+
+	if etag, err := conditional.ETag(problem); err == nil {
+		c.Header("ETag", etag)
+	}
 	c.JSON(http.StatusOK, problem)
 }
 
-func getAllProblems(c *gin.Context) {
-	var problems []Problem
+func deleteProblem(c *gin.Context) {
+	id := c.Param("id")
 
-	query := `SELECT id, title, description, difficulty, tags, created_at, updated_at FROM problems`
-	rows, err := dbPool.Query(ctx, query)
+	tx, err := dbPool.Begin(ctx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve problems"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockProblem(tx, id)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch problem"})
+		return
+	}
+
+	if !conditional.IfMatch(c, current) {
+		return
+	}
+
+	problemID := current.ID
+	if _, err := tx.Exec(ctx, `DELETE FROM problems WHERE id = $1`, problemID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete problem"})
+		return
+	}
+
+	if err := enqueueEvent(tx, events.ProblemDeleted, events.ProblemDeletedEvent{ProblemID: problemID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to outbox"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	problemDeleted(problemID)
+
+	c.Status(http.StatusNoContent)
+}
+
+func getProblemOwners(c *gin.Context) {
+	id := c.Param("id")
+
+	rows, err := dbPool.Query(ctx, `SELECT user_id FROM problem_owners WHERE problem_id = $1 ORDER BY user_id`, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch owners"})
 		return
 	}
 	defer rows.Close()
 
+	owners := []int{}
 	for rows.Next() {
-		var problem Problem
-		err := rows.Scan(&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty, pq.Array(&problem.Tags), &problem.CreatedAt, &problem.UpdatedAt)
+		var userID int
+		if err := rows.Scan(&userID); err == nil {
+			owners = append(owners, userID)
+		}
+	}
+
+	conditional.JSON(c, owners, time.Time{}, listCacheControl)
+}
+
+func addProblemOwner(c *gin.Context) {
+	id := c.Param("id")
+
+	var request struct {
+		UserID int `json:"user_id"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.UserID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+		return
+	}
+
+	_, err := dbPool.Exec(ctx, `INSERT INTO problem_owners (problem_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, id, request.UserID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add owner"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"problem_id": id, "user_id": request.UserID})
+}
+
+func removeProblemOwner(c *gin.Context) {
+	id := c.Param("id")
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Concurrent removals each count the other's owner under READ COMMITTED,
+	// so lock the problem to take them one at a time.
+	_, err = tx.Exec(ctx, `SELECT id FROM problems WHERE id = $1 FOR UPDATE`, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock problem"})
+		return
+	}
+
+	// Keep at least one owner so the problem stays editable without an admin.
+	query := `DELETE FROM problem_owners WHERE problem_id = $1 AND user_id = $2
+		AND (SELECT COUNT(*) FROM problem_owners WHERE problem_id = $1) > 1`
+	tag, err := tx.Exec(ctx, query, id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove owner"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Not an owner, or the problem's last owner"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func getProblem(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
+		return
+	}
+
+	problem, err := loadProblem(id)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Problem not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve problem"})
+		return
+	}
+
+	conditional.JSON(c, problem, problem.UpdatedAt, problemCacheControl)
+}
+
+const maxBatchSize = 100
+
+func getAllProblems(c *gin.Context) {
+	if ids := c.Query("ids"); ids != "" {
+		getProblemsByID(c, ids)
+		return
+	}
+
+	problems, err := cachedSearch("all", func() ([]Problem, error) {
+		var problems []Problem
+
+		query := `SELECT id, title, description, difficulty, tags, created_by, revision, created_at, updated_at FROM problems`
+		rows, err := dbPool.Query(ctx, query)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse problem data"})
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var problem Problem
+			err := rows.Scan(&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty, pq.Array(&problem.Tags), &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, problem)
+		}
+
+		return problems, rows.Err()
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve problems"})
+		return
+	}
+
+	conditional.JSON(c, gin.H{"data": problems}, time.Time{}, listCacheControl)
+}
+
+// getProblemsByID serves GET /problems?ids=1,2,3 so that callers can fetch a
+// set of problems with one request, and one rate-limit token. IDs that do not
+// exist are listed under "missing".
+func getProblemsByID(c *gin.Context, ids string) {
+	var problemIDs []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(ids, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids must be a comma-separated list of problem IDs"})
 			return
 		}
-		problems = append(problems, problem)
+		if !seen[id] {
+			seen[id] = true
+			problemIDs = append(problemIDs, id)
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": problems})
+	if len(problemIDs) > maxBatchSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d ids per request", maxBatchSize)})
+		return
+	}
+
+	found, err := loadProblems(problemIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve problems"})
+		return
+	}
+
+	problems := []Problem{}
+	missing := []int{}
+	for _, id := range problemIDs {
+		if problem, ok := found[id]; ok {
+			problems = append(problems, problem)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	conditional.JSON(c, gin.H{"data": problems, "missing": missing}, time.Time{}, listCacheControl)
 }
 
 func filterProblems(c *gin.Context) {
@@ -69,23 +379,152 @@ func filterProblems(c *gin.Context) {
 	tag := c.Query("tag")
 	difficulty := c.Query("difficulty")
 
-	var problems []Problem
-	query := `SELECT id, title, description, difficulty, created_at, updated_at FROM problems WHERE 
+	params := url.Values{"text": {text}, "tag": {tag}, "difficulty": {difficulty}}
+	problems, err := cachedSearch("filter?"+params.Encode(), func() ([]Problem, error) {
+		var problems []Problem
+		query := `SELECT id, title, description, difficulty, created_by, revision, created_at, updated_at FROM problems WHERE 
 			  (title ILIKE '%' || $1 || '%' OR description ILIKE '%' || $1 || '%') 
 			  AND difficulty = $2 AND $3 = ANY(tags)`
-	rows, err := dbPool.Query(ctx, query, text, difficulty, tag)
+		rows, err := dbPool.Query(ctx, query, text, difficulty, tag)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var problem Problem
+			if err := rows.Scan(&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty, &problem.CreatedBy, &problem.Revision, &problem.CreatedAt, &problem.UpdatedAt); err == nil {
+				problems = append(problems, problem)
+			}
+		}
+
+		return problems, rows.Err()
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve problems"})
 		return
 	}
+
+	conditional.JSON(c, problems, time.Time{}, listCacheControl)
+}
+
+func createAPIKey(c *gin.Context) {
+	var request struct {
+		Name          string     `json:"name"`
+		Principal     string     `json:"principal"`
+		PrincipalType string     `json:"principal_type"`
+		Tier          string     `json:"tier"`
+		Scopes        []string   `json:"scopes"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Name == "" || request.Principal == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and principal are required"})
+		return
+	}
+
+	if request.PrincipalType == "" {
+		request.PrincipalType = principalClient
+	}
+	if request.PrincipalType != principalClient && request.PrincipalType != principalService {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "principal_type must be client or service"})
+		return
+	}
+
+	if request.Tier == "" {
+		request.Tier = ratelimit.TierFree
+	}
+	switch request.Tier {
+	case ratelimit.TierFree, ratelimit.TierPremium, ratelimit.TierInternal:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tier must be free, premium or internal"})
+		return
+	}
+
+	for _, scope := range request.Scopes {
+		switch scope {
+		case scopeProblemsRead, scopeProblemsWrite, scopeAPIKeysManage:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + scope})
+			return
+		}
+	}
+
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	apiKey := APIKey{
+		Name:          request.Name,
+		Principal:     request.Principal,
+		PrincipalType: request.PrincipalType,
+		Tier:          request.Tier,
+		Scopes:        request.Scopes,
+		ExpiresAt:     request.ExpiresAt,
+	}
+	query := `INSERT INTO api_keys (name, principal, principal_type, tier, scopes, key_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+	err = dbPool.QueryRow(ctx, query,
+		apiKey.Name, apiKey.Principal, apiKey.PrincipalType, apiKey.Tier, pq.Array(apiKey.Scopes), hashAPIKey(key), apiKey.ExpiresAt,
+	).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	// The plaintext key is only ever returned here; only its hash is stored.
+	c.JSON(http.StatusCreated, gin.H{"api_key": apiKey, "key": key})
+}
+
+func getAPIKeys(c *gin.Context) {
+	apiKeys := []APIKey{}
+
+	query := `SELECT id, name, principal, principal_type, tier, scopes, expires_at, revoked_at, created_at FROM api_keys ORDER BY id`
+	rows, err := dbPool.Query(ctx, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var problem Problem
-		if err := rows.Scan(&problem.ID, &problem.Title, &problem.Description, &problem.Difficulty, &problem.CreatedAt, &problem.UpdatedAt); err == nil {
-			problems = append(problems, problem)
+		var apiKey APIKey
+		err := rows.Scan(&apiKey.ID, &apiKey.Name, &apiKey.Principal, &apiKey.PrincipalType, &apiKey.Tier,
+			pq.Array(&apiKey.Scopes), &apiKey.ExpiresAt, &apiKey.RevokedAt, &apiKey.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse API key data"})
+			return
 		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": apiKeys})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	id := c.Param("id")
+
+	tag, err := dbPool.Exec(ctx, `UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
 	}
 
-	c.JSON(http.StatusOK, problems)
+	c.Status(http.StatusNoContent)
 }
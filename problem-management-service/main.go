@@ -5,14 +5,23 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"os"
+	"shared/auth"
+	"shared/idempotency"
+	"shared/rabbitmq"
+	"shared/retention"
 )
 
 var (
 	dbPool *pgxpool.Pool
 	rdb    *redis.Client
 	ctx    = context.Background()
+	broker *rabbitmq.Broker
+
+	jwtSecret       []byte
+	idempotencyKeys *idempotency.Store
 )
 
 func initDB() {
@@ -39,24 +48,52 @@ func initRedis() {
 	}
 }
 
+func initJWT() {
+	var err error
+	jwtSecret, err = auth.SecretFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v\n", err)
+	}
+}
+
 func main() {
 	initDB()
+	idempotencyKeys = idempotency.NewStore(dbPool)
 	initRedis()
+	initJWT()
+	initRabbitMQ()
+	initRateLimiter()
+	bootstrapCredentials()
 
 	defer dbPool.Close()
 	defer rdb.Close()
+	defer broker.Close()
+
+	go processOutbox()
+	go retention.Run(ctx, dbPool, retention.ConfigFromEnv(false))
+	go idempotencyKeys.RunRetention(idempotency.RetentionFromEnv())
 
 	r := gin.Default()
 
+	r.Use(authMiddleware(jwtSecret))
 	r.Use(rateLimiterMiddleware())
 
-	//r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	r.POST("/problems", createProblem)
+	r.POST("/problems", requireScope(scopeProblemsWrite), idempotencyKeys.Middleware(principalScope), createProblem)
 	r.GET("/problems/:id", getProblem)
+	r.PUT("/problems/:id", requireProblemOwner(), updateProblem)
+	r.DELETE("/problems/:id", requireProblemOwner(), deleteProblem)
+	r.GET("/problems/:id/owners", getProblemOwners)
+	r.POST("/problems/:id/owners", requireProblemOwner(), addProblemOwner)
+	r.DELETE("/problems/:id/owners/:userId", requireProblemOwner(), removeProblemOwner)
 	r.GET("/problems", getAllProblems)
 	r.GET("/problems/filter", filterProblems)
 
+	r.POST("/api-keys", requireScope(scopeAPIKeysManage), createAPIKey)
+	r.GET("/api-keys", requireScope(scopeAPIKeysManage), getAPIKeys)
+	r.DELETE("/api-keys/:id", requireScope(scopeAPIKeysManage), revokeAPIKey)
+
 	if err := r.Run(":8080"); err != nil {
 		log.Fatalf("Failed to run server: %v\n", err)
 	}
@@ -8,6 +8,20 @@ type Problem struct {
 	Description string    `json:"description"`
 	Difficulty  string    `json:"difficulty"`
 	Tags        []string  `json:"tags"`
+	CreatedBy   *int      `json:"created_by"`
+	Revision    int       `json:"revision"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
+
+type APIKey struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Principal     string     `json:"principal"`
+	PrincipalType string     `json:"principal_type"`
+	Tier          string     `json:"tier"`
+	Scopes        []string   `json:"scopes"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"shared/events"
+	"shared/notify"
+	"shared/rabbitmq"
+	"time"
+)
+
+const (
+	maxRetries         = 5
+	outboxBatchSize    = 100
+	outboxPollInterval = 5 * time.Second
+)
+
+// enqueueEvent writes an event to the outbox as part of tx.
+func enqueueEvent(tx pgx.Tx, eventType string, event interface{}) error {
+	payload, version, err := events.Marshal(eventType, event)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (event_id, event_type, version, payload) VALUES ($1, $2, $3, $4)`, uuid.New().String(), eventType, version, payload)
+	return err
+}
+
+// processOutbox publishes pending outbox events as soon as a NOTIFY reports a
+// new row, falling back to polling every outboxPollInterval.
+func processOutbox() {
+	wakeup := make(chan struct{}, 1)
+	go notify.Listen(ctx, dbPool, "outbox_events", wakeup)
+
+	for {
+		if dispatchOutboxBatch() == outboxBatchSize {
+			continue
+		}
+
+		select {
+		case <-wakeup:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// dispatchOutboxBatch publishes up to outboxBatchSize events and returns how
+// many rows it picked up, so the caller can drain a backlog without waiting.
+func dispatchOutboxBatch() int {
+	rows, err := dbPool.Query(ctx, "SELECT id, event_id, event_type, version, payload, retries FROM outbox WHERE processed = FALSE AND retries < $1 ORDER BY id LIMIT $2", maxRetries, outboxBatchSize)
+	if err != nil {
+		log.Printf("Failed to fetch outbox events: %v\n", err)
+		return 0
+	}
+
+	var ids, retries []int
+	var messages []rabbitmq.Message
+	fetched := 0
+
+	for rows.Next() {
+		var id, version, retryCount int
+		var eventID, eventType string
+		var payload []byte
+
+		if err := rows.Scan(&id, &eventID, &eventType, &version, &payload, &retryCount); err != nil {
+			log.Printf("Failed to scan outbox row: %v\n", err)
+			continue
+		}
+		fetched++
+
+		eventPayload, err := events.NewEnvelope(eventID, eventType, version, payload)
+		if err != nil {
+			log.Printf("Failed to build envelope for event ID %s: %v\n", eventID, err)
+			continue
+		}
+
+		ids = append(ids, id)
+		retries = append(retries, retryCount)
+		// Every problem event is a cache invalidation, fanned out to whoever
+		// caches problems.
+		messages = append(messages, rabbitmq.Message{Exchange: "cache_invalidation", RoutingKey: eventType, Body: eventPayload})
+	}
+	rows.Close()
+
+	if len(messages) == 0 {
+		return fetched
+	}
+
+	var publishedIDs, failedIDs []int
+	for i, err := range broker.PublishBatch(messages) {
+		if err != nil {
+			log.Printf("Failed to publish message (attempt %d/%d): %v\n", retries[i]+1, maxRetries, err)
+			failedIDs = append(failedIDs, ids[i])
+			continue
+		}
+		publishedIDs = append(publishedIDs, ids[i])
+	}
+
+	if len(failedIDs) > 0 {
+		_, err := dbPool.Exec(ctx, "UPDATE outbox SET retries = retries + 1 WHERE id = ANY($1)", failedIDs)
+		if err != nil {
+			log.Printf("Failed to update retries for outbox events: %v\n", err)
+		}
+	}
+
+	if len(publishedIDs) > 0 {
+		_, err := dbPool.Exec(ctx, "UPDATE outbox SET processed = TRUE WHERE id = ANY($1)", publishedIDs)
+		if err != nil {
+			log.Printf("Failed to mark outbox events as processed: %v\n", err)
+		}
+	}
+
+	return fetched
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"shared/rabbitmq"
+
+	"github.com/streadway/amqp"
+)
+
+// initRabbitMQ starts the connection manager in the background. The service
+// keeps serving HTTP while the broker is unavailable; publishes fail and are
+// retried by the outbox until the connection comes back.
+func initRabbitMQ() {
+	broker = rabbitmq.Connect(rabbitmq.Config{
+		URL:             os.Getenv("RABBITMQ_URL"),
+		DeclareTopology: declareTopology,
+		ConfirmBuffer:   outboxBatchSize,
+	})
+}
+
+// declareTopology declares the fanout exchange problem changes are published
+// on. Services that cache problems bind their own queue to it.
+func declareTopology(channel *amqp.Channel) error {
+	return rabbitmq.DeclareFanout(channel, "cache_invalidation")
+}
@@ -1,69 +1,88 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"shared/ratelimit"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	rateLimit       = 5
-	windowDuration  = time.Minute
-	bucketInterval  = 10 * time.Second
-	numberOfBuckets = int(windowDuration / bucketInterval)
+	rateLimit              = 5
+	windowDuration         = time.Minute
+	policyFile             = "rate-limits.json"
+	policyReloadCheckEvery = 30 * time.Second
 )
 
-func rateLimiterMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		clientID := c.GetHeader("X-Client-ID")
-
-		log.Printf("Client ID: %s", clientID)
+var policies *ratelimit.Engine
 
-		if clientID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing X-Client-ID header"})
-			c.Abort()
-			return
-		}
+// initRateLimiter loads per-route, per-tier policies from RATE_LIMIT_CONFIG.
+// The file is reloaded when it changes on disk or on SIGHUP; without a file
+// every client gets rateLimit requests per windowDuration.
+func initRateLimiter() {
+	path := os.Getenv("RATE_LIMIT_CONFIG")
+	if path == "" {
+		path = policyFile
+	}
 
-		now := time.Now().Unix()
-		currentBucket := now / int64(bucketInterval.Seconds())
-		log.Printf("Current bucket: %d", currentBucket)
+	var err error
+	policies, err = ratelimit.NewEngine(rdb, "rate_limit", path, ratelimit.Policy{
+		Algorithm: ratelimit.AlgorithmSlidingWindow,
+		Limit:     rateLimit,
+		Window:    windowDuration.String(),
+	})
+	if err != nil {
+		log.Fatalf("Failed to load rate limit policies: %v\n", err)
+	}
 
-		totalRequests := int64(0)
+	go policies.Watch(policyReloadCheckEvery)
 
-		for i := 0; i < numberOfBuckets; i++ {
-			bucketKey := fmt.Sprintf("rate_limit:%s:%d", clientID, currentBucket-int64(i))
-			bucketCount, _ := rdb.Get(ctx, bucketKey).Int64()
-			log.Printf("Bucket %d: %d", currentBucket-int64(i), bucketCount)
-			totalRequests += bucketCount
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := policies.Reload(); err != nil {
+				log.Printf("Failed to reload rate limit policies, keeping previous ones: %v\n", err)
+			}
 		}
+	}()
+}
 
-		log.Printf("Total requests: %d", totalRequests)
+func rateLimiterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := currentPrincipal(c)
+		key := principal.rateLimitKey()
 
-		if totalRequests >= rateLimit {
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error":  "Rate limit exceeded",
-				"limit":  rateLimit,
-				"window": windowDuration.Seconds(),
-			})
+		policy := policies.Match(c.FullPath(), c.Request.Method, principal.Tier)
+
+		result, err := policy.Allow(ctx, key)
+		if err != nil {
+			log.Printf("Rate limiter error for %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
 			c.Abort()
 			return
 		}
 
-		redisKey := fmt.Sprintf("rate_limit:%s:%d", clientID, currentBucket)
-		_, err := rdb.Incr(ctx, redisKey).Result()
+		ratelimit.WriteHeaders(c.Writer.Header(), result, policy.WindowDuration())
 
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error"})
+		if !result.Allowed {
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":       "Rate limit exceeded",
+				"policy":      policy.Name,
+				"limit":       result.Limit,
+				"remaining":   result.Remaining,
+				"window":      policy.WindowDuration().Seconds(),
+				"retry_after": result.RetryAfter.Seconds(),
+			})
 			c.Abort()
 			return
 		}
 
-		rdb.Expire(ctx, redisKey, windowDuration)
-
 		c.Next()
 	}
 }
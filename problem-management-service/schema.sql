@@ -4,6 +4,84 @@ CREATE TABLE problems (
   description TEXT,
   difficulty VARCHAR(50),
   tags TEXT[],
+  created_by INT,
+  -- Incremented by every update, so that competitions can pin the version
+  -- of a problem they were set with.
+  revision INT NOT NULL DEFAULT 1,
   created_at TIMESTAMP DEFAULT NOW(),
   updated_at TIMESTAMP DEFAULT NOW()
 );
+
+CREATE TABLE problem_owners (
+  problem_id INT NOT NULL REFERENCES problems (id) ON DELETE CASCADE,
+  user_id INT NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW(),
+  PRIMARY KEY (problem_id, user_id)
+);
+
+CREATE TABLE api_keys (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  principal VARCHAR(255) NOT NULL,
+  principal_type VARCHAR(50) NOT NULL DEFAULT 'client',
+  tier VARCHAR(50) NOT NULL DEFAULT 'free',
+  scopes TEXT[] NOT NULL DEFAULT '{}',
+  key_hash CHAR(64) NOT NULL UNIQUE,
+  expires_at TIMESTAMP,
+  revoked_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Responses to requests sent with an Idempotency-Key, replayed when the
+-- request is retried. Rows are deleted after IDEMPOTENCY_RETENTION.
+CREATE TABLE idempotency_keys (
+  scope TEXT NOT NULL,
+  key TEXT NOT NULL,
+  request_hash CHAR(64) NOT NULL,
+  claim_token CHAR(32) NOT NULL,
+  status_code INT,
+  content_type TEXT,
+  response_body BYTEA,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  completed_at TIMESTAMP,
+  PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys (created_at);
+
+CREATE TABLE outbox (
+  id SERIAL PRIMARY KEY,
+  event_id UUID NOT NULL UNIQUE,
+  event_type TEXT NOT NULL,
+  version INT NOT NULL DEFAULT 1,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMP DEFAULT NOW(),
+  processed BOOLEAN DEFAULT FALSE,
+  retries INT DEFAULT 0
+);
+
+CREATE INDEX outbox_archivable_idx ON outbox (created_at) WHERE processed = TRUE;
+
+-- Processed rows are moved here by the retention job. Monthly partitions are
+-- created on demand and dropped once older than ARCHIVE_RETENTION.
+CREATE TABLE outbox_archive (
+  id INT NOT NULL,
+  event_id UUID NOT NULL,
+  event_type TEXT NOT NULL,
+  version INT NOT NULL,
+  payload JSONB NOT NULL,
+  retries INT,
+  created_at TIMESTAMP NOT NULL,
+  archived_at TIMESTAMP DEFAULT NOW()
+) PARTITION BY RANGE (created_at);
+
+CREATE FUNCTION notify_channel() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify(TG_ARGV[0], '');
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER outbox_notify AFTER INSERT ON outbox
+  FOR EACH STATEMENT EXECUTE FUNCTION notify_channel('outbox_events');
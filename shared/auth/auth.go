@@ -0,0 +1,155 @@
+// Package auth issues and verifies the JWT access tokens that user-service
+// hands out, and provides the Gin middleware every service uses to identify
+// the calling user.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	issuer         = "user-service"
+	userContextKey = "user"
+)
+
+// Claims are the contents of an access token.
+type Claims struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles,omitempty"`
+	// Organization is assigned by administrators, like roles, and is empty
+	// for users outside any organization.
+	Organization string `json:"org,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the numeric user ID carried in the subject claim.
+func (c *Claims) UserID() int {
+	id, _ := strconv.Atoi(c.Subject)
+	return id
+}
+
+// SecretFromEnv reads the HMAC key shared by all services from JWT_SECRET.
+func SecretFromEnv() ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("JWT_SECRET must be at least 32 characters")
+	}
+
+	return []byte(secret), nil
+}
+
+// Issue signs an access token for a user that expires after ttl.
+func Issue(secret []byte, userID int, username string, roles []string, organization string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		Username:     username,
+		Roles:        roles,
+		Organization: organization,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiresAt, nil
+}
+
+// Verify checks a token's signature, issuer and expiry.
+func Verify(secret []byte, token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.UserID() == 0 {
+		return nil, errors.New("token has no user")
+	}
+
+	return &claims, nil
+}
+
+// BearerToken returns the token from an "Authorization: Bearer" header.
+func BearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// Middleware verifies the bearer token when one is present and stores its
+// claims in the context. Requests without a token pass through so that public
+// endpoints keep working; use RequireUser on endpoints that need a user.
+func Middleware(secret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := BearerToken(c)
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		claims, err := Verify(secret, token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+
+		SetUser(c, claims)
+		c.Next()
+	}
+}
+
+// RequireUser rejects requests that did not carry a valid token.
+func RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := User(c); !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func SetUser(c *gin.Context, claims *Claims) {
+	c.Set(userContextKey, claims)
+}
+
+// User returns the authenticated user of the request, if any.
+func User(c *gin.Context) (*Claims, bool) {
+	value, ok := c.Get(userContextKey)
+	if !ok {
+		return nil, false
+	}
+
+	claims, ok := value.(*Claims)
+	return claims, ok
+}
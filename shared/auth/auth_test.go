@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	token, expiresAt, err := Issue(testSecret, 42, "ada", []string{RoleTester}, "acme", time.Hour)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if time.Until(expiresAt) <= 59*time.Minute {
+		t.Errorf("Issue() expires at %v, want an hour from now", expiresAt)
+	}
+
+	claims, err := Verify(testSecret, token)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if claims.UserID() != 42 || claims.Username != "ada" || claims.Organization != "acme" || !claims.HasRole(RoleTester) {
+		t.Errorf("Verify() = %+v", claims)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	expired, _, _ := Issue(testSecret, 42, "ada", nil, "", -time.Minute)
+	otherSecret, _, _ := Issue([]byte("fedcba9876543210fedcba9876543210"), 42, "ada", nil, "", time.Hour)
+	noUser, _, _ := Issue(testSecret, 0, "ada", nil, "", time.Hour)
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString() error = %v", err)
+		}
+		return token
+	}
+	expiry := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	otherIssuer := sign(jwt.SigningMethodHS256, testSecret, Claims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "elsewhere", Subject: "42", ExpiresAt: expiry}})
+	noExpiry := sign(jwt.SigningMethodHS256, testSecret, Claims{RegisteredClaims: jwt.RegisteredClaims{Issuer: issuer, Subject: "42"}})
+	otherMethod := sign(jwt.SigningMethodHS512, testSecret, Claims{RegisteredClaims: jwt.RegisteredClaims{Issuer: issuer, Subject: "42", ExpiresAt: expiry}})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", expired},
+		{"signed with another secret", otherSecret},
+		{"without a user", noUser},
+		{"from another issuer", otherIssuer},
+		{"without an expiry", noExpiry},
+		{"signed with another method", otherMethod},
+		{"not a token", "token"},
+		{"tampered", expired[:len(expired)-2] + "xx"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if claims, err := Verify(testSecret, test.token); err == nil {
+				t.Errorf("Verify() = %+v, want an error", claims)
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		roles      []string
+		permission string
+		want       bool
+	}{
+		{[]string{RoleAdmin}, PermRolesManage, true},
+		{[]string{RoleTester}, PermSubmissionsReview, true},
+		{[]string{RoleTester}, PermCompetitionsParticipate, true},
+		{[]string{RoleParticipant}, PermSubmissionsReview, false},
+		{[]string{RoleProblemSetter, RoleContestOrganizer}, PermCompetitionsCreate, true},
+		{[]string{RoleContestOrganizer}, PermProblemsCreate, false},
+		{[]string{"unknown"}, PermCompetitionsParticipate, false},
+		{nil, PermCompetitionsParticipate, false},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.roles, "+")+" "+test.permission, func(t *testing.T) {
+			claims := &Claims{Roles: test.roles}
+			if got := claims.Can(test.permission); got != test.want {
+				t.Errorf("Can(%s) = %v, want %v", test.permission, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSecretFromEnv(t *testing.T) {
+	t.Setenv("JWT_SECRET", "short")
+	if _, err := SecretFromEnv(); err == nil {
+		t.Error("SecretFromEnv() accepted a short secret")
+	}
+
+	t.Setenv("JWT_SECRET", string(testSecret))
+	if secret, err := SecretFromEnv(); err != nil || string(secret) != string(testSecret) {
+		t.Errorf("SecretFromEnv() = %q, %v", secret, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	participant, _, _ := Issue(testSecret, 1, "ada", []string{RoleParticipant}, "", time.Hour)
+	tester, _, _ := Issue(testSecret, 2, "bob", []string{RoleTester}, "", time.Hour)
+
+	router := gin.New()
+	router.Use(Middleware(testSecret))
+	router.GET("/public", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/user", RequireUser(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/review", RequirePermission(PermSubmissionsReview), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		want          int
+	}{
+		{"anonymous on a public route", "/public", "", http.StatusOK},
+		{"invalid token on a public route", "/public", "Bearer nope", http.StatusUnauthorized},
+		{"non-bearer header is ignored", "/public", "Basic abc", http.StatusOK},
+		{"anonymous needing a user", "/user", "", http.StatusUnauthorized},
+		{"user needing a user", "/user", "Bearer " + participant, http.StatusOK},
+		{"anonymous needing a permission", "/review", "", http.StatusUnauthorized},
+		{"user without the permission", "/review", "Bearer " + participant, http.StatusForbidden},
+		{"user with the permission", "/review", "Bearer " + tester, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
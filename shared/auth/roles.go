@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles are granted by administrators through user-service and carried in
+// access tokens, so a change takes effect the next time the user refreshes.
+const (
+	RoleAdmin            = "admin"
+	RoleProblemSetter    = "problem_setter"
+	RoleContestOrganizer = "contest_organizer"
+	RoleTester           = "tester"
+	RoleParticipant      = "participant"
+)
+
+// Permissions are what handlers check; roles only exist to bundle them.
+const (
+	PermProblemsCreate          = "problems:create"
+	PermCompetitionsCreate      = "competitions:create"
+	PermCompetitionsParticipate = "competitions:participate"
+	PermSubmissionsReview       = "submissions:review"
+	PermLeaderboardsModerate    = "leaderboards:moderate"
+	PermRolesManage             = "roles:manage"
+)
+
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermProblemsCreate, PermCompetitionsCreate, PermCompetitionsParticipate,
+		PermSubmissionsReview, PermLeaderboardsModerate, PermRolesManage,
+	},
+	RoleProblemSetter:    {PermProblemsCreate},
+	RoleContestOrganizer: {PermCompetitionsCreate},
+	RoleTester:           {PermSubmissionsReview, PermCompetitionsParticipate},
+	RoleParticipant:      {PermCompetitionsParticipate},
+}
+
+// Roles lists every role in the order they are documented.
+func Roles() []string {
+	return []string{RoleAdmin, RoleProblemSetter, RoleContestOrganizer, RoleTester, RoleParticipant}
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+// Can reports whether any of the user's roles grants permission.
+func (c *Claims) Can(permission string) bool {
+	for _, role := range c.Roles {
+		if slices.Contains(rolePermissions[role], permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequirePermission rejects requests from anonymous users and from users none
+// of whose roles grant permission.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := User(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		if !user.Can(permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission " + permission})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,178 @@
+// Package breaker keeps one circuit breaker per downstream service and
+// endpoint, so that a failing endpoint does not cut off healthy ones, and
+// exports every breaker's state and outcomes as Prometheus metrics.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeTolerated is an error that Config.IsSuccessful excused, such as
+	// being rate limited by a healthy upstream.
+	OutcomeTolerated = "tolerated"
+	// OutcomeRejected is a call the breaker refused to make.
+	OutcomeRejected = "rejected"
+	// OutcomeCancelled is a call abandoned by its caller, such as the loser
+	// of a hedged request. It says nothing about the downstream's health.
+	OutcomeCancelled = "cancelled"
+)
+
+var (
+	stateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "circuit_breaker_state",
+		Help: "Circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	}, []string{"service", "endpoint"})
+
+	transitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_transitions_total",
+		Help: "Circuit breaker state transitions.",
+	}, []string{"service", "endpoint", "from", "to"})
+
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "circuit_breaker_requests_total",
+		Help: "Calls through a circuit breaker by outcome.",
+	}, []string{"service", "endpoint", "outcome"})
+)
+
+// Config applies to every breaker of a registry.
+type Config struct {
+	// Timeout is how long a breaker stays open before letting probes through.
+	Timeout time.Duration
+	// MaxRequests is how many probes are allowed while half-open.
+	MaxRequests uint32
+	// Interval is how often a closed breaker resets its counts.
+	Interval time.Duration
+	// ConsecutiveFailures trips the breaker once exceeded.
+	ConsecutiveFailures uint32
+	// IsSuccessful decides whether an error counts against the breaker. Nil
+	// treats every error as a failure.
+	IsSuccessful func(err error) bool
+}
+
+type Registry struct {
+	config   Config
+	mutex    sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewRegistry(config Config) *Registry {
+	return &Registry{config: config, breakers: make(map[string]*Breaker)}
+}
+
+// Get returns the breaker for an endpoint of service, creating it on first use.
+// Endpoints are free-form labels such as "GET /problems".
+func (r *Registry) Get(service string, endpoint string) *Breaker {
+	key := service + " " + endpoint
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if b, ok := r.breakers[key]; ok {
+		return b
+	}
+
+	b := &Breaker{service: service, endpoint: endpoint, isSuccessful: r.config.IsSuccessful}
+	b.cb = gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name:        key,
+		Timeout:     r.config.Timeout,
+		MaxRequests: r.config.MaxRequests,
+		Interval:    r.config.Interval,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures > r.config.ConsecutiveFailures
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			log.Printf("Circuit breaker %s: %s -> %s\n", name, from, to)
+			stateGauge.WithLabelValues(service, endpoint).Set(stateValue(to))
+			transitions.WithLabelValues(service, endpoint, from.String(), to.String()).Inc()
+		},
+	})
+	stateGauge.WithLabelValues(service, endpoint).Set(stateValue(gobreaker.StateClosed))
+
+	r.breakers[key] = b
+	return b
+}
+
+// Breaker wraps a gobreaker.TwoStepCircuitBreaker with outcome metrics.
+type Breaker struct {
+	service      string
+	endpoint     string
+	isSuccessful func(err error) bool
+	cb           *gobreaker.TwoStepCircuitBreaker
+}
+
+// State is safe to call concurrently with Execute.
+func (b *Breaker) State() gobreaker.State {
+	return b.cb.State()
+}
+
+// Execute runs call unless the breaker is open. A call that ends in
+// context.Canceled is left out of the counts while the breaker is closed. A
+// half-open breaker counts it as a failure instead, since the probe it let
+// through would otherwise never report back.
+func (b *Breaker) Execute(call func() (interface{}, error)) (interface{}, error) {
+	done, err := b.cb.Allow()
+	if err != nil {
+		requests.WithLabelValues(b.service, b.endpoint, OutcomeRejected).Inc()
+		return nil, err
+	}
+	probe := b.cb.State() == gobreaker.StateHalfOpen
+
+	defer func() {
+		if e := recover(); e != nil {
+			done(false)
+			panic(e)
+		}
+	}()
+
+	result, err := call()
+	outcome := b.outcome(err)
+	switch {
+	case outcome == OutcomeCancelled && probe:
+		done(false)
+	case outcome != OutcomeCancelled:
+		done(outcome != OutcomeFailure)
+	}
+	requests.WithLabelValues(b.service, b.endpoint, outcome).Inc()
+
+	return result, err
+}
+
+func (b *Breaker) outcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, context.Canceled):
+		return OutcomeCancelled
+	case b.isSuccessful != nil && b.isSuccessful(err):
+		return OutcomeTolerated
+	default:
+		return OutcomeFailure
+	}
+}
+
+// IsOpenError reports whether err means the breaker refused the call.
+func IsOpenError(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+func stateValue(state gobreaker.State) float64 {
+	switch state {
+	case gobreaker.StateHalfOpen:
+		return 1
+	case gobreaker.StateOpen:
+		return 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,142 @@
+// Package conditional implements HTTP conditional requests for JSON
+// resources. A resource's ETag is a hash of its JSON representation, so any
+// change a client could see changes the tag, and handlers need no extra
+// columns to track versions.
+package conditional
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Private is for responses that depend on who is asking; browsers may keep
+// them but must revalidate, and shared caches must not store them.
+const Private = "private, no-cache"
+
+// NoStore is for responses no cache may keep at all, such as partial or
+// degraded answers that the next request should not see again.
+const NoStore = "no-store"
+
+// Public lets shared caches such as a CDN or Traefik serve the response for
+// maxAge before revalidating.
+func Public(maxAge time.Duration) string {
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
+
+// ETag returns the strong entity tag of body's JSON representation.
+func ETag(body interface{}) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	return tag(data), nil
+}
+
+func tag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// JSON writes body with its ETag, Cache-Control and, unless lastModified is
+// zero, Last-Modified. It answers 304 Not Modified instead when the request's
+// If-None-Match or If-Modified-Since shows the client's copy is current.
+func JSON(c *gin.Context, body interface{}, lastModified time.Time, cacheControl string) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+
+	etag := tag(data)
+	header := c.Writer.Header()
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", cacheControl)
+	if !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// notModified follows RFC 9110: If-Modified-Since is only consulted when the
+// request has no If-None-Match.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return matches(header, etag, true)
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(header)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// IfMatch reports whether a request may modify a resource whose current
+// representation is current. Requests without If-Match always may, so that
+// clients opt in to optimistic concurrency; otherwise a mismatch is answered
+// with 412 Precondition Failed. Callers should hold a lock on the resource
+// between reading current and writing the change.
+func IfMatch(c *gin.Context, current interface{}) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		return true
+	}
+
+	etag, err := ETag(current)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode resource"})
+		return false
+	}
+
+	if !matches(header, etag, false) {
+		c.Header("ETag", etag)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Resource has changed; fetch it again and retry"})
+		return false
+	}
+
+	return true
+}
+
+// matches reports whether a comma-separated list of entity tags contains
+// etag. If-None-Match uses weak comparison, If-Match strong comparison, and a
+// weak tag never strongly matches.
+func matches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
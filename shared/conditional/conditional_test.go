@@ -0,0 +1,155 @@
+package conditional
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestMatches(t *testing.T) {
+	const etag = `"abc"`
+
+	tests := []struct {
+		name   string
+		header string
+		weak   bool
+		want   bool
+	}{
+		{"same tag", `"abc"`, false, true},
+		{"other tag", `"def"`, false, false},
+		{"tag in a list", `"def", "abc"`, false, true},
+		{"wildcard", `*`, false, true},
+		{"weak tag, weak comparison", `W/"abc"`, true, true},
+		{"weak tag, strong comparison", `W/"abc"`, false, false},
+		{"unquoted tag", `abc`, true, false},
+		{"empty header", ``, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := matches(test.header, etag, test.weak); got != test.want {
+				t.Errorf("matches(%q, %q, %v) = %v, want %v", test.header, etag, test.weak, got, test.want)
+			}
+		})
+	}
+}
+
+func TestETag(t *testing.T) {
+	a, err := ETag(map[string]int{"id": 1})
+	if err != nil {
+		t.Fatalf("ETag() error = %v", err)
+	}
+	b, _ := ETag(map[string]int{"id": 1})
+	c, _ := ETag(map[string]int{"id": 2})
+
+	if a != b {
+		t.Errorf("ETag() = %s and %s for the same body", a, b)
+	}
+	if a == c {
+		t.Errorf("ETag() = %s for different bodies", a)
+	}
+	if len(a) != 34 || a[0] != '"' || a[len(a)-1] != '"' {
+		t.Errorf("ETag() = %s, want a quoted 32-digit hash", a)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	body := map[string]string{"name": "spring"}
+	etag, _ := ETag(body)
+	lastModified := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		lastModified time.Time
+		wantStatus   int
+	}{
+		{"no conditions", http.MethodGet, nil, lastModified, http.StatusOK},
+		{"matching If-None-Match", http.MethodGet, map[string]string{"If-None-Match": etag}, lastModified, http.StatusNotModified},
+		{"weak If-None-Match", http.MethodGet, map[string]string{"If-None-Match": "W/" + etag}, lastModified, http.StatusNotModified},
+		{"stale If-None-Match", http.MethodGet, map[string]string{"If-None-Match": `"old"`}, lastModified, http.StatusOK},
+		{"If-None-Match wins over If-Modified-Since", http.MethodGet, map[string]string{"If-None-Match": `"old"`, "If-Modified-Since": lastModified.Format(http.TimeFormat)}, lastModified, http.StatusOK},
+		{"If-Modified-Since at Last-Modified", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, lastModified, http.StatusNotModified},
+		{"If-Modified-Since before Last-Modified", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, lastModified, http.StatusOK},
+		{"If-Modified-Since without Last-Modified", http.MethodGet, map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, time.Time{}, http.StatusOK},
+		{"not a GET", http.MethodPost, map[string]string{"If-None-Match": etag}, lastModified, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(test.method, "/", nil)
+			for name, value := range test.headers {
+				c.Request.Header.Set(name, value)
+			}
+
+			JSON(c, body, test.lastModified, Private)
+			c.Writer.WriteHeaderNow()
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if got := recorder.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if got := recorder.Header().Get("Cache-Control"); got != Private {
+				t.Errorf("Cache-Control = %s, want %s", got, Private)
+			}
+			if test.wantStatus == http.StatusNotModified && recorder.Body.Len() > 0 {
+				t.Errorf("304 has a body: %s", recorder.Body)
+			}
+		})
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	current := map[string]int{"id": 1}
+	etag, _ := ETag(current)
+
+	tests := []struct {
+		name       string
+		header     string
+		want       bool
+		wantStatus int
+	}{
+		{"no If-Match", "", true, http.StatusOK},
+		{"current tag", etag, true, http.StatusOK},
+		{"wildcard", "*", true, http.StatusOK},
+		{"stale tag", `"old"`, false, http.StatusPreconditionFailed},
+		{"weak tag", "W/" + etag, false, http.StatusPreconditionFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPut, "/", nil)
+			if test.header != "" {
+				c.Request.Header.Set("If-Match", test.header)
+			}
+
+			if got := IfMatch(c, current); got != test.want {
+				t.Errorf("IfMatch() = %v, want %v", got, test.want)
+			}
+			c.Writer.WriteHeaderNow()
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPublic(t *testing.T) {
+	if got := Public(90 * time.Second); got != "public, max-age=90" {
+		t.Errorf("Public() = %s", got)
+	}
+}
@@ -0,0 +1,41 @@
+// Command schemagen writes the JSON Schema of every registered event version
+// to <dir>/<event_type>.v<version>.json.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"shared/events"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("Usage: schemagen <output-dir>\n")
+	}
+	dir := os.Args[1]
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v\n", dir, err)
+	}
+
+	for _, ref := range events.Schemas() {
+		schema, err := events.Schema(ref.EventType, ref.Version)
+		if err != nil {
+			log.Fatalf("Failed to build schema for %s v%d: %v\n", ref.EventType, ref.Version, err)
+		}
+
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to marshal schema for %s v%d: %v\n", ref.EventType, ref.Version, err)
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%s.v%d.json", ref.EventType, ref.Version))
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("Failed to write %s: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package events is the contract for messages exchanged between services over
+// RabbitMQ. Every payload type is versioned: producers always emit the latest
+// version, and consumers upcast older versions before handling them, so a
+// producer can be deployed ahead of its consumers.
+package events
+
+//go:generate go run ./cmd/schemagen schemas
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Envelope is the wire format of every event.
+type Envelope struct {
+	EventID   string          `json:"event_id"`
+	EventType string          `json:"event_type"`
+	Version   int             `json:"version"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Marshal validates payload against the latest schema for eventType and
+// returns its JSON encoding along with the version it was encoded as.
+func Marshal(eventType string, payload interface{}) (json.RawMessage, int, error) {
+	def, err := lookup(eventType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := def.validate(def.latest, data); err != nil {
+		return nil, 0, err
+	}
+
+	return data, def.latest, nil
+}
+
+// NewEnvelope wraps an already encoded payload, validating it against the
+// schema of the given version.
+func NewEnvelope(eventID string, eventType string, version int, payload json.RawMessage) ([]byte, error) {
+	def, err := lookup(eventType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := def.validate(version, payload); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Envelope{
+		EventID:   eventID,
+		EventType: eventType,
+		Version:   version,
+		Payload:   payload,
+	})
+}
+
+// Encode builds a complete envelope for payload at the latest version.
+func Encode(eventID string, eventType string, payload interface{}) ([]byte, error) {
+	data, version, err := Marshal(eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEnvelope(eventID, eventType, version, data)
+}
+
+// Decode parses an envelope, validates it and upcasts its payload to the
+// latest version. Envelopes without a version are treated as version 1.
+func Decode(body []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.EventID == "" {
+		return nil, fmt.Errorf("event has no event_id")
+	}
+
+	if envelope.Version == 0 {
+		envelope.Version = 1
+	}
+
+	payload, version, err := Upcast(envelope.EventType, envelope.Version, envelope.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope.Payload = payload
+	envelope.Version = version
+
+	return &envelope, nil
+}
+
+// Upcast validates payload against the schema of version and converts it to
+// the latest version of eventType.
+func Upcast(eventType string, version int, payload json.RawMessage) (json.RawMessage, int, error) {
+	def, err := lookup(eventType)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := def.validate(version, payload); err != nil {
+		return nil, 0, err
+	}
+
+	for version < def.latest {
+		upcaster, ok := def.upcasters[version]
+		if !ok {
+			return nil, 0, fmt.Errorf("no upcaster for %s v%d", eventType, version)
+		}
+
+		payload, err = upcaster(payload)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to upcast %s v%d: %w", eventType, version, err)
+		}
+		version++
+
+		if err := def.validate(version, payload); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return payload, version, nil
+}
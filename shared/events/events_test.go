@@ -0,0 +1,276 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpcast(t *testing.T) {
+	tests := []struct {
+		name        string
+		eventType   string
+		version     int
+		payload     string
+		wantVersion int
+		want        string
+	}{
+		{
+			name:        "competition_created v1 renames id and defaults the visibility",
+			eventType:   CompetitionCreated,
+			version:     1,
+			payload:     `{"id": 7, "name": "Spring", "description": "d", "problem_ids": [1, 2]}`,
+			wantVersion: 4,
+			want:        `{"competition_id": 7, "name": "Spring", "description": "d", "problem_ids": [1, 2], "starts_at": null, "ends_at": null, "visibility": "public"}`,
+		},
+		{
+			name:        "competition_created v2 gets an open schedule",
+			eventType:   CompetitionCreated,
+			version:     2,
+			payload:     `{"competition_id": 7, "name": "Spring", "description": "", "problem_ids": null}`,
+			wantVersion: 4,
+			want:        `{"competition_id": 7, "name": "Spring", "description": "", "problem_ids": null, "starts_at": null, "ends_at": null, "visibility": "public"}`,
+		},
+		{
+			name:        "competition_created v3 keeps its schedule",
+			eventType:   CompetitionCreated,
+			version:     3,
+			payload:     `{"competition_id": 7, "name": "Spring", "description": "", "problem_ids": [3], "starts_at": "2026-03-01T10:00:00Z", "ends_at": null}`,
+			wantVersion: 4,
+			want:        `{"competition_id": 7, "name": "Spring", "description": "", "problem_ids": [3], "starts_at": "2026-03-01T10:00:00Z", "ends_at": null, "visibility": "public"}`,
+		},
+		{
+			name:        "competition_created v4 is already the latest",
+			eventType:   CompetitionCreated,
+			version:     4,
+			payload:     `{"competition_id": 7, "name": "Spring", "visibility": "private"}`,
+			wantVersion: 4,
+			want:        `{"competition_id": 7, "name": "Spring", "visibility": "private"}`,
+		},
+		{
+			name:        "leaderboard_success v1 drops the event ID",
+			eventType:   LeaderboardSuccess,
+			version:     1,
+			payload:     `{"event_id": "e1", "competition_id": 7}`,
+			wantVersion: 2,
+			want:        `{"competition_id": 7, "leaderboard_id": 0}`,
+		},
+		{
+			name:        "submission_judged v1 counts for the standings",
+			eventType:   SubmissionJudged,
+			version:     1,
+			payload:     `{"competition_id": 1, "submission_id": 2, "problem_id": 3, "user_id": 4, "team_id": null, "verdict": "accepted", "points": 100, "judged_at": "2026-03-01T10:00:00Z"}`,
+			wantVersion: 2,
+			want:        `{"competition_id": 1, "submission_id": 2, "problem_id": 3, "user_id": 4, "team_id": null, "virtual_session_id": null, "verdict": "accepted", "points": 100, "judged_at": "2026-03-01T10:00:00Z"}`,
+		},
+		{
+			name:        "competition_access_changed v1 comes before every versioned change",
+			eventType:   CompetitionAccessChanged,
+			version:     1,
+			payload:     `{"competition_id": 7, "visibility": "private", "user_ids": [1], "organizations": ["acme"]}`,
+			wantVersion: 2,
+			want:        `{"competition_id": 7, "access_version": 0, "visibility": "private", "user_ids": [1], "organizations": ["acme"]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, version, err := Upcast(test.eventType, test.version, json.RawMessage(test.payload))
+			if err != nil {
+				t.Fatalf("Upcast() error = %v", err)
+			}
+			if version != test.wantVersion {
+				t.Errorf("Upcast() version = %d, want %d", version, test.wantVersion)
+			}
+			assertJSONEqual(t, payload, test.want)
+		})
+	}
+}
+
+func TestUpcastRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		version   int
+		payload   string
+		wantErr   string
+	}{
+		{"unknown event type", "no_such_event", 1, `{}`, "unknown event type"},
+		{"unknown version", CompetitionCreated, 9, `{}`, "unknown version 9"},
+		{"invalid payload for its version", CompetitionCreated, 1, `{"id": 0}`, "must be >= 1"},
+		{"payload that is not an object", Rollback, 1, `[1]`, "expected object"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := Upcast(test.eventType, test.version, json.RawMessage(test.payload))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Upcast() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		payload   string
+		wantErr   string
+	}{
+		{"valid", ParticipantRegistered, `{"competition_id": 1, "user_id": 2, "username": "ada"}`, ""},
+		{"missing required field", ParticipantRegistered, `{"competition_id": 1, "user_id": 2}`, "username"},
+		{"below minimum", ParticipantRegistered, `{"competition_id": 0, "user_id": 2, "username": "ada"}`, "must be >= 1"},
+		{"wrong type", ParticipantRegistered, `{"competition_id": "1", "user_id": 2, "username": "ada"}`, "competition_id"},
+		{"fraction for an integer", ParticipantRegistered, `{"competition_id": 1.5, "user_id": 2, "username": "ada"}`, "competition_id"},
+		{"value outside the enum", CompetitionAccessChanged, `{"competition_id": 1, "access_version": 1, "visibility": "secret", "user_ids": [], "organizations": []}`, "must be one of"},
+		{"invalid array item", TeamRegistered, `{"competition_id": 1, "team_id": 2, "team_name": "t", "members": [{"user_id": 0, "username": "ada"}]}`, "members[0]"},
+		{"null for a nullable field", SubmissionJudged, `{"competition_id": 1, "submission_id": 2, "problem_id": 3, "user_id": 4, "team_id": null, "virtual_session_id": null, "verdict": "accepted", "points": 0, "judged_at": "2026-03-01T10:00:00Z"}`, ""},
+		{"negative points", SubmissionJudged, `{"competition_id": 1, "submission_id": 2, "problem_id": 3, "user_id": 4, "verdict": "accepted", "points": -1, "judged_at": "2026-03-01T10:00:00Z"}`, "must be >= 0"},
+		{"unknown verdict", SubmissionJudged, `{"competition_id": 1, "submission_id": 2, "problem_id": 3, "user_id": 4, "verdict": "pending", "points": 0, "judged_at": "2026-03-01T10:00:00Z"}`, "must be one of"},
+		{"missing access version", CompetitionAccessChanged, `{"competition_id": 1, "visibility": "public", "user_ids": [], "organizations": []}`, "access_version"},
+		{"malformed JSON", Rollback, `{"competition_id": `, "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def, err := lookup(test.eventType)
+			if err != nil {
+				t.Fatalf("lookup() error = %v", err)
+			}
+
+			err = def.validate(def.latest, json.RawMessage(test.payload))
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("validate() error = %v, want none", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("validate() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	teamID := 5
+	event := SubmissionJudgedEvent{
+		CompetitionID: 1,
+		SubmissionID:  2,
+		ProblemID:     3,
+		UserID:        4,
+		TeamID:        &teamID,
+		Verdict:       "accepted",
+		Points:        100,
+		JudgedAt:      time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC),
+	}
+
+	body, err := Encode("e1", SubmissionJudged, event)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	envelope, err := Decode(body)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if envelope.EventID != "e1" || envelope.EventType != SubmissionJudged || envelope.Version != 2 {
+		t.Errorf("Decode() = %+v, want event e1 of type %s at version 2", envelope, SubmissionJudged)
+	}
+
+	var decoded SubmissionJudgedEvent
+	if err := json.Unmarshal(envelope.Payload, &decoded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if decoded.TeamID == nil || *decoded.TeamID != teamID || decoded.Points != 100 || !decoded.JudgedAt.Equal(event.JudgedAt) {
+		t.Errorf("decoded payload = %+v, want %+v", decoded, event)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantVersion int
+		wantErr     string
+	}{
+		{"versionless envelope is version 1", `{"event_id": "e1", "event_type": "leaderboard_success", "payload": {"competition_id": 7}}`, 2, ""},
+		{"older version is upcast", `{"event_id": "e1", "event_type": "competition_created", "version": 2, "payload": {"competition_id": 7, "name": "n"}}`, 4, ""},
+		{"missing event ID", `{"event_type": "rollback_events", "version": 1, "payload": {"competition_id": 7}}`, 0, "no event_id"},
+		{"unknown event type", `{"event_id": "e1", "event_type": "nope", "version": 1, "payload": {}}`, 0, "unknown event type"},
+		{"invalid payload", `{"event_id": "e1", "event_type": "rollback_events", "version": 1, "payload": {}}`, 0, "competition_id"},
+		{"not JSON", `event`, 0, "invalid character"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := Decode([]byte(test.body))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("Decode() error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if envelope.Version != test.wantVersion {
+				t.Errorf("Decode() version = %d, want %d", envelope.Version, test.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMarshalRejectsInvalidPayload(t *testing.T) {
+	_, _, err := Marshal(ParticipantRegistered, ParticipantRegisteredEvent{CompetitionID: 1, UserID: 0, Username: "ada"})
+	if err == nil || !strings.Contains(err.Error(), "user_id") {
+		t.Errorf("Marshal() error = %v, want one about user_id", err)
+	}
+}
+
+// TestSchemasUpToDate fails when a payload changed without running
+// go generate, so that the published schemas match what producers validate.
+func TestSchemasUpToDate(t *testing.T) {
+	for _, ref := range Schemas() {
+		name := fmt.Sprintf("%s.v%d.json", ref.EventType, ref.Version)
+		t.Run(name, func(t *testing.T) {
+			schema, err := Schema(ref.EventType, ref.Version)
+			if err != nil {
+				t.Fatalf("Schema() error = %v", err)
+			}
+			want, err := json.MarshalIndent(schema, "", "  ")
+			if err != nil {
+				t.Fatalf("MarshalIndent() error = %v", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join("schemas", name))
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v; run go generate ./...", err)
+			}
+			if !bytes.Equal(bytes.TrimSpace(got), want) {
+				t.Errorf("schemas/%s is out of date; run go generate ./...", name)
+			}
+		})
+	}
+}
+
+func assertJSONEqual(t *testing.T, got json.RawMessage, want string) {
+	t.Helper()
+
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+
+	gotJSON, _ := json.Marshal(gotValue)
+	wantJSON, _ := json.Marshal(wantValue)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("payload = %s, want %s", gotJSON, wantJSON)
+	}
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Upcaster converts a payload from one version to the next.
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+type definition struct {
+	eventType string
+	latest    int
+	versions  map[int]reflect.Type
+	schemas   map[int]map[string]interface{}
+	upcasters map[int]Upcaster
+}
+
+var registry = make(map[string]*definition)
+
+func register(eventType string, version int, payload interface{}) {
+	def, ok := registry[eventType]
+	if !ok {
+		def = &definition{
+			eventType: eventType,
+			versions:  make(map[int]reflect.Type),
+			schemas:   make(map[int]map[string]interface{}),
+			upcasters: make(map[int]Upcaster),
+		}
+		registry[eventType] = def
+	}
+
+	t := reflect.TypeOf(payload)
+	def.versions[version] = t
+	def.schemas[version] = generateSchema(t, fmt.Sprintf("%s v%d", eventType, version))
+	if version > def.latest {
+		def.latest = version
+	}
+}
+
+func registerUpcaster(eventType string, fromVersion int, upcaster Upcaster) {
+	registry[eventType].upcasters[fromVersion] = upcaster
+}
+
+func lookup(eventType string) (*definition, error) {
+	def, ok := registry[eventType]
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %q", eventType)
+	}
+
+	return def, nil
+}
+
+func (d *definition) validate(version int, payload json.RawMessage) error {
+	schema, ok := d.schemas[version]
+	if !ok {
+		return fmt.Errorf("unknown version %d of event type %q", version, d.eventType)
+	}
+
+	if err := validate(schema, payload); err != nil {
+		return fmt.Errorf("invalid %s v%d payload: %w", d.eventType, version, err)
+	}
+
+	return nil
+}
+
+// LatestVersion returns the version producers currently emit for eventType.
+func LatestVersion(eventType string) (int, error) {
+	def, err := lookup(eventType)
+	if err != nil {
+		return 0, err
+	}
+
+	return def.latest, nil
+}
+
+// Schema returns the JSON Schema of a specific event version.
+func Schema(eventType string, version int) (map[string]interface{}, error) {
+	def, err := lookup(eventType)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, ok := def.schemas[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown version %d of event type %q", version, eventType)
+	}
+
+	return schema, nil
+}
+
+// SchemaRef identifies one version of one event type.
+type SchemaRef struct {
+	EventType string
+	Version   int
+}
+
+// Schemas lists every registered event version in a stable order.
+func Schemas() []SchemaRef {
+	var refs []SchemaRef
+	for eventType, def := range registry {
+		for version := range def.versions {
+			refs = append(refs, SchemaRef{EventType: eventType, Version: version})
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].EventType != refs[j].EventType {
+			return refs[i].EventType < refs[j].EventType
+		}
+		return refs[i].Version < refs[j].Version
+	})
+
+	return refs
+}
@@ -0,0 +1,253 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// generateSchema builds a JSON Schema from a payload struct. Field names come
+// from `json` tags; constraints come from `schema` tags, e.g.
+// `schema:"required,minimum=1,maxLength=255"`.
+func generateSchema(t reflect.Type, title string) map[string]interface{} {
+	schema := typeSchema(t)
+	schema["$schema"] = schemaDraft
+	schema["title"] = title
+
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := typeSchema(t.Elem())
+		schema["type"] = nullable(schema["type"])
+		return schema
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := typeSchema(field.Type)
+		for _, option := range strings.Split(field.Tag.Get("schema"), ",") {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "required":
+				required = append(required, name)
+			case "minimum", "maximum":
+				number, _ := strconv.ParseFloat(value, 64)
+				property[key] = number
+			case "minLength", "maxLength", "minItems", "maxItems":
+				number, _ := strconv.Atoi(value)
+				property[key] = number
+			case "enum":
+				property[key] = strings.Split(value, "|")
+			}
+		}
+
+		properties[name] = property
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+func nullable(schemaType interface{}) interface{} {
+	switch t := schemaType.(type) {
+	case string:
+		return []string{t, "null"}
+	case []string:
+		return t
+	default:
+		return nil
+	}
+}
+
+// validate checks payload against a schema produced by generateSchema. It
+// supports the subset of JSON Schema the generator emits.
+func validate(schema map[string]interface{}, payload json.RawMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+
+	return validateValue(schema, value, "payload")
+}
+
+func validateValue(schema map[string]interface{}, value interface{}, path string) error {
+	if schemaType, ok := schema["type"]; ok && !matchesType(schemaType, value) {
+		return fmt.Errorf("%s: expected %v", path, schemaType)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s.%s: is required", path, name)
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range properties {
+			fieldValue, ok := v[name]
+			if !ok {
+				continue
+			}
+			if err := validateValue(property.(map[string]interface{}), fieldValue, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if minItems, ok := schema["minItems"].(int); ok && len(v) < minItems {
+			return fmt.Errorf("%s: must have at least %d items", path, minItems)
+		}
+		if maxItems, ok := schema["maxItems"].(int); ok && len(v) > maxItems {
+			return fmt.Errorf("%s: must have at most %d items", path, maxItems)
+		}
+
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if minLength, ok := schema["minLength"].(int); ok && length < minLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, minLength)
+		}
+		if maxLength, ok := schema["maxLength"].(int); ok && length > maxLength {
+			return fmt.Errorf("%s: must be at most %d characters", path, maxLength)
+		}
+		if enum, ok := schema["enum"].([]string); ok && !contains(enum, v) {
+			return fmt.Errorf("%s: must be one of %v", path, enum)
+		}
+	case json.Number:
+		number, _ := v.Float64()
+		if minimum, ok := schema["minimum"].(float64); ok && number < minimum {
+			return fmt.Errorf("%s: must be >= %v", path, minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && number > maximum {
+			return fmt.Errorf("%s: must be <= %v", path, maximum)
+		}
+	}
+
+	return nil
+}
+
+func matchesType(schemaType interface{}, value interface{}) bool {
+	switch t := schemaType.(type) {
+	case string:
+		return isType(t, value)
+	case []string:
+		for _, name := range t {
+			if isType(name, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func isType(name string, value interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := number.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "null":
+		return value == nil
+	default:
+		return false
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,331 @@
+package events
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	CompetitionCreated = "competition_created"
+	LeaderboardSuccess = "leaderboard_success"
+	Rollback           = "rollback_events"
+
+	ParticipantRegistered = "participant_registered"
+	TeamRegistered        = "team_registered"
+
+	VirtualSessionStarted = "virtual_session_started"
+
+	SubmissionJudged = "submission_judged"
+
+	ProblemUpdated     = "problem_updated"
+	ProblemDeleted     = "problem_deleted"
+	CompetitionDeleted = "competition_deleted"
+
+	CompetitionUpdated       = "competition_updated"
+	CompetitionCancelled     = "competition_cancelled"
+	CompetitionAccessChanged = "competition_access_changed"
+)
+
+// Aliases for the latest version of each payload. Services use these so that
+// bumping a version only touches the fields that changed.
+type (
+	CompetitionCreatedEvent = CompetitionCreatedV4
+	LeaderboardSuccessEvent = LeaderboardSuccessV2
+	RollbackEvent           = RollbackV1
+
+	ParticipantRegisteredEvent = ParticipantRegisteredV1
+	TeamRegisteredEvent        = TeamRegisteredV1
+
+	VirtualSessionStartedEvent = VirtualSessionStartedV1
+
+	SubmissionJudgedEvent = SubmissionJudgedV2
+
+	ProblemUpdatedEvent     = ProblemUpdatedV1
+	ProblemDeletedEvent     = ProblemDeletedV1
+	CompetitionDeletedEvent = CompetitionDeletedV1
+
+	CompetitionUpdatedEvent       = CompetitionUpdatedV1
+	CompetitionCancelledEvent     = CompetitionCancelledV1
+	CompetitionAccessChangedEvent = CompetitionAccessChangedV2
+)
+
+// CompetitionCreatedV1 used `id` for the competition ID.
+type CompetitionCreatedV1 struct {
+	ID          int    `json:"id" schema:"required,minimum=1"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ProblemIDs  []int  `json:"problem_ids"`
+}
+
+type CompetitionCreatedV2 struct {
+	CompetitionID int    `json:"competition_id" schema:"required,minimum=1"`
+	Name          string `json:"name" schema:"required"`
+	Description   string `json:"description"`
+	ProblemIDs    []int  `json:"problem_ids"`
+}
+
+// CompetitionCreatedV3 adds the schedule; either end may be open.
+type CompetitionCreatedV3 struct {
+	CompetitionID int        `json:"competition_id" schema:"required,minimum=1"`
+	Name          string     `json:"name" schema:"required"`
+	Description   string     `json:"description"`
+	ProblemIDs    []int      `json:"problem_ids"`
+	StartsAt      *time.Time `json:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at"`
+}
+
+// CompetitionCreatedV4 adds the visibility. Who may see a private
+// competition follows in competition_access_changed.
+type CompetitionCreatedV4 struct {
+	CompetitionID int        `json:"competition_id" schema:"required,minimum=1"`
+	Name          string     `json:"name" schema:"required"`
+	Description   string     `json:"description"`
+	ProblemIDs    []int      `json:"problem_ids"`
+	StartsAt      *time.Time `json:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at"`
+	Visibility    string     `json:"visibility" schema:"required,enum=public|unlisted|private"`
+}
+
+// LeaderboardSuccessV1 repeated the event ID inside the payload.
+type LeaderboardSuccessV1 struct {
+	EventID       string `json:"event_id"`
+	CompetitionID int    `json:"competition_id" schema:"required,minimum=1"`
+}
+
+type LeaderboardSuccessV2 struct {
+	CompetitionID int `json:"competition_id" schema:"required,minimum=1"`
+	LeaderboardID int `json:"leaderboard_id"`
+}
+
+type RollbackV1 struct {
+	CompetitionID int    `json:"competition_id" schema:"required,minimum=1"`
+	Reason        string `json:"reason"`
+}
+
+type ParticipantRegisteredV1 struct {
+	CompetitionID int    `json:"competition_id" schema:"required,minimum=1"`
+	UserID        int    `json:"user_id" schema:"required,minimum=1"`
+	Username      string `json:"username" schema:"required"`
+}
+
+// TeamRegisteredV1 carries the roster as it was registered; later changes to
+// the team do not affect the competition.
+type TeamRegisteredV1 struct {
+	CompetitionID int            `json:"competition_id" schema:"required,minimum=1"`
+	TeamID        int            `json:"team_id" schema:"required,minimum=1"`
+	TeamName      string         `json:"team_name" schema:"required"`
+	Members       []TeamMemberV1 `json:"members" schema:"required"`
+}
+
+type TeamMemberV1 struct {
+	UserID   int    `json:"user_id" schema:"required,minimum=1"`
+	Username string `json:"username" schema:"required"`
+}
+
+// VirtualSessionStartedV1 announces a user's virtual run of a competition
+// that has ended, timed by the user's own clock.
+type VirtualSessionStartedV1 struct {
+	CompetitionID int       `json:"competition_id" schema:"required,minimum=1"`
+	SessionID     int       `json:"session_id" schema:"required,minimum=1"`
+	UserID        int       `json:"user_id" schema:"required,minimum=1"`
+	Username      string    `json:"username" schema:"required"`
+	StartsAt      time.Time `json:"starts_at" schema:"required"`
+	EndsAt        time.Time `json:"ends_at" schema:"required"`
+}
+
+// SubmissionJudgedV1 reports a submission's verdict and the points it earned
+// whoever it counts for: the team when TeamID is set, and the user otherwise.
+// Only the first accepted submission to a problem earns points.
+type SubmissionJudgedV1 struct {
+	CompetitionID int       `json:"competition_id" schema:"required,minimum=1"`
+	SubmissionID  int       `json:"submission_id" schema:"required,minimum=1"`
+	ProblemID     int       `json:"problem_id" schema:"required,minimum=1"`
+	UserID        int       `json:"user_id" schema:"required,minimum=1"`
+	TeamID        *int      `json:"team_id"`
+	Verdict       string    `json:"verdict" schema:"required,enum=accepted|wrong_answer|time_limit|memory_limit|runtime_error|compile_error"`
+	Points        int       `json:"points" schema:"required,minimum=0"`
+	JudgedAt      time.Time `json:"judged_at" schema:"required"`
+}
+
+// SubmissionJudgedV2 adds VirtualSessionID, which is set when the submission
+// counts for a virtual run instead.
+type SubmissionJudgedV2 struct {
+	CompetitionID    int       `json:"competition_id" schema:"required,minimum=1"`
+	SubmissionID     int       `json:"submission_id" schema:"required,minimum=1"`
+	ProblemID        int       `json:"problem_id" schema:"required,minimum=1"`
+	UserID           int       `json:"user_id" schema:"required,minimum=1"`
+	TeamID           *int      `json:"team_id"`
+	VirtualSessionID *int      `json:"virtual_session_id"`
+	Verdict          string    `json:"verdict" schema:"required,enum=accepted|wrong_answer|time_limit|memory_limit|runtime_error|compile_error"`
+	Points           int       `json:"points" schema:"required,minimum=0"`
+	JudgedAt         time.Time `json:"judged_at" schema:"required"`
+}
+
+// ProblemUpdatedV1, ProblemDeletedV1 and CompetitionDeletedV1 are published
+// on the cache_invalidation exchange so that every service caching the entity
+// can drop its copy.
+type ProblemUpdatedV1 struct {
+	ProblemID int `json:"problem_id" schema:"required,minimum=1"`
+}
+
+type ProblemDeletedV1 struct {
+	ProblemID int `json:"problem_id" schema:"required,minimum=1"`
+}
+
+type CompetitionDeletedV1 struct {
+	CompetitionID int    `json:"competition_id" schema:"required,minimum=1"`
+	Reason        string `json:"reason"`
+}
+
+// CompetitionUpdatedV1 carries the competition as it is after the change,
+// so consumers can apply it without knowing what changed.
+type CompetitionUpdatedV1 struct {
+	CompetitionID int        `json:"competition_id" schema:"required,minimum=1"`
+	Name          string     `json:"name" schema:"required"`
+	Description   string     `json:"description"`
+	ProblemIDs    []int      `json:"problem_ids"`
+	StartsAt      *time.Time `json:"starts_at"`
+	EndsAt        *time.Time `json:"ends_at"`
+}
+
+type CompetitionCancelledV1 struct {
+	CompetitionID int       `json:"competition_id" schema:"required,minimum=1"`
+	Reason        string    `json:"reason"`
+	CancelledAt   time.Time `json:"cancelled_at" schema:"required"`
+}
+
+// CompetitionAccessChangedV1 carries everyone who may see a competition
+// beyond its registered participants: organizers and allowlisted users by
+// ID, and allowlisted organizations by name. It replaces whatever the
+// previous event said.
+type CompetitionAccessChangedV1 struct {
+	CompetitionID int      `json:"competition_id" schema:"required,minimum=1"`
+	Visibility    string   `json:"visibility" schema:"required,enum=public|unlisted|private"`
+	UserIDs       []int    `json:"user_ids" schema:"required"`
+	Organizations []string `json:"organizations" schema:"required"`
+}
+
+// CompetitionAccessChangedV2 adds the competition's access version, which
+// grows with every event so that consumers can ignore one that arrives after
+// a newer one. Events from before versions existed upcast to version 0.
+type CompetitionAccessChangedV2 struct {
+	CompetitionID int      `json:"competition_id" schema:"required,minimum=1"`
+	AccessVersion int      `json:"access_version" schema:"required,minimum=0"`
+	Visibility    string   `json:"visibility" schema:"required,enum=public|unlisted|private"`
+	UserIDs       []int    `json:"user_ids" schema:"required"`
+	Organizations []string `json:"organizations" schema:"required"`
+}
+
+func init() {
+	register(CompetitionCreated, 1, CompetitionCreatedV1{})
+	register(CompetitionCreated, 2, CompetitionCreatedV2{})
+	registerUpcaster(CompetitionCreated, 1, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v1 CompetitionCreatedV1
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(CompetitionCreatedV2{
+			CompetitionID: v1.ID,
+			Name:          v1.Name,
+			Description:   v1.Description,
+			ProblemIDs:    v1.ProblemIDs,
+		})
+	})
+
+	register(CompetitionCreated, 3, CompetitionCreatedV3{})
+	registerUpcaster(CompetitionCreated, 2, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v2 CompetitionCreatedV2
+		if err := json.Unmarshal(payload, &v2); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(CompetitionCreatedV3{
+			CompetitionID: v2.CompetitionID,
+			Name:          v2.Name,
+			Description:   v2.Description,
+			ProblemIDs:    v2.ProblemIDs,
+		})
+	})
+
+	register(CompetitionCreated, 4, CompetitionCreatedV4{})
+	registerUpcaster(CompetitionCreated, 3, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v3 CompetitionCreatedV3
+		if err := json.Unmarshal(payload, &v3); err != nil {
+			return nil, err
+		}
+
+		// Every competition was public before visibility existed.
+		return json.Marshal(CompetitionCreatedV4{
+			CompetitionID: v3.CompetitionID,
+			Name:          v3.Name,
+			Description:   v3.Description,
+			ProblemIDs:    v3.ProblemIDs,
+			StartsAt:      v3.StartsAt,
+			EndsAt:        v3.EndsAt,
+			Visibility:    "public",
+		})
+	})
+
+	register(LeaderboardSuccess, 1, LeaderboardSuccessV1{})
+	register(LeaderboardSuccess, 2, LeaderboardSuccessV2{})
+	registerUpcaster(LeaderboardSuccess, 1, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v1 LeaderboardSuccessV1
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(LeaderboardSuccessV2{CompetitionID: v1.CompetitionID})
+	})
+
+	register(Rollback, 1, RollbackV1{})
+
+	register(ParticipantRegistered, 1, ParticipantRegisteredV1{})
+	register(TeamRegistered, 1, TeamRegisteredV1{})
+
+	register(VirtualSessionStarted, 1, VirtualSessionStartedV1{})
+
+	register(SubmissionJudged, 1, SubmissionJudgedV1{})
+	register(SubmissionJudged, 2, SubmissionJudgedV2{})
+	registerUpcaster(SubmissionJudged, 1, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v1 SubmissionJudgedV1
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+
+		// Submissions judged before virtual runs existed all count for the
+		// standings.
+		return json.Marshal(SubmissionJudgedV2{
+			CompetitionID: v1.CompetitionID,
+			SubmissionID:  v1.SubmissionID,
+			ProblemID:     v1.ProblemID,
+			UserID:        v1.UserID,
+			TeamID:        v1.TeamID,
+			Verdict:       v1.Verdict,
+			Points:        v1.Points,
+			JudgedAt:      v1.JudgedAt,
+		})
+	})
+
+	register(ProblemUpdated, 1, ProblemUpdatedV1{})
+	register(ProblemDeleted, 1, ProblemDeletedV1{})
+	register(CompetitionDeleted, 1, CompetitionDeletedV1{})
+
+	register(CompetitionUpdated, 1, CompetitionUpdatedV1{})
+	register(CompetitionCancelled, 1, CompetitionCancelledV1{})
+	register(CompetitionAccessChanged, 1, CompetitionAccessChangedV1{})
+	register(CompetitionAccessChanged, 2, CompetitionAccessChangedV2{})
+	registerUpcaster(CompetitionAccessChanged, 1, func(payload json.RawMessage) (json.RawMessage, error) {
+		var v1 CompetitionAccessChangedV1
+		if err := json.Unmarshal(payload, &v1); err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(CompetitionAccessChangedV2{
+			CompetitionID: v1.CompetitionID,
+			Visibility:    v1.Visibility,
+			UserIDs:       v1.UserIDs,
+			Organizations: v1.Organizations,
+		})
+	})
+}
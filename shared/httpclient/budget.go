@@ -0,0 +1,39 @@
+package httpclient
+
+import "sync"
+
+// retryBudget lets a fixed share of requests be retried. Every request
+// deposits ratio tokens and every retry spends one, so when a downstream
+// fails outright retries stop at ratio times the request rate instead of
+// multiplying it by MaxAttempts.
+type retryBudget struct {
+	mutex  sync.Mutex
+	ratio  float64
+	tokens float64
+	max    float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	// Start with enough tokens for a few retries so that a quiet client can
+	// still retry its first failures.
+	return &retryBudget{ratio: ratio, tokens: 10, max: 10}
+}
+
+func (b *retryBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens = min(b.max, b.tokens+b.ratio)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
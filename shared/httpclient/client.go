@@ -0,0 +1,412 @@
+// Package httpclient is the client services use to call each other. Every
+// call has a timeout and honours its context; failed idempotent calls are
+// retried within a retry budget, slow GETs are hedged against another
+// instance, and each endpoint gets its own circuit breaker. Responses are
+// decoded into the caller's types.
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"shared/breaker"
+	"shared/ratelimit"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+const maxErrorBody = 4096
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_client_request_duration_seconds",
+		Help:    "Duration of outgoing HTTP attempts by service, route and result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "route", "result"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_client_retries_total",
+		Help: "Outgoing HTTP attempts that were retries.",
+	}, []string{"service", "route"})
+
+	hedges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_client_hedged_requests_total",
+		Help: "Outgoing GETs that were hedged, by which attempt won.",
+	}, []string{"service", "route", "winner"})
+)
+
+// Config describes one downstream service.
+type Config struct {
+	// Service names the downstream in metrics, breakers and rate limits.
+	Service string
+	// BaseURLs are the service's instances; see Discover.
+	BaseURLs []string
+	// Header is sent with every request, e.g. credentials.
+	Header http.Header
+
+	// Timeout bounds each attempt. Defaults to 5s.
+	Timeout time.Duration
+	// MaxAttempts includes the first attempt. Defaults to 1.
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry; it doubles after each.
+	RetryBackoff time.Duration
+	// RetryRatio is the share of requests that may be retried, so that
+	// retries cannot multiply load on a struggling service. Defaults to 0.2.
+	RetryRatio float64
+	// HedgeDelay sends a second GET to another instance when the first has
+	// not answered in time. Zero disables hedging, as does having a single
+	// instance.
+	HedgeDelay time.Duration
+
+	// Breakers provides a breaker per route. Optional.
+	Breakers *breaker.Registry
+	// Limiter bounds outgoing requests under LimiterKey. Retries and hedges
+	// of a request are not charged again. Optional.
+	Limiter    ratelimit.Limiter
+	LimiterKey string
+
+	// Transport defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	budget *retryBudget
+	next   atomic.Uint64
+}
+
+func New(config Config) *Client {
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 1
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 100 * time.Millisecond
+	}
+	if config.RetryRatio <= 0 {
+		config.RetryRatio = 0.2
+	}
+	if config.LimiterKey == "" {
+		config.LimiterKey = config.Service
+	}
+
+	transport := config.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Client{
+		config: config,
+		http:   &http.Client{Transport: transport},
+		budget: newRetryBudget(config.RetryRatio),
+	}
+}
+
+type Request struct {
+	Method string
+	// Path is appended to the instance's base URL.
+	Path  string
+	Query url.Values
+	Body  interface{}
+	// Route labels metrics and selects the breaker, e.g. "/problems/:id".
+	// Defaults to Path.
+	Route string
+}
+
+// StatusError is a response outside 2xx other than 429.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response %s: %s", e.Status, e.Body)
+}
+
+// RateLimitedError means the call was not made, or was refused, because of a
+// rate limit. Upstream is set when the downstream answered 429 rather than
+// our own limiter holding the call back.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+	Upstream   bool
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.Upstream {
+		return fmt.Sprintf("rate limited by upstream, retry after %v", e.RetryAfter)
+	}
+
+	return fmt.Sprintf("outgoing rate limit reached, retry after %v", e.RetryAfter)
+}
+
+// IsSuccessful is meant for breaker.Config: being rate limited or sent a
+// client error does not mean the downstream is unhealthy. The breaker leaves
+// cancelled attempts, such as the loser of a hedge, out of its counts.
+func IsSuccessful(err error) bool {
+	var rateLimited *RateLimitedError
+	var status *StatusError
+	return err == nil || errors.As(err, &rateLimited) || (errors.As(err, &status) && status.StatusCode < 500)
+}
+
+// Get decodes the JSON response of a GET into out.
+func (c *Client) Get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.Do(ctx, Request{Method: http.MethodGet, Path: path, Query: query}, out)
+}
+
+// Do sends req and decodes a JSON response into out unless out is nil.
+func (c *Client) Do(ctx context.Context, req Request, out interface{}) error {
+	if len(c.config.BaseURLs) == 0 {
+		return fmt.Errorf("no instances configured for %s", c.config.Service)
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.Route == "" {
+		req.Route = req.Path
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = json.Marshal(req.Body); err != nil {
+			return err
+		}
+	}
+
+	if c.config.Limiter != nil {
+		result, err := c.config.Limiter.Allow(ctx, c.config.LimiterKey)
+		if err != nil {
+			return fmt.Errorf("failed to check outgoing rate limit: %w", err)
+		}
+		if !result.Allowed {
+			return &RateLimitedError{RetryAfter: result.RetryAfter}
+		}
+	}
+
+	c.budget.deposit()
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead ||
+		req.Method == http.MethodPut || req.Method == http.MethodDelete
+
+	backoff := c.config.RetryBackoff
+	var data []byte
+	var err error
+	for attempt := 1; ; attempt++ {
+		if req.Method == http.MethodGet && c.config.HedgeDelay > 0 && len(c.config.BaseURLs) > 1 {
+			data, err = c.hedged(ctx, req)
+		} else {
+			data, err = c.attempt(ctx, req, body, c.pickInstance())
+		}
+
+		if err == nil || !idempotent || !retryable(err) || attempt >= c.config.MaxAttempts || !c.budget.withdraw() {
+			break
+		}
+
+		retries.WithLabelValues(c.config.Service, req.Route).Inc()
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+type attemptResult struct {
+	data   []byte
+	err    error
+	hedged bool
+}
+
+// hedged starts a second attempt against the next instance if the first has
+// not answered within HedgeDelay, and returns whichever succeeds first. The
+// loser is cancelled. Probes of a half-open breaker are not hedged.
+func (c *Client) hedged(ctx context.Context, req Request) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	original, hedge := c.pickInstancePair()
+	if c.config.Breakers != nil && c.config.Breakers.Get(c.config.Service, req.Method+" "+req.Route).State() != gobreaker.StateClosed {
+		return c.attempt(ctx, req, nil, original)
+	}
+
+	results := make(chan attemptResult, 2)
+	launch := func(baseURL string, hedged bool) {
+		data, err := c.attempt(ctx, req, nil, baseURL)
+		results <- attemptResult{data: data, err: err, hedged: hedged}
+	}
+
+	go launch(original, false)
+	pending := 1
+
+	timer := time.NewTimer(c.config.HedgeDelay)
+	defer timer.Stop()
+
+	var last attemptResult
+	for {
+		select {
+		case <-timer.C:
+			go launch(hedge, true)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if pending > 0 || result.hedged {
+					winner := "original"
+					if result.hedged {
+						winner = "hedge"
+					}
+					hedges.WithLabelValues(c.config.Service, req.Route, winner).Inc()
+				}
+				return result.data, nil
+			}
+
+			last = result
+			// A failed first attempt before the hedge fired is left to the
+			// retry loop rather than hedged.
+			if pending == 0 {
+				return nil, last.err
+			}
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, req Request, body []byte, baseURL string) ([]byte, error) {
+	call := func() (interface{}, error) {
+		return c.send(ctx, req, body, baseURL)
+	}
+
+	var data interface{}
+	var err error
+	if c.config.Breakers != nil {
+		data, err = c.config.Breakers.Get(c.config.Service, req.Method+" "+req.Route).Execute(call)
+	} else {
+		data, err = call()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data.([]byte), nil
+}
+
+func (c *Client) send(ctx context.Context, req Request, body []byte, baseURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	target := baseURL + req.Path
+	if len(req.Query) > 0 {
+		target += "?" + req.Query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range c.config.Header {
+		for _, value := range values {
+			httpReq.Header.Add(name, value)
+		}
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		requestDuration.WithLabelValues(c.config.Service, req.Route, "error").Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	requestDuration.WithLabelValues(c.config.Service, req.Route, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := ratelimit.RetryAfter(resp.Header)
+		return nil, &RateLimitedError{RetryAfter: retryAfter, Upstream: true}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(data) > maxErrorBody {
+			data = data[:maxErrorBody]
+		}
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(data)}
+	}
+
+	return data, nil
+}
+
+// pickInstance rotates through the configured instances.
+func (c *Client) pickInstance() string {
+	urls := c.config.BaseURLs
+	return urls[int(c.next.Add(1)-1)%len(urls)]
+}
+
+// pickInstancePair returns the next instance and the one after it, for a
+// request and its hedge.
+func (c *Client) pickInstancePair() (string, string) {
+	urls := c.config.BaseURLs
+	next := int(c.next.Add(1) - 1)
+	return urls[next%len(urls)], urls[(next+1)%len(urls)]
+}
+
+// retryable reports whether another attempt could succeed: transport errors,
+// per-attempt timeouts and 502-504 are, rate limits and breaker rejections
+// are not.
+func retryable(err error) bool {
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) || breaker.IsOpenError(err) {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var status *StatusError
+	if errors.As(err, &status) {
+		switch status.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,134 @@
+package httpclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"shared/breaker"
+	"shared/ratelimit"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport answers 200 from every instance except those listed in slow,
+// which wait for the request to be cancelled, and 503 from those in broken.
+type fakeTransport struct {
+	mutex  sync.Mutex
+	hosts  []string
+	slow   map[string]bool
+	broken map[string]bool
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	t.hosts = append(t.hosts, req.URL.Host)
+	t.mutex.Unlock()
+
+	if t.slow[req.URL.Host] {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	status := http.StatusOK
+	if t.broken[req.URL.Host] {
+		status = http.StatusServiceUnavailable
+	}
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: io.NopCloser(strings.NewReader("{}")), Header: http.Header{}}, nil
+}
+
+func (t *fakeTransport) requested() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string(nil), t.hosts...)
+}
+
+// countingLimiter allows everything and counts what it was charged.
+type countingLimiter struct {
+	mutex   sync.Mutex
+	charged int
+}
+
+func (l *countingLimiter) Allow(ctx context.Context, key string) (ratelimit.Result, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.charged++
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func (l *countingLimiter) Peek(ctx context.Context, key string) (ratelimit.Result, error) {
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func TestHedgeGoesToAnotherInstance(t *testing.T) {
+	transport := &fakeTransport{slow: map[string]bool{"a": true}}
+	limiter := &countingLimiter{}
+	breakers := breaker.NewRegistry(breaker.Config{Timeout: time.Minute, ConsecutiveFailures: 0})
+	client := New(Config{
+		Service:    "test",
+		BaseURLs:   []string{"http://a", "http://b"},
+		HedgeDelay: 10 * time.Millisecond,
+		Breakers:   breakers,
+		Limiter:    limiter,
+		Transport:  transport,
+	})
+
+	if err := client.Get(context.Background(), "/", nil, nil); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if hosts := strings.Join(transport.requested(), ","); hosts != "a,b" {
+		t.Errorf("requested %s, want a,b", hosts)
+	}
+	if limiter.charged != 1 {
+		t.Errorf("limiter charged %d times, want 1", limiter.charged)
+	}
+	// The cancelled original must not count as a failure, which would trip a
+	// breaker that opens on the first one.
+	if state := breakers.Get("test", "GET /").State().String(); state != "closed" {
+		t.Errorf("breaker state = %s, want closed", state)
+	}
+}
+
+func TestSingleInstanceIsNotHedged(t *testing.T) {
+	transport := &fakeTransport{slow: map[string]bool{"a": true}}
+	client := New(Config{
+		Service:    "test",
+		BaseURLs:   []string{"http://a"},
+		Timeout:    50 * time.Millisecond,
+		HedgeDelay: time.Millisecond,
+		Transport:  transport,
+	})
+
+	client.Get(context.Background(), "/", nil, nil)
+
+	if hosts := strings.Join(transport.requested(), ","); hosts != "a" {
+		t.Errorf("requested %s, want a", hosts)
+	}
+}
+
+func TestRetriesAreNotChargedAgain(t *testing.T) {
+	transport := &fakeTransport{broken: map[string]bool{"a": true}}
+	limiter := &countingLimiter{}
+	client := New(Config{
+		Service:      "test",
+		BaseURLs:     []string{"http://a"},
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		RetryRatio:   1,
+		Limiter:      limiter,
+		Transport:    transport,
+	})
+
+	if err := client.Get(context.Background(), "/", nil, nil); err == nil {
+		t.Fatal("Get() error = nil, want the 503")
+	}
+
+	if attempts := len(transport.requested()); attempts != 3 {
+		t.Errorf("made %d attempts, want 3", attempts)
+	}
+	if limiter.charged != 1 {
+		t.Errorf("limiter charged %d times, want 1", limiter.charged)
+	}
+}
@@ -0,0 +1,27 @@
+package httpclient
+
+import (
+	"os"
+	"strings"
+)
+
+// Discover returns the instances of service from the environment variable
+// named after it, e.g. PROBLEM_MANAGEMENT_URL for "problem_management". The
+// variable may list several comma-separated base URLs; fallback is used when
+// it is unset.
+func Discover(service string, fallback string) []string {
+	name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(service)) + "_URL"
+
+	var urls []string
+	for _, url := range strings.Split(os.Getenv(name), ",") {
+		if url = strings.TrimRight(strings.TrimSpace(url), "/"); url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	if len(urls) == 0 {
+		return []string{fallback}
+	}
+
+	return urls
+}
@@ -0,0 +1,309 @@
+// Package idempotency makes POST endpoints safe to retry. A client sends an
+// Idempotency-Key header; the first request with a key runs normally and its
+// response is stored in PostgreSQL, and later requests with the same key get
+// that response back instead of repeating the side effects.
+//
+// Each service needs the table:
+//
+//	CREATE TABLE idempotency_keys (
+//	    scope TEXT NOT NULL,
+//	    key TEXT NOT NULL,
+//	    request_hash CHAR(64) NOT NULL,
+//	    claim_token CHAR(32) NOT NULL,
+//	    status_code INT,
+//	    content_type TEXT,
+//	    response_body BYTEA,
+//	    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+//	    heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW(),
+//	    completed_at TIMESTAMP,
+//	    PRIMARY KEY (scope, key)
+//	);
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// ReplayedHeader marks a response that was stored rather than produced.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+	// lockTimeout is how long a key may go without a heartbeat from the
+	// request holding it before another request may take it over. A running
+	// request beats every heartbeatInterval, so only a request whose process
+	// died loses its key.
+	lockTimeout       = time.Minute
+	heartbeatInterval = lockTimeout / 4
+	// DefaultRetention is how long keys are kept when IDEMPOTENCY_RETENTION
+	// is not set.
+	DefaultRetention = 24 * time.Hour
+)
+
+type Store struct {
+	db *pgxpool.Pool
+}
+
+func NewStore(db *pgxpool.Pool) *Store {
+	return &Store{db: db}
+}
+
+// RetentionFromEnv reads IDEMPOTENCY_RETENTION, e.g. "48h".
+func RetentionFromEnv() time.Duration {
+	value := os.Getenv("IDEMPOTENCY_RETENTION")
+	if value == "" {
+		return DefaultRetention
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention <= 0 {
+		log.Printf("Invalid IDEMPOTENCY_RETENTION %q, using %v\n", value, DefaultRetention)
+		return DefaultRetention
+	}
+
+	return retention
+}
+
+// Middleware honours Idempotency-Key on the routes it is attached to. Keys
+// are namespaced by scope, typically the caller's identity, so that two
+// clients cannot collide or read each other's responses. It belongs after
+// authentication, so that rejected requests never claim a key.
+//
+// Reusing a key with a different method, path or body is answered with 409,
+// as is a key whose first request is still running. Server errors are not
+// stored, so the client can retry them with the same key.
+func (s *Store) Middleware(scope func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		keyScope := scope(c)
+		hash := requestHash(c.Request, body)
+
+		token, err := newClaimToken()
+		if err != nil {
+			log.Printf("Failed to generate idempotency claim token: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+
+		claimed, err := s.claim(ctx, keyScope, key, hash, token)
+		if err != nil {
+			log.Printf("Failed to claim idempotency key: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+			c.Abort()
+			return
+		}
+
+		if !claimed {
+			s.replay(c, keyScope, key, hash)
+			c.Abort()
+			return
+		}
+
+		done := make(chan struct{})
+		go s.heartbeat(context.WithoutCancel(ctx), keyScope, key, token, done)
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+		close(done)
+
+		// The request's context may be cancelled by now; the outcome must be
+		// recorded regardless.
+		s.complete(context.WithoutCancel(ctx), keyScope, key, token, recorder)
+	}
+}
+
+// claim inserts the key under token, or takes over one whose request
+// stopped sending heartbeats. Only a request with the same hash may take a
+// key over. It reports false if the key belongs to another request.
+func (s *Store) claim(ctx context.Context, scope string, key string, hash string, token string) (bool, error) {
+	tag, err := s.db.Exec(ctx,
+		`INSERT INTO idempotency_keys (scope, key, request_hash, claim_token) VALUES ($1, $2, $3, $4) ON CONFLICT (scope, key) DO NOTHING`,
+		scope, key, hash, token,
+	)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 1 {
+		return true, nil
+	}
+
+	tag, err = s.db.Exec(ctx,
+		`UPDATE idempotency_keys SET claim_token = $4, created_at = NOW(), heartbeat_at = NOW()
+		WHERE scope = $1 AND key = $2 AND request_hash = $3 AND completed_at IS NULL AND heartbeat_at < NOW() - make_interval(secs => $5)`,
+		scope, key, hash, token, lockTimeout.Seconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// heartbeat keeps the key's claim alive until done is closed.
+func (s *Store) heartbeat(ctx context.Context, scope string, key string, token string, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_, err := s.db.Exec(ctx,
+				`UPDATE idempotency_keys SET heartbeat_at = NOW() WHERE scope = $1 AND key = $2 AND claim_token = $3`,
+				scope, key, token,
+			)
+			if err != nil {
+				log.Printf("Failed to renew idempotency key: %v\n", err)
+			}
+		}
+	}
+}
+
+func (s *Store) replay(c *gin.Context, scope string, key string, hash string) {
+	var storedHash string
+	var statusCode *int
+	var contentType *string
+	var body []byte
+	err := s.db.QueryRow(c.Request.Context(),
+		`SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys WHERE scope = $1 AND key = $2`,
+		scope, key,
+	).Scan(&storedHash, &statusCode, &contentType, &body)
+	if err == pgx.ErrNoRows {
+		// Released by a failed request between our claim and this read.
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is being processed; retry"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check Idempotency-Key"})
+		return
+	}
+
+	if storedHash != hash {
+		c.JSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used for a different request"})
+		return
+	}
+
+	if statusCode == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is being processed; retry"})
+		return
+	}
+
+	c.Header(ReplayedHeader, "true")
+	if contentType != nil {
+		c.Data(*statusCode, *contentType, body)
+	} else {
+		c.Data(*statusCode, "", body)
+	}
+}
+
+// complete stores the response, or releases the key when the outcome may be
+// different on a retry. Either only happens while token still holds the key,
+// so a request that lost it cannot overwrite or release another's claim.
+func (s *Store) complete(ctx context.Context, scope string, key string, token string, recorder *responseRecorder) {
+	status := recorder.Status()
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		if _, err := s.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND claim_token = $3`, scope, key, token); err != nil {
+			log.Printf("Failed to release idempotency key: %v\n", err)
+		}
+		return
+	}
+
+	tag, err := s.db.Exec(ctx,
+		`UPDATE idempotency_keys SET status_code = $4, content_type = $5, response_body = $6, completed_at = NOW()
+		WHERE scope = $1 AND key = $2 AND claim_token = $3`,
+		scope, key, token, status, recorder.Header().Get("Content-Type"), recorder.body.Bytes(),
+	)
+	if err != nil {
+		log.Printf("Failed to store idempotent response: %v\n", err)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		log.Printf("Idempotency key %q was taken over before its response could be stored\n", key)
+	}
+}
+
+// RunRetention deletes keys older than retention every hour.
+func (s *Store) RunRetention(retention time.Duration) {
+	for {
+		tag, err := s.db.Exec(context.Background(),
+			`DELETE FROM idempotency_keys WHERE created_at < NOW() - make_interval(secs => $1)`,
+			retention.Seconds(),
+		)
+		if err != nil {
+			log.Printf("Failed to delete expired idempotency keys: %v\n", err)
+		} else if tag.RowsAffected() > 0 {
+			log.Printf("Deleted %d expired idempotency keys\n", tag.RowsAffected())
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+func newClaimToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response body as it is written.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
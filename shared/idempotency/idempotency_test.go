@@ -0,0 +1,255 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestRequestHash(t *testing.T) {
+	base := requestHash(httptest.NewRequest(http.MethodPost, "/competitions", nil), []byte(`{"name":"a"}`))
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		wantSame bool
+	}{
+		{"same request", http.MethodPost, "/competitions", `{"name":"a"}`, true},
+		{"query string is ignored", http.MethodPost, "/competitions?x=1", `{"name":"a"}`, true},
+		{"other body", http.MethodPost, "/competitions", `{"name":"b"}`, false},
+		{"other path", http.MethodPost, "/competitions/1/invites", `{"name":"a"}`, false},
+		{"other method", http.MethodPut, "/competitions", `{"name":"a"}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := requestHash(httptest.NewRequest(test.method, test.target, nil), []byte(test.body))
+			if len(got) != 64 {
+				t.Errorf("requestHash() = %q, want 64 hex digits", got)
+			}
+			if (got == base) != test.wantSame {
+				t.Errorf("requestHash() same as base = %v, want %v", got == base, test.wantSame)
+			}
+		})
+	}
+}
+
+func TestNewClaimToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := newClaimToken()
+		if err != nil {
+			t.Fatalf("newClaimToken() error = %v", err)
+		}
+		if len(token) != 32 {
+			t.Fatalf("newClaimToken() = %q, want 32 hex digits to fit claim_token", token)
+		}
+		if seen[token] {
+			t.Fatalf("newClaimToken() repeated %q", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestRetentionFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", DefaultRetention},
+		{"48h", 48 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"soon", DefaultRetention},
+		{"-1h", DefaultRetention},
+		{"0s", DefaultRetention},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv("IDEMPOTENCY_RETENTION", test.value)
+			if got := RetentionFromEnv(); got != test.want {
+				t.Errorf("RetentionFromEnv() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestMiddlewareWithoutDatabase covers the requests the middleware answers
+// before it needs the table.
+func TestMiddlewareWithoutDatabase(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		wantStatus  int
+		wantHandled bool
+	}{
+		{"no key", "", http.StatusCreated, true},
+		{"key too long", strings.Repeat("k", maxKeyLength+1), http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handled := false
+			router := newRouter(NewStore(nil), func(c *gin.Context) {
+				handled = true
+				c.JSON(http.StatusCreated, gin.H{"id": 1})
+			})
+
+			recorder := send(router, test.key, `{}`)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if handled != test.wantHandled {
+				t.Errorf("handler ran = %v, want %v", handled, test.wantHandled)
+			}
+		})
+	}
+}
+
+// TestMiddleware runs against the database in TEST_DATABASE_URL, creating
+// idempotency_keys if needed, and is skipped without one.
+func TestMiddleware(t *testing.T) {
+	store := testStore(t)
+
+	calls := 0
+	status := http.StatusCreated
+	router := newRouter(store, func(c *gin.Context) {
+		calls++
+		c.JSON(status, gin.H{"call": calls})
+	})
+
+	key := "key-" + time.Now().Format(time.RFC3339Nano)
+
+	first := send(router, key, `{"name":"a"}`)
+	if first.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("first request: status = %d, calls = %d", first.Code, calls)
+	}
+
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantReplayed bool
+	}{
+		{"retry is replayed", `{"name":"a"}`, http.StatusCreated, true},
+		{"other body is rejected", `{"name":"b"}`, http.StatusConflict, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := send(router, key, test.body)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if replayed := recorder.Header().Get(ReplayedHeader) == "true"; replayed != test.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, test.wantReplayed)
+			}
+			if test.wantReplayed && recorder.Body.String() != first.Body.String() {
+				t.Errorf("body = %s, want %s", recorder.Body, first.Body)
+			}
+		})
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+
+	t.Run("server errors release the key", func(t *testing.T) {
+		failing := key + "-failing"
+		status = http.StatusInternalServerError
+		send(router, failing, `{}`)
+		status = http.StatusCreated
+
+		if recorder := send(router, failing, `{}`); recorder.Code != http.StatusCreated {
+			t.Errorf("retry status = %d, want %d", recorder.Code, http.StatusCreated)
+		}
+	})
+
+	t.Run("a lost claim cannot store its response", func(t *testing.T) {
+		ctx := context.Background()
+		lost := key + "-lost"
+		if claimed, err := store.claim(ctx, "test", lost, "hash", "owner"); err != nil || !claimed {
+			t.Fatalf("claim() = %v, %v", claimed, err)
+		}
+		if claimed, err := store.claim(ctx, "test", lost, "hash", "other"); err != nil || claimed {
+			t.Fatalf("claim() of a live key = %v, %v, want false", claimed, err)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: newTestWriter()}
+		recorder.WriteHeader(http.StatusCreated)
+		store.complete(ctx, "test", lost, "other", recorder)
+
+		var completed bool
+		err := store.db.QueryRow(ctx, `SELECT completed_at IS NOT NULL FROM idempotency_keys WHERE scope = 'test' AND key = $1`, lost).Scan(&completed)
+		if err != nil || completed {
+			t.Errorf("completed = %v, %v; want the key still held by its owner", completed, err)
+		}
+	})
+}
+
+func testStore(t *testing.T) *Store {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := pgxpool.Connect(context.Background(), url)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	_, err = db.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash CHAR(64) NOT NULL,
+		claim_token CHAR(32) NOT NULL,
+		status_code INT,
+		content_type TEXT,
+		response_body BYTEA,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		completed_at TIMESTAMP,
+		PRIMARY KEY (scope, key)
+	)`)
+	if err != nil {
+		t.Fatalf("failed to create idempotency_keys: %v", err)
+	}
+
+	return NewStore(db)
+}
+
+func newRouter(store *Store, handler gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	router.POST("/things", store.Middleware(func(c *gin.Context) string { return "test" }), handler)
+	return router
+}
+
+func send(router *gin.Engine, key string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/things", strings.NewReader(body))
+	if key != "" {
+		request.Header.Set(Header, key)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func newTestWriter() gin.ResponseWriter {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	return c.Writer
+}
@@ -0,0 +1,57 @@
+// Package notify turns PostgreSQL NOTIFY messages into wakeups for the
+// outbox and inbox dispatchers.
+package notify
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const retryDelay = 5 * time.Second
+
+// Listen wakes up a dispatcher whenever PostgreSQL sends a NOTIFY on channel.
+// Dispatchers still poll on a slower interval, so events inserted while the
+// listener is reconnecting are picked up anyway.
+func Listen(ctx context.Context, db *pgxpool.Pool, channel string, wakeup chan<- struct{}) {
+	for {
+		if err := waitForNotifications(ctx, db, channel, wakeup); err != nil {
+			log.Printf("Listener for %s stopped, retrying in %v: %v\n", channel, retryDelay, err)
+		}
+		time.Sleep(retryDelay)
+	}
+}
+
+func waitForNotifications(ctx context.Context, db *pgxpool.Pool, channel string, wakeup chan<- struct{}) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+		return err
+	}
+	defer conn.Exec(ctx, "UNLISTEN "+channel)
+
+	// Catch up on anything inserted before LISTEN took effect.
+	Wake(wakeup)
+
+	for {
+		if _, err := conn.Conn().WaitForNotification(ctx); err != nil {
+			return err
+		}
+		Wake(wakeup)
+	}
+}
+
+// Wake signals wakeup without blocking; a wakeup already pending covers this
+// one.
+func Wake(wakeup chan<- struct{}) {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
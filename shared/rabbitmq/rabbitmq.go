@@ -0,0 +1,327 @@
+// Package rabbitmq keeps a service connected to RabbitMQ and publishes with
+// broker confirmations. The service keeps serving HTTP while the broker is
+// unavailable; publishes fail and are retried by the outbox until the
+// connection comes back.
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Variables so that tests can shorten them.
+var (
+	publishConfirmTimeout = 5 * time.Second
+	// requeueDelay spaces out the redeliveries of a message that could not
+	// be stored.
+	requeueDelay = 1 * time.Second
+)
+
+// ErrInvalidMessage marks a message that can never be stored. Consume drops
+// it instead of requeueing it.
+var ErrInvalidMessage = errors.New("invalid message")
+
+type Config struct {
+	URL string
+	// DeclareTopology declares the exchanges and queues the service uses. It
+	// runs on every connection, before anything is published or consumed.
+	DeclareTopology func(channel *amqp.Channel) error
+	// StartConsumers, if set, attaches the service's consumers to a new
+	// connection. They should stop once the connection closes.
+	StartConsumers func(conn *amqp.Connection)
+	// ConfirmBuffer should be at least the largest batch the service
+	// publishes at once.
+	ConfirmBuffer int
+}
+
+// Broker is the service's connection to RabbitMQ, replaced whenever it drops.
+type Broker struct {
+	config    Config
+	connected atomic.Bool
+
+	// mutex serializes publishes, since confirmations are matched to
+	// messages by their order on the channel.
+	mutex    sync.Mutex
+	conn     *amqp.Connection
+	channel  publisher
+	confirms chan amqp.Confirmation
+	seqNo    uint64
+}
+
+// publisher is the part of *amqp.Channel that PublishBatch uses.
+type publisher interface {
+	Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error
+}
+
+// Message is one message to publish. An empty Exchange means the default
+// exchange, which routes by queue name.
+type Message struct {
+	Exchange   string
+	RoutingKey string
+	Body       []byte
+}
+
+// Connect starts the connection manager in the background and returns right
+// away.
+func Connect(config Config) *Broker {
+	broker := &Broker{config: config}
+	go broker.manageConnection()
+	return broker
+}
+
+// Connected reports whether the broker can currently publish.
+func (b *Broker) Connected() bool {
+	return b.connected.Load()
+}
+
+func (b *Broker) manageConnection() {
+	delay := minReconnectDelay
+
+	for {
+		conn, channel, err := b.connect()
+		if err != nil {
+			log.Printf("Failed to connect to RabbitMQ, retrying in %v: %v\n", delay, err)
+			time.Sleep(delay)
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = minReconnectDelay
+
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+		b.mutex.Lock()
+		b.conn = conn
+		b.channel = channel
+		b.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, b.config.ConfirmBuffer))
+		b.seqNo = 0
+		b.mutex.Unlock()
+
+		b.connected.Store(true)
+		log.Println("Connected to RabbitMQ")
+
+		if b.config.StartConsumers != nil {
+			b.config.StartConsumers(conn)
+		}
+
+		select {
+		case err = <-connClosed:
+			log.Printf("RabbitMQ connection closed: %v\n", err)
+		case err = <-channelClosed:
+			log.Printf("RabbitMQ publish channel closed: %v\n", err)
+		}
+
+		b.connected.Store(false)
+		conn.Close()
+	}
+}
+
+func (b *Broker) connect() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(b.config.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to create channel: %w", err)
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to put channel into confirm mode: %w", err)
+	}
+
+	if b.config.DeclareTopology != nil {
+		if err := b.config.DeclareTopology(channel); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	return conn, channel, nil
+}
+
+// Publish publishes a message and blocks until the broker confirms it, so
+// callers only treat an event as sent once RabbitMQ has taken ownership of it.
+func (b *Broker) Publish(exchange string, routingKey string, body []byte) error {
+	return b.PublishBatch([]Message{{Exchange: exchange, RoutingKey: routingKey, Body: body}})[0]
+}
+
+// PublishBatch publishes every message before waiting for confirmations, so a
+// batch costs one broker round trip instead of one per message. The returned
+// slice holds the outcome for each message in order.
+func (b *Broker) PublishBatch(messages []Message) []error {
+	results := make([]error, len(messages))
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.connected.Load() {
+		for i := range results {
+			results[i] = fmt.Errorf("RabbitMQ is not connected")
+		}
+		return results
+	}
+
+	firstTag := b.seqNo + 1
+	published := 0
+	for i, message := range messages {
+		err := b.channel.Publish(
+			message.Exchange, message.RoutingKey, false, false,
+			amqp.Publishing{ContentType: "application/json", DeliveryMode: amqp.Persistent, Body: message.Body},
+		)
+		if err != nil {
+			for j := i; j < len(messages); j++ {
+				results[j] = err
+			}
+			break
+		}
+		b.seqNo++
+		published++
+	}
+
+	confirmed := make([]bool, published)
+	pending := published
+	timeout := time.After(publishConfirmTimeout)
+	for pending > 0 {
+		select {
+		case confirm, ok := <-b.confirms:
+			if !ok {
+				markUnconfirmed(results, confirmed, fmt.Errorf("confirmation channel closed"))
+				return results
+			}
+			// Confirmations for earlier publishes that timed out may still arrive.
+			if confirm.DeliveryTag < firstTag {
+				continue
+			}
+			i := int(confirm.DeliveryTag - firstTag)
+			if !confirm.Ack {
+				results[i] = fmt.Errorf("broker rejected message with delivery tag %d", confirm.DeliveryTag)
+			}
+			confirmed[i] = true
+			pending--
+		case <-timeout:
+			markUnconfirmed(results, confirmed, fmt.Errorf("timed out waiting for broker confirmation"))
+			return results
+		}
+	}
+
+	return results
+}
+
+func markUnconfirmed(results []error, confirmed []bool, err error) {
+	for i, ok := range confirmed {
+		if !ok {
+			results[i] = err
+		}
+	}
+}
+
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// Consume hands the messages on queueName to store until the channel closes.
+// A message is acknowledged once store has kept it. One that store failed to
+// keep is requeued, and one it reports as ErrInvalidMessage is dropped.
+func Consume(conn *amqp.Connection, queueName string, prefetch int, store func(body []byte) error) error {
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to create consumer channel: %w", err)
+	}
+	defer channel.Close()
+
+	if err := channel.Qos(prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %w", err)
+	}
+
+	deliveries, err := channel.Consume(queueName, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register consumer: %w", err)
+	}
+
+	handleDeliveries(queueName, deliveries, store)
+	return fmt.Errorf("delivery channel closed")
+}
+
+func handleDeliveries(queueName string, deliveries <-chan amqp.Delivery, store func(body []byte) error) {
+	for delivery := range deliveries {
+		err := store(delivery.Body)
+		switch {
+		case errors.Is(err, ErrInvalidMessage):
+			log.Printf("Discarding invalid message from queue %s: %v\n", queueName, err)
+			delivery.Nack(false, false)
+		case err != nil:
+			log.Printf("Failed to store message from queue %s, requeueing: %v\n", queueName, err)
+			time.Sleep(requeueDelay)
+			delivery.Nack(false, true)
+		default:
+			if err := delivery.Ack(false); err != nil {
+				log.Printf("Failed to ack message %d in queue %s: %v\n", delivery.DeliveryTag, queueName, err)
+			}
+		}
+	}
+}
+
+// RunConsumer keeps consume attached to queueName for as long as conn is
+// open. Once the connection drops the manager starts a fresh set of consumers.
+func RunConsumer(conn *amqp.Connection, queueName string, consume func(conn *amqp.Connection, queueName string) error) {
+	for !conn.IsClosed() {
+		if err := consume(conn, queueName); err != nil {
+			log.Printf("Consumer for queue %s stopped: %v\n", queueName, err)
+		}
+		time.Sleep(minReconnectDelay)
+	}
+}
+
+// DeclareQueues declares durable queues.
+func DeclareQueues(channel *amqp.Channel, queueNames ...string) error {
+	for _, queueName := range queueNames {
+		if _, err := channel.QueueDeclare(queueName, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare %s queue: %w", queueName, err)
+		}
+	}
+
+	return nil
+}
+
+// DeclareFanout declares a durable fanout exchange.
+func DeclareFanout(channel *amqp.Channel, exchangeName string) error {
+	if err := channel.ExchangeDeclare(exchangeName, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %w", exchangeName, err)
+	}
+
+	return nil
+}
+
+// DeclareBoundQueue declares a durable queue that receives everything
+// published on a fanout exchange.
+func DeclareBoundQueue(channel *amqp.Channel, queueName string, exchangeName string) error {
+	if err := DeclareQueues(channel, queueName); err != nil {
+		return err
+	}
+
+	if err := channel.QueueBind(queueName, "", exchangeName, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s: %w", queueName, exchangeName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeChannel accepts every publish except those numbered in fail.
+type fakeChannel struct {
+	published int
+	fail      map[int]bool
+}
+
+func (c *fakeChannel) Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
+	c.published++
+	if c.fail[c.published] {
+		return fmt.Errorf("channel closed")
+	}
+
+	return nil
+}
+
+func connectedBroker(channel publisher, confirms chan amqp.Confirmation) *Broker {
+	broker := &Broker{channel: channel, confirms: confirms}
+	broker.connected.Store(true)
+	return broker
+}
+
+func TestPublishBatch(t *testing.T) {
+	publishConfirmTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { publishConfirmTimeout = 5 * time.Second })
+
+	tests := []struct {
+		name     string
+		fail     map[int]bool
+		confirms []amqp.Confirmation
+		close    bool
+		wantErrs []string
+	}{
+		{
+			name:     "all acked",
+			confirms: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}, {DeliveryTag: 3, Ack: true}},
+			wantErrs: []string{"", "", ""},
+		},
+		{
+			name:     "acked out of order",
+			confirms: []amqp.Confirmation{{DeliveryTag: 3, Ack: true}, {DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: true}},
+			wantErrs: []string{"", "", ""},
+		},
+		{
+			name:     "nacked",
+			confirms: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 2, Ack: false}, {DeliveryTag: 3, Ack: true}},
+			wantErrs: []string{"", "rejected", ""},
+		},
+		{
+			name:     "confirmation missing",
+			confirms: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}, {DeliveryTag: 3, Ack: true}},
+			wantErrs: []string{"", "timed out", ""},
+		},
+		{
+			name:     "confirmation channel closed",
+			confirms: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}},
+			close:    true,
+			wantErrs: []string{"", "closed", "closed"},
+		},
+		{
+			name:     "publish fails",
+			fail:     map[int]bool{2: true},
+			confirms: []amqp.Confirmation{{DeliveryTag: 1, Ack: true}},
+			wantErrs: []string{"", "channel closed", "channel closed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			confirms := make(chan amqp.Confirmation, len(test.confirms))
+			for _, confirm := range test.confirms {
+				confirms <- confirm
+			}
+			if test.close {
+				close(confirms)
+			}
+			broker := connectedBroker(&fakeChannel{fail: test.fail}, confirms)
+
+			results := broker.PublishBatch([]Message{{RoutingKey: "a"}, {RoutingKey: "b"}, {RoutingKey: "c"}})
+			for i, err := range results {
+				want := test.wantErrs[i]
+				switch {
+				case want == "" && err != nil:
+					t.Errorf("message %d error = %v, want none", i, err)
+				case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+					t.Errorf("message %d error = %v, want one containing %q", i, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPublishBatchSkipsStaleConfirmations(t *testing.T) {
+	// Message 1 timed out earlier; its late confirmation must not be taken
+	// for message 2.
+	confirms := make(chan amqp.Confirmation, 2)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	broker := connectedBroker(&fakeChannel{}, confirms)
+	broker.seqNo = 1
+
+	if err := broker.Publish("", "a", nil); err == nil {
+		t.Error("Publish() error = nil, want the rejection of delivery tag 2")
+	}
+}
+
+func TestPublishBatchNotConnected(t *testing.T) {
+	broker := &Broker{}
+
+	for i, err := range broker.PublishBatch([]Message{{RoutingKey: "a"}, {RoutingKey: "b"}}) {
+		if err == nil {
+			t.Errorf("message %d error = nil, want one while disconnected", i)
+		}
+	}
+}
+
+// fakeAcknowledger records how each delivery was settled.
+type fakeAcknowledger struct {
+	acked    []uint64
+	requeued []uint64
+	dropped  []uint64
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	} else {
+		a.dropped = append(a.dropped, tag)
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestHandleDeliveries(t *testing.T) {
+	requeueDelay = 0
+	t.Cleanup(func() { requeueDelay = 1 * time.Second })
+
+	acknowledger := &fakeAcknowledger{}
+	deliveries := make(chan amqp.Delivery, 3)
+	for tag, body := range []string{"stored", "insert fails", "invalid"} {
+		deliveries <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: uint64(tag + 1), Body: []byte(body)}
+	}
+	close(deliveries)
+
+	handleDeliveries("q", deliveries, func(body []byte) error {
+		switch string(body) {
+		case "insert fails":
+			return errors.New("connection refused")
+		case "invalid":
+			return fmt.Errorf("%w: unexpected EOF", ErrInvalidMessage)
+		}
+		return nil
+	})
+
+	if fmt.Sprint(acknowledger.acked) != "[1]" {
+		t.Errorf("acked = %v, want [1]", acknowledger.acked)
+	}
+	if fmt.Sprint(acknowledger.requeued) != "[2]" {
+		t.Errorf("requeued = %v, want [2]", acknowledger.requeued)
+	}
+	if fmt.Sprint(acknowledger.dropped) != "[3]" {
+		t.Errorf("dropped = %v, want [3]", acknowledger.dropped)
+	}
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
+
+const nowMillis = `
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// slidingLogScript keeps one sorted-set member per accepted request, scored by
+// its timestamp, and allows a request while fewer than limit members are
+// younger than the window.
+var slidingLogScript = redis.NewScript(nowMillis + `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local member = ARGV[4]
+local consume = tonumber(ARGV[5])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+
+local allowed = 0
+if count < limit then
+	allowed = 1
+	if consume == 1 then
+		redis.call('ZADD', key, now, member)
+		redis.call('PEXPIRE', key, window)
+		count = count + 1
+	end
+end
+
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+
+local retry = 0
+if allowed == 0 then
+	retry = reset
+end
+
+return {allowed, math.max(limit - count, 0), reset, retry}
+`)
+
+// fixedWindowScript counts requests per aligned window.
+var fixedWindowScript = redis.NewScript(nowMillis + `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local consume = tonumber(ARGV[5])
+
+local index = math.floor(now / window)
+local reset = (index + 1) * window - now
+
+local state = redis.call('HMGET', key, 'window', 'count')
+local count = 0
+if tonumber(state[1]) == index then
+	count = tonumber(state[2])
+end
+
+local allowed = 0
+local retry = reset
+if count < limit then
+	allowed = 1
+	retry = 0
+	if consume == 1 then
+		count = count + 1
+		redis.call('HSET', key, 'window', index, 'count', count)
+		redis.call('PEXPIRE', key, reset)
+	end
+end
+
+return {allowed, math.max(limit - count, 0), reset, retry}
+`)
+
+// tokenBucketScript refills burst tokens at limit per window and spends one
+// token per request, so clients can burst after a quiet period.
+var tokenBucketScript = redis.NewScript(nowMillis + `
+local key = KEYS[1]
+local rate = tonumber(ARGV[1]) / tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local consume = tonumber(ARGV[5])
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(now - ts, 0) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	allowed = 1
+	if consume == 1 then
+		tokens = tokens - 1
+	end
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+
+if consume == 1 then
+	redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(capacity / rate))
+end
+
+return {allowed, math.floor(tokens), math.ceil((capacity - tokens) / rate), retry}
+`)
+
+// leakyBucketScript treats each request as a unit of water poured into a
+// bucket of size burst that drains at limit per window. A request that would
+// overflow the bucket is rejected, which smooths traffic to the drain rate.
+var leakyBucketScript = redis.NewScript(nowMillis + `
+local key = KEYS[1]
+local rate = tonumber(ARGV[1]) / tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local consume = tonumber(ARGV[5])
+
+local state = redis.call('HMGET', key, 'level', 'ts')
+local level = tonumber(state[1]) or 0
+local ts = tonumber(state[2]) or now
+level = math.max(0, level - math.max(now - ts, 0) * rate)
+
+local allowed = 0
+local retry = 0
+if level + 1 <= capacity then
+	allowed = 1
+	if consume == 1 then
+		level = level + 1
+	end
+else
+	retry = math.ceil((level + 1 - capacity) / rate)
+end
+
+if consume == 1 then
+	redis.call('HSET', key, 'level', tostring(level), 'ts', now)
+	redis.call('PEXPIRE', key, math.ceil(capacity / rate))
+end
+
+return {allowed, math.floor(capacity - level), math.ceil(level / rate), retry}
+`)
+
+// NewSlidingWindow allows limit requests in any window-long interval for each
+// key, storing state under "<prefix>:<key>".
+func NewSlidingWindow(client redis.Cmdable, prefix string, limit int, window time.Duration) Limiter {
+	return &scriptLimiter{client: client, script: slidingLogScript, prefix: prefix, limit: limit, window: window}
+}
+
+// NewFixedWindow allows limit requests per aligned window. It is the cheapest
+// algorithm but lets a client send up to twice the limit across a boundary.
+func NewFixedWindow(client redis.Cmdable, prefix string, limit int, window time.Duration) Limiter {
+	return &scriptLimiter{client: client, script: fixedWindowScript, prefix: prefix, limit: limit, window: window}
+}
+
+// NewTokenBucket refills limit tokens per window up to burst.
+func NewTokenBucket(client redis.Cmdable, prefix string, limit int, window time.Duration, burst int) Limiter {
+	return &scriptLimiter{client: client, script: tokenBucketScript, prefix: prefix, limit: limit, window: window, burst: orLimit(burst, limit)}
+}
+
+// NewLeakyBucket drains limit requests per window from a bucket of size burst.
+func NewLeakyBucket(client redis.Cmdable, prefix string, limit int, window time.Duration, burst int) Limiter {
+	return &scriptLimiter{client: client, script: leakyBucketScript, prefix: prefix, limit: limit, window: window, burst: orLimit(burst, limit)}
+}
+
+func orLimit(burst int, limit int) int {
+	if burst > 0 {
+		return burst
+	}
+
+	return limit
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteHeaders sets the IETF draft RateLimit-* fields for result, plus
+// Retry-After when the request was rejected. Durations are rounded up to
+// whole seconds so clients never retry early.
+func WriteHeaders(header http.Header, result Result, window time.Duration) {
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Limit, ceilSeconds(window)))
+
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+// RetryAfter reads how long a server asked the client to wait, from
+// Retry-After (seconds or HTTP date) or, failing that, RateLimit-Reset.
+func RetryAfter(header http.Header) (time.Duration, bool) {
+	if value := strings.TrimSpace(header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		if date, err := http.ParseTime(value); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+
+	if value := strings.TrimSpace(header.Get("RateLimit-Reset")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	TierAnonymous = "anonymous"
+	TierFree      = "free"
+	TierPremium   = "premium"
+	TierInternal  = "internal"
+)
+
+// Any matches every route, method or tier in a policy rule.
+const Any = "*"
+
+// Policy is one rate-limit rule. Route is a Gin route pattern such as
+// "/problems/:id"; empty Route, Method and Tier fields match anything.
+type Policy struct {
+	Name      string `json:"name"`
+	Route     string `json:"route"`
+	Method    string `json:"method"`
+	Tier      string `json:"tier"`
+	Algorithm string `json:"algorithm"`
+	Limit     int    `json:"limit"`
+	Window    string `json:"window"`
+	Burst     int    `json:"burst"`
+
+	window  time.Duration
+	limiter Limiter
+}
+
+func (p *Policy) Allow(ctx context.Context, key string) (Result, error) {
+	return p.limiter.Allow(ctx, key)
+}
+
+func (p *Policy) Peek(ctx context.Context, key string) (Result, error) {
+	return p.limiter.Peek(ctx, key)
+}
+
+func (p *Policy) WindowDuration() time.Duration {
+	return p.window
+}
+
+func (p *Policy) matches(route string, method string, tier string) bool {
+	return matchesField(p.Route, route) && matchesField(p.Method, method) && matchesField(p.Tier, tier)
+}
+
+func matchesField(pattern string, value string) bool {
+	return pattern == "" || pattern == Any || pattern == value
+}
+
+func (p *Policy) init(client redis.Cmdable, prefix string) error {
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("%s|%s|%s", orAny(p.Route), orAny(p.Method), orAny(p.Tier))
+	}
+
+	if p.Limit <= 0 {
+		return fmt.Errorf("policy %s: limit must be positive", p.Name)
+	}
+
+	window, err := time.ParseDuration(p.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("policy %s: invalid window %q", p.Name, p.Window)
+	}
+	p.window = window
+
+	switch p.Tier {
+	case "", Any, TierAnonymous, TierFree, TierPremium, TierInternal:
+	default:
+		return fmt.Errorf("policy %s: unknown tier %q", p.Name, p.Tier)
+	}
+
+	keyPrefix := prefix + ":" + p.Name
+	switch p.Algorithm {
+	case "", AlgorithmSlidingWindow:
+		p.limiter = NewSlidingWindow(client, keyPrefix, p.Limit, window)
+	case AlgorithmFixedWindow:
+		p.limiter = NewFixedWindow(client, keyPrefix, p.Limit, window)
+	case AlgorithmTokenBucket:
+		p.limiter = NewTokenBucket(client, keyPrefix, p.Limit, window, p.Burst)
+	case AlgorithmLeakyBucket:
+		p.limiter = NewLeakyBucket(client, keyPrefix, p.Limit, window, p.Burst)
+	default:
+		return fmt.Errorf("policy %s: unknown algorithm %q", p.Name, p.Algorithm)
+	}
+
+	return nil
+}
+
+func orAny(value string) string {
+	if value == "" {
+		return Any
+	}
+
+	return value
+}
+
+// PolicyConfig is the format of the policy file.
+type PolicyConfig struct {
+	// Default applies when no rule matches.
+	Default Policy `json:"default"`
+	// Rules are checked in order; the first match wins.
+	Rules []Policy `json:"rules"`
+}
+
+// Engine resolves the policy for a request. It can reload its file at runtime
+// without dropping requests; a file that fails to parse leaves the previous
+// policies in place.
+type Engine struct {
+	client   redis.Cmdable
+	prefix   string
+	path     string
+	fallback Policy
+	current  atomic.Pointer[PolicyConfig]
+
+	mutex   sync.Mutex
+	modTime time.Time
+}
+
+// NewEngine loads policies from path. If the file does not exist, fallback is
+// used for every request until the file appears.
+func NewEngine(client redis.Cmdable, prefix string, path string, fallback Policy) (*Engine, error) {
+	engine := &Engine{
+		client:   client,
+		prefix:   prefix,
+		path:     path,
+		fallback: fallback,
+	}
+
+	if err := engine.Reload(); err != nil {
+		return nil, err
+	}
+
+	return engine, nil
+}
+
+// Reload re-reads the policy file.
+func (e *Engine) Reload() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.reload()
+}
+
+func (e *Engine) reload() error {
+	config := PolicyConfig{Default: e.fallback}
+
+	info, err := os.Stat(e.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Printf("Rate limit policy file %s not found, using default policy\n", e.path)
+	case err != nil:
+		return err
+	default:
+		data, err := os.ReadFile(e.path)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", e.path, err)
+		}
+		e.modTime = info.ModTime()
+	}
+
+	if config.Default.Name == "" {
+		config.Default.Name = "default"
+	}
+	if err := config.Default.init(e.client, e.prefix); err != nil {
+		return err
+	}
+
+	for i := range config.Rules {
+		if err := config.Rules[i].init(e.client, e.prefix); err != nil {
+			return err
+		}
+	}
+
+	e.current.Store(&config)
+	log.Printf("Loaded %d rate limit rules from %s\n", len(config.Rules), e.path)
+
+	return nil
+}
+
+// Watch reloads the policy file whenever its modification time changes.
+func (e *Engine) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		e.mutex.Lock()
+		info, err := os.Stat(e.path)
+		if err == nil && info.ModTime().After(e.modTime) {
+			if err := e.reload(); err != nil {
+				log.Printf("Failed to reload rate limit policies, keeping previous ones: %v\n", err)
+				e.modTime = info.ModTime()
+			}
+		}
+		e.mutex.Unlock()
+	}
+}
+
+// Match returns the first rule matching the request, or the default policy.
+func (e *Engine) Match(route string, method string, tier string) *Policy {
+	config := e.current.Load()
+	for i := range config.Rules {
+		if config.Rules[i].matches(route, method, tier) {
+			return &config.Rules[i]
+		}
+	}
+
+	return &config.Default
+}
@@ -0,0 +1,95 @@
+// Package ratelimit implements Redis-backed rate limiters. Every algorithm
+// runs its check and update in a single Lua script, so concurrent requests
+// from any number of service instances cannot exceed the limit, and every
+// script uses the Redis clock so that instances agree on the window.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Result describes the state of a client's allowance after a check.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is how long until the allowance is fully restored.
+	ResetAfter time.Duration
+	// RetryAfter is how long a rejected client should wait; zero if allowed.
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	// Allow consumes one unit of key's allowance if it is available.
+	Allow(ctx context.Context, key string) (Result, error)
+	// Peek reports whether key could be allowed without consuming anything.
+	Peek(ctx context.Context, key string) (Result, error)
+}
+
+// scriptLimiter runs one of the algorithm scripts. Every script takes the
+// same arguments and returns {allowed, remaining, reset_ms, retry_ms}.
+//
+// KEYS[1] - state key for the client
+// ARGV[1] - limit per window
+// ARGV[2] - window in milliseconds
+// ARGV[3] - burst capacity
+// ARGV[4] - unique member for this request
+// ARGV[5] - 1 to consume, 0 to only check
+type scriptLimiter struct {
+	client redis.Cmdable
+	script *redis.Script
+	prefix string
+	limit  int
+	window time.Duration
+	burst  int
+}
+
+func (l *scriptLimiter) Allow(ctx context.Context, key string) (Result, error) {
+	return l.run(ctx, key, true)
+}
+
+func (l *scriptLimiter) Peek(ctx context.Context, key string) (Result, error) {
+	return l.run(ctx, key, false)
+}
+
+func (l *scriptLimiter) run(ctx context.Context, key string, consume bool) (Result, error) {
+	member, err := randomMember()
+	if err != nil {
+		return Result{}, err
+	}
+
+	consumeArg := 0
+	if consume {
+		consumeArg = 1
+	}
+
+	values, err := l.script.Run(ctx, l.client,
+		[]string{l.prefix + ":" + key},
+		l.limit, l.window.Milliseconds(), l.burst, member, consumeArg,
+	).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      l.limit,
+		Remaining:  int(values[1]),
+		ResetAfter: time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+func randomMember() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
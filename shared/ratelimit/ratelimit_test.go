@@ -0,0 +1,237 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestLimiters runs the Lua scripts against the Redis in REDIS_URL and is
+// skipped without one.
+func TestLimiters(t *testing.T) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatalf("ParseURL() error = %v", err)
+	}
+	client := redis.NewClient(options)
+	t.Cleanup(func() { client.Close() })
+
+	ctx := context.Background()
+	prefix := "ratelimit-test:" + time.Now().Format(time.RFC3339Nano)
+	t.Cleanup(func() {
+		keys, _ := client.Keys(ctx, prefix+"*").Result()
+		if len(keys) > 0 {
+			client.Del(ctx, keys...)
+		}
+	})
+
+	const limit = 3
+	tests := []struct {
+		name    string
+		limiter Limiter
+	}{
+		{AlgorithmSlidingWindow, NewSlidingWindow(client, prefix+":sliding", limit, time.Minute)},
+		{AlgorithmFixedWindow, NewFixedWindow(client, prefix+":fixed", limit, time.Minute)},
+		{AlgorithmTokenBucket, NewTokenBucket(client, prefix+":token", limit, time.Minute, 0)},
+		{AlgorithmLeakyBucket, NewLeakyBucket(client, prefix+":leaky", limit, time.Minute, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peeked, err := test.limiter.Peek(ctx, "client")
+			if err != nil {
+				t.Fatalf("Peek() error = %v", err)
+			}
+			if !peeked.Allowed || peeked.Remaining != limit {
+				t.Errorf("Peek() = %+v, want allowed with %d remaining", peeked, limit)
+			}
+
+			for i := 1; i <= limit; i++ {
+				result, err := test.limiter.Allow(ctx, "client")
+				if err != nil {
+					t.Fatalf("Allow() error = %v", err)
+				}
+				if !result.Allowed || result.Remaining != limit-i || result.RetryAfter != 0 {
+					t.Errorf("Allow() #%d = %+v, want allowed with %d remaining", i, result, limit-i)
+				}
+			}
+
+			result, err := test.limiter.Allow(ctx, "client")
+			if err != nil {
+				t.Fatalf("Allow() error = %v", err)
+			}
+			if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+				t.Errorf("Allow() over the limit = %+v, want rejected with a retry within the window", result)
+			}
+
+			other, err := test.limiter.Allow(ctx, "other-client")
+			if err != nil {
+				t.Fatalf("Allow() error = %v", err)
+			}
+			if !other.Allowed {
+				t.Errorf("Allow() for another key = %+v, want allowed", other)
+			}
+		})
+	}
+}
+
+func TestWriteHeaders(t *testing.T) {
+	tests := []struct {
+		name           string
+		result         Result
+		wantRemaining  string
+		wantReset      string
+		wantRetryAfter string
+	}{
+		{"allowed", Result{Allowed: true, Limit: 10, Remaining: 4, ResetAfter: 1500 * time.Millisecond}, "4", "2", ""},
+		{"rejected", Result{Limit: 10, ResetAfter: 30 * time.Second, RetryAfter: 100 * time.Millisecond}, "0", "30", "1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			WriteHeaders(header, test.result, time.Minute)
+
+			want := map[string]string{
+				"RateLimit-Limit":     "10",
+				"RateLimit-Remaining": test.wantRemaining,
+				"RateLimit-Reset":     test.wantReset,
+				"RateLimit-Policy":    "10;w=60",
+				"Retry-After":         test.wantRetryAfter,
+			}
+			for name, value := range want {
+				if got := header.Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		wantOK bool
+	}{
+		{"seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second, true},
+		{"date in the past", http.Header{"Retry-After": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, 0, true},
+		{"RateLimit-Reset", http.Header{"Ratelimit-Reset": {"3"}}, 3 * time.Second, true},
+		{"Retry-After wins", http.Header{"Retry-After": {"7"}, "Ratelimit-Reset": {"3"}}, 7 * time.Second, true},
+		{"invalid Retry-After falls back", http.Header{"Retry-After": {"soon"}, "Ratelimit-Reset": {"3"}}, 3 * time.Second, true},
+		{"negative", http.Header{"Retry-After": {"-1"}}, 0, false},
+		{"nothing", http.Header{}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := RetryAfter(test.header)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("RetryAfter() = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestEngineMatch(t *testing.T) {
+	path := writePolicies(t, `{
+		"default": {"limit": 100, "window": "1m"},
+		"rules": [
+			{"name": "anonymous-writes", "route": "/problems", "method": "POST", "tier": "anonymous", "limit": 1, "window": "1m"},
+			{"name": "problem-reads", "route": "/problems/:id", "method": "GET", "algorithm": "token_bucket", "limit": 10, "window": "1s", "burst": 20},
+			{"name": "premium", "tier": "premium", "algorithm": "fixed_window", "limit": 1000, "window": "1h"},
+			{"name": "internal", "route": "*", "method": "*", "tier": "internal", "algorithm": "leaky_bucket", "limit": 50, "window": "1s"}
+		]
+	}`)
+
+	engine, err := NewEngine(nil, "test", path, Policy{Limit: 1, Window: "1s"})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	tests := []struct {
+		route  string
+		method string
+		tier   string
+		want   string
+	}{
+		{"/problems", "POST", TierAnonymous, "anonymous-writes"},
+		{"/problems", "POST", TierFree, "default"},
+		{"/problems/:id", "GET", TierPremium, "problem-reads"},
+		{"/problems/:id", "PUT", TierPremium, "premium"},
+		{"/competitions", "GET", TierInternal, "internal"},
+		{"/competitions", "GET", TierFree, "default"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.route+" "+test.tier, func(t *testing.T) {
+			if got := engine.Match(test.route, test.method, test.tier); got.Name != test.want {
+				t.Errorf("Match() = %s, want %s", got.Name, test.want)
+			}
+		})
+	}
+
+	if window := engine.Match("/problems/:id", "GET", TierFree).WindowDuration(); window != time.Second {
+		t.Errorf("WindowDuration() = %v, want 1s", window)
+	}
+}
+
+func TestEngineRejectsInvalidPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{"zero limit", `{"name": "r", "limit": 0, "window": "1m"}`, "limit must be positive"},
+		{"bad window", `{"name": "r", "limit": 1, "window": "soon"}`, "invalid window"},
+		{"negative window", `{"name": "r", "limit": 1, "window": "-1m"}`, "invalid window"},
+		{"unknown tier", `{"name": "r", "tier": "gold", "limit": 1, "window": "1m"}`, "unknown tier"},
+		{"unknown algorithm", `{"name": "r", "algorithm": "magic", "limit": 1, "window": "1m"}`, "unknown algorithm"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writePolicies(t, `{"default": {"limit": 100, "window": "1m"}, "rules": [`+test.rule+`]}`)
+
+			_, err := NewEngine(nil, "test", path, Policy{Limit: 1, Window: "1s"})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("NewEngine() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEngineWithoutPolicyFile(t *testing.T) {
+	engine, err := NewEngine(nil, "test", filepath.Join(t.TempDir(), "missing.json"), Policy{Limit: 5, Window: "1s"})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+
+	policy := engine.Match("/problems", "GET", TierFree)
+	if policy.Name != "default" || policy.Limit != 5 {
+		t.Errorf("Match() = %+v, want the fallback policy", policy)
+	}
+}
+
+func writePolicies(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	return path
+}
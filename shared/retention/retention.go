@@ -0,0 +1,257 @@
+// Package retention keeps the outbox and inbox tables small. Processed rows
+// are moved into the monthly partitions of <table>_archive, and archive
+// partitions are dropped once they are older than the archive retention.
+//
+// Each service needs, for the outbox and, if it consumes events, the inbox:
+//
+//	CREATE TABLE outbox_archive (
+//	    id INT NOT NULL,
+//	    event_id UUID NOT NULL,
+//	    event_type TEXT NOT NULL,
+//	    version INT NOT NULL,
+//	    payload JSONB NOT NULL,
+//	    retries INT,
+//	    created_at TIMESTAMP NOT NULL,
+//	    archived_at TIMESTAMP DEFAULT NOW()
+//	) PARTITION BY RANGE (created_at);
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	interval  = time.Hour
+	batchSize = 1000
+)
+
+type Config struct {
+	OutboxAge time.Duration
+	// InboxAge is zero for services that only publish events and so have no
+	// inbox to retain.
+	InboxAge         time.Duration
+	ArchiveRetention time.Duration
+}
+
+// ConfigFromEnv reads OUTBOX_RETENTION, ARCHIVE_RETENTION and, when the
+// service has an inbox, INBOX_RETENTION and INBOX_IDEMPOTENCY_WINDOW.
+func ConfigFromEnv(inbox bool) Config {
+	config := Config{
+		OutboxAge:        durationFromEnv("OUTBOX_RETENTION", 24*time.Hour),
+		ArchiveRetention: durationFromEnv("ARCHIVE_RETENTION", 0),
+	}
+	if !inbox {
+		return config
+	}
+
+	// Inbox rows are what deduplicates redelivered events, so they must outlive
+	// the idempotency window no matter how short the retention is configured.
+	config.InboxAge = durationFromEnv("INBOX_RETENTION", 24*time.Hour)
+	idempotencyWindow := durationFromEnv("INBOX_IDEMPOTENCY_WINDOW", 7*24*time.Hour)
+	if config.InboxAge < idempotencyWindow {
+		config.InboxAge = idempotencyWindow
+	}
+
+	return config
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v: %v\n", name, value, fallback, err)
+		return fallback
+	}
+
+	return duration
+}
+
+// Run archives processed rows every hour, and drops archive partitions older
+// than config.ArchiveRetention when it is set.
+func Run(ctx context.Context, db *pgxpool.Pool, config Config) {
+	tables := []string{"outbox"}
+	if config.InboxAge > 0 {
+		tables = append(tables, "inbox")
+		log.Printf("Retention: outbox %v, inbox %v, archive %v\n", config.OutboxAge, config.InboxAge, config.ArchiveRetention)
+	} else {
+		log.Printf("Retention: outbox %v, archive %v\n", config.OutboxAge, config.ArchiveRetention)
+	}
+
+	for {
+		if moved, err := archiveProcessedRows(ctx, db, "outbox", "created_at", config.OutboxAge); err != nil {
+			log.Printf("Failed to archive outbox: %v\n", err)
+		} else if moved > 0 {
+			log.Printf("Archived %d outbox rows\n", moved)
+		}
+
+		if config.InboxAge > 0 {
+			if moved, err := archiveProcessedRows(ctx, db, "inbox", "processed_at", config.InboxAge); err != nil {
+				log.Printf("Failed to archive inbox: %v\n", err)
+			} else if moved > 0 {
+				log.Printf("Archived %d inbox rows\n", moved)
+			}
+		}
+
+		if config.ArchiveRetention > 0 {
+			for _, table := range tables {
+				if err := dropExpiredPartitions(ctx, db, table+"_archive", config.ArchiveRetention); err != nil {
+					log.Printf("Failed to drop expired %s_archive partitions: %v\n", table, err)
+				}
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// archiveProcessedRows moves processed rows whose ageColumn is older than age
+// into <table>_archive in batches. Each batch is a single statement, so a row
+// is never both deleted and missing from the archive.
+func archiveProcessedRows(ctx context.Context, db *pgxpool.Pool, table string, ageColumn string, age time.Duration) (int64, error) {
+	condition := fmt.Sprintf("processed = TRUE AND %s < NOW() - make_interval(secs => $1)", ageColumn)
+
+	if err := ensureArchivePartitions(ctx, db, table, condition, age); err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(`
+		WITH moved AS (
+			DELETE FROM %[1]s WHERE id IN (
+				SELECT id FROM %[1]s WHERE %[2]s ORDER BY id LIMIT $2
+			)
+			RETURNING id, event_id, event_type, version, payload, retries, created_at
+		)
+		INSERT INTO %[1]s_archive (id, event_id, event_type, version, payload, retries, created_at)
+		SELECT id, event_id, event_type, version, payload, retries, created_at FROM moved`,
+		table, condition,
+	)
+
+	var total int64
+	for {
+		tag, err := db.Exec(ctx, query, age.Seconds(), batchSize)
+		if err != nil {
+			return total, err
+		}
+
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// ensureArchivePartitions creates a monthly partition of <table>_archive for
+// every month between the oldest row about to be archived and now. The months
+// come from the database, whose NOW() filled created_at, so that they match
+// the rows whatever its time zone.
+func ensureArchivePartitions(ctx context.Context, db *pgxpool.Pool, table string, condition string, age time.Duration) error {
+	query := fmt.Sprintf(`
+		SELECT month FROM generate_series(
+			date_trunc('month', (SELECT MIN(created_at) FROM %s WHERE %s)),
+			date_trunc('month', LOCALTIMESTAMP),
+			INTERVAL '1 month'
+		) AS month`,
+		table, condition,
+	)
+	rows, err := db.Query(ctx, query, age.Seconds())
+	if err != nil {
+		return err
+	}
+
+	var months []time.Time
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, month)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, month := range months {
+		next := month.AddDate(0, 1, 0)
+		_, err := db.Exec(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF %s_archive FOR VALUES FROM ('%s') TO ('%s')",
+			partitionName(table+"_archive", month), table, month.Format("2006-01-02"), next.Format("2006-01-02"),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to create archive partition for %s: %w", month.Format("2006-01"), err)
+		}
+	}
+
+	return nil
+}
+
+// dropExpiredPartitions takes the cutoff from the database clock too, as the
+// partitions hold its local months.
+func dropExpiredPartitions(ctx context.Context, db *pgxpool.Pool, archiveTable string, retention time.Duration) error {
+	var cutoff time.Time
+	if err := db.QueryRow(ctx, "SELECT LOCALTIMESTAMP - make_interval(secs => $1)", retention.Seconds()).Scan(&cutoff); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT child.relname FROM pg_inherits
+		JOIN pg_class child ON child.oid = pg_inherits.inhrelid
+		JOIN pg_class parent ON parent.oid = pg_inherits.inhparent
+		WHERE parent.relname = $1`, archiveTable)
+	if err != nil {
+		return err
+	}
+
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		month, err := partitionMonth(archiveTable, name)
+		if err != nil {
+			continue
+		}
+
+		// Only drop a partition once its entire month is past the cutoff.
+		if month.AddDate(0, 1, 0).Before(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+
+	for _, name := range expired {
+		if _, err := db.Exec(ctx, "DROP TABLE "+name); err != nil {
+			return err
+		}
+		log.Printf("Dropped expired archive partition %s\n", name)
+	}
+
+	return nil
+}
+
+func partitionName(archiveTable string, month time.Time) string {
+	return fmt.Sprintf("%s_%s", archiveTable, month.Format("y2006m01"))
+}
+
+// partitionMonth is the inverse of partitionName.
+func partitionMonth(archiveTable string, name string) (time.Time, error) {
+	if len(name) <= len(archiveTable)+1 {
+		return time.Time{}, fmt.Errorf("%s is not a partition of %s", name, archiveTable)
+	}
+
+	return time.Parse("y2006m01", name[len(archiveTable)+1:])
+}
@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionName(t *testing.T) {
+	tests := []struct {
+		month time.Time
+		want  string
+	}{
+		{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), "inbox_archive_y2026m01"},
+		{time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), "inbox_archive_y2026m12"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			name := partitionName("inbox_archive", test.month)
+			if name != test.want {
+				t.Errorf("partitionName() = %s, want %s", name, test.want)
+			}
+
+			month, err := partitionMonth("inbox_archive", name)
+			if err != nil || !month.Equal(test.month) {
+				t.Errorf("partitionMonth(%s) = %v, %v, want %v", name, month, err, test.month)
+			}
+		})
+	}
+}
+
+func TestPartitionMonthRejects(t *testing.T) {
+	for _, name := range []string{"inbox_archive", "inbox_archive_", "inbox_archive_default", "inbox_archive_y2026m13"} {
+		t.Run(name, func(t *testing.T) {
+			if month, err := partitionMonth("inbox_archive", name); err == nil {
+				t.Errorf("partitionMonth(%s) = %v, want an error", name, month)
+			}
+		})
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		inbox bool
+		want  Config
+	}{
+		{
+			name: "defaults without an inbox",
+			want: Config{OutboxAge: 24 * time.Hour},
+		},
+		{
+			name:  "defaults with an inbox",
+			inbox: true,
+			want:  Config{OutboxAge: 24 * time.Hour, InboxAge: 7 * 24 * time.Hour},
+		},
+		{
+			name:  "inbox retention below the idempotency window",
+			env:   map[string]string{"INBOX_RETENTION": "1h", "INBOX_IDEMPOTENCY_WINDOW": "48h"},
+			inbox: true,
+			want:  Config{OutboxAge: 24 * time.Hour, InboxAge: 48 * time.Hour},
+		},
+		{
+			name:  "inbox retention above the idempotency window",
+			env:   map[string]string{"INBOX_RETENTION": "720h", "ARCHIVE_RETENTION": "2160h"},
+			inbox: true,
+			want:  Config{OutboxAge: 24 * time.Hour, InboxAge: 720 * time.Hour, ArchiveRetention: 2160 * time.Hour},
+		},
+		{
+			name: "invalid values fall back",
+			env:  map[string]string{"OUTBOX_RETENTION": "soon", "INBOX_RETENTION": "1h"},
+			want: Config{OutboxAge: 24 * time.Hour},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"OUTBOX_RETENTION", "INBOX_RETENTION", "INBOX_IDEMPOTENCY_WINDOW", "ARCHIVE_RETENTION"} {
+				t.Setenv(name, test.env[name])
+			}
+
+			if got := ConfigFromEnv(test.inbox); got != test.want {
+				t.Errorf("ConfigFromEnv(%v) = %+v, want %+v", test.inbox, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/mail"
+	"shared/auth"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+	maxUsernameLength = 50
+)
+
+func register(c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.Username = strings.TrimSpace(request.Username)
+	if request.Username == "" || utf8.RuneCountInString(request.Username) > maxUsernameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username must be between 1 and 50 characters"})
+		return
+	}
+
+	if _, err := mail.ParseAddress(request.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email is invalid"})
+		return
+	}
+
+	if len(request.Password) < minPasswordLength || len(request.Password) > maxPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password must be between 8 and 128 characters"})
+		return
+	}
+
+	passwordHash, err := hashPassword(request.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	user := User{Username: request.Username, Email: request.Email, Roles: []string{auth.RoleParticipant}}
+	query := `INSERT INTO users (username, email, password_hash, created_at, updated_at) VALUES ($1, $2, $3, NOW(), NOW()) RETURNING id, created_at, updated_at`
+	err = tx.QueryRow(ctx, query, user.Username, user.Email, passwordHash).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+
+	// Every account can take part in competitions; other roles are granted.
+	_, err = tx.Exec(ctx, `INSERT INTO user_roles (user_id, role) VALUES ($1, $2)`, user.ID, auth.RoleParticipant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign default role"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, user)
+}
+
+func login(c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	var passwordHash string
+	query := `SELECT id, username, email, COALESCE(organization, ''), password_hash FROM users WHERE username = $1`
+	err := dbPool.QueryRow(ctx, query, request.Username).Scan(&user.ID, &user.Username, &user.Email, &user.Organization, &passwordHash)
+	if err != nil && err != pgx.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+
+	if err == pgx.ErrNoRows {
+		// Hash anyway so that response times do not reveal which usernames exist.
+		hashPassword(request.Password)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	ok, err := verifyPassword(request.Password, passwordHash)
+	if err != nil || !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	issueTokens(c, user)
+}
+
+// refresh exchanges a refresh token for a new token pair. Refresh tokens are
+// single use: the presented token is revoked in the same statement that
+// validates it, so a replayed token fails.
+func refresh(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	query := `UPDATE refresh_tokens SET revoked_at = NOW()
+		FROM users
+		WHERE refresh_tokens.user_id = users.id AND token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING users.id, users.username, users.email, COALESCE(users.organization, '')`
+	err := dbPool.QueryRow(ctx, query, hashToken(request.RefreshToken)).Scan(&user.ID, &user.Username, &user.Email, &user.Organization)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	issueTokens(c, user)
+}
+
+func logout(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := dbPool.Exec(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL`, hashToken(request.RefreshToken))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func getCurrentUser(c *gin.Context) {
+	claims, _ := auth.User(c)
+
+	var user User
+	query := `SELECT id, username, email, COALESCE(organization, ''), created_at, updated_at FROM users WHERE id = $1`
+	err := dbPool.QueryRow(ctx, query, claims.UserID()).Scan(&user.ID, &user.Username, &user.Email, &user.Organization, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	user.Roles, err = loadRoles(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load roles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func getUser(c *gin.Context) {
+	id := c.Param("id")
+
+	var user struct {
+		ID        int       `json:"id"`
+		Username  string    `json:"username"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	err := dbPool.QueryRow(ctx, `SELECT id, username, created_at FROM users WHERE id = $1`, id).Scan(&user.ID, &user.Username, &user.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// issueTokens reads the user's roles afresh, so that a refresh picks up any
+// role granted or revoked since the previous token was issued. Callers load
+// the organization in the same query that identifies the user.
+func issueTokens(c *gin.Context, user User) {
+	roles, err := loadRoles(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load roles"})
+		return
+	}
+	user.Roles = roles
+
+	accessToken, expiresAt, err := auth.Issue(jwtSecret, user.ID, user.Username, roles, user.Organization, accessTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue access token"})
+		return
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue refresh token"})
+		return
+	}
+
+	_, err = dbPool.Exec(ctx, `INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		user.ID, hashToken(refreshToken), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_at":    expiresAt,
+		"refresh_token": refreshToken,
+		"user":          user,
+	})
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func clientScope(c *gin.Context) string {
+	return "client:" + c.ClientIP()
+}
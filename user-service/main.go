@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"shared/auth"
+	"shared/idempotency"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	dbPool          *pgxpool.Pool
+	ctx             = context.Background()
+	jwtSecret       []byte
+	idempotencyKeys *idempotency.Store
+)
+
+func initDB() {
+	dbURL := os.Getenv("DATABASE_URL")
+	var err error
+	dbPool, err = pgxpool.Connect(ctx, dbURL)
+	if err != nil {
+		log.Fatalf("Unable to connect to database: %v\n", err)
+	}
+}
+
+func initJWT() {
+	var err error
+	jwtSecret, err = auth.SecretFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v\n", err)
+	}
+}
+
+func main() {
+	initDB()
+	idempotencyKeys = idempotency.NewStore(dbPool)
+	initJWT()
+	bootstrapAdmins()
+
+	defer dbPool.Close()
+
+	go idempotencyKeys.RunRetention(idempotency.RetentionFromEnv())
+
+	r := gin.Default()
+	r.Use(auth.Middleware(jwtSecret))
+
+	// Registration is anonymous, so keys are kept apart by client address.
+	r.POST("/auth/register", idempotencyKeys.Middleware(clientScope), register)
+	r.POST("/auth/login", login)
+	r.POST("/auth/refresh", refresh)
+	r.POST("/auth/logout", logout)
+
+	r.GET("/users/me", auth.RequireUser(), getCurrentUser)
+	r.GET("/users/:id", getUser)
+
+	r.GET("/roles", getRoleDefinitions)
+	r.GET("/users/:id/roles", auth.RequirePermission(auth.PermRolesManage), getUserRoles)
+	r.POST("/users/:id/roles", auth.RequirePermission(auth.PermRolesManage), grantRole)
+	r.DELETE("/users/:id/roles/:role", auth.RequirePermission(auth.PermRolesManage), revokeRole)
+	r.PUT("/users/:id/organization", auth.RequirePermission(auth.PermRolesManage), setOrganization)
+	r.DELETE("/users/:id/organization", auth.RequirePermission(auth.PermRolesManage), clearOrganization)
+
+	log.Println("User Service running on port 8080")
+	if err := r.Run(":8080"); err != nil {
+		log.Fatalf("Failed to run server: %v\n", err)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	Organization string    `json:"organization,omitempty"`
+	Roles        []string  `json:"roles,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type RoleGrant struct {
+	Role      string    `json:"role"`
+	GrantedBy *int      `json:"granted_by"`
+	GrantedAt time.Time `json:"granted_at"`
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"shared/auth"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxOrganizationLength = 100
+
+// setOrganization places a user in an organization, replacing any previous
+// one. Like roles, the change reaches access tokens on the next refresh.
+func setOrganization(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var request struct {
+		Organization string `json:"organization"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	organization := strings.TrimSpace(request.Organization)
+	if organization == "" || utf8.RuneCountInString(organization) > maxOrganizationLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "organization must be between 1 and 100 characters"})
+		return
+	}
+
+	tag, err := dbPool.Exec(ctx, `UPDATE users SET organization = $2, updated_at = NOW() WHERE id = $1`, userID, organization)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set organization"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	admin, _ := auth.User(c)
+	log.Printf("User %d placed user %d in organization %s\n", admin.UserID(), userID, organization)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "organization": organization})
+}
+
+func clearOrganization(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	tag, err := dbPool.Exec(ctx, `UPDATE users SET organization = NULL, updated_at = NOW() WHERE id = $1 AND organization IS NOT NULL`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear organization"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no organization"})
+		return
+	}
+
+	admin, _ := auth.User(c)
+	log.Printf("User %d removed user %d from their organization\n", admin.UserID(), userID)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"shared/auth"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func loadRoles(userID int) ([]string, error) {
+	rows, err := dbPool.Query(ctx, `SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func getRoleDefinitions(c *gin.Context) {
+	c.JSON(http.StatusOK, auth.Roles())
+}
+
+func getUserRoles(c *gin.Context) {
+	id := c.Param("id")
+
+	rows, err := dbPool.Query(ctx, `SELECT role, granted_by, granted_at FROM user_roles WHERE user_id = $1 ORDER BY role`, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch roles"})
+		return
+	}
+	defer rows.Close()
+
+	grants := []RoleGrant{}
+	for rows.Next() {
+		var grant RoleGrant
+		if err := rows.Scan(&grant.Role, &grant.GrantedBy, &grant.GrantedAt); err == nil {
+			grants = append(grants, grant)
+		}
+	}
+
+	c.JSON(http.StatusOK, grants)
+}
+
+func grantRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var request struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !auth.ValidRole(request.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role " + request.Role})
+		return
+	}
+
+	admin, _ := auth.User(c)
+
+	query := `INSERT INTO user_roles (user_id, role, granted_by)
+		SELECT id, $2, $3 FROM users WHERE id = $1
+		ON CONFLICT (user_id, role) DO NOTHING`
+	tag, err := dbPool.Exec(ctx, query, userID, request.Role, admin.UserID())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant role"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		dbPool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	log.Printf("User %d granted role %s to user %d\n", admin.UserID(), request.Role, userID)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "role": request.Role})
+}
+
+func revokeRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	role := c.Param("role")
+	admin, _ := auth.User(c)
+
+	// An administrator removing their own admin role could leave nobody able
+	// to grant it back.
+	if userID == admin.UserID() && role == auth.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Administrators cannot revoke their own admin role"})
+		return
+	}
+
+	tag, err := dbPool.Exec(ctx, `DELETE FROM user_roles WHERE user_id = $1 AND role = $2`, userID, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke role"})
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not granted"})
+		return
+	}
+
+	log.Printf("User %d revoked role %s from user %d\n", admin.UserID(), role, userID)
+	c.Status(http.StatusNoContent)
+}
+
+// bootstrapAdmins grants the admin role to the accounts listed in ADMIN_USERS
+// so that the first administrator does not need a manual database step:
+//
+//	ADMIN_USERS=alice,bob
+func bootstrapAdmins() {
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			continue
+		}
+
+		tag, err := dbPool.Exec(ctx, `INSERT INTO user_roles (user_id, role)
+			SELECT id, $2 FROM users WHERE username = $1
+			ON CONFLICT (user_id, role) DO NOTHING`, username, auth.RoleAdmin)
+		if err != nil {
+			log.Fatalf("Failed to grant admin role to %s: %v\n", username, err)
+		}
+		if tag.RowsAffected() > 0 {
+			log.Printf("Granted admin role to %s\n", username)
+		}
+	}
+}
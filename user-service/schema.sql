@@ -0,0 +1,46 @@
+CREATE TABLE users (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(50) NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    -- Set by administrators; competitions can allow every member of an
+    -- organization at once.
+    organization VARCHAR(100),
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE user_roles (
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role VARCHAR(50) NOT NULL,
+    granted_by INT REFERENCES users (id) ON DELETE SET NULL,
+    granted_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+-- Responses to requests sent with an Idempotency-Key, replayed when the
+-- request is retried. Rows are deleted after IDEMPOTENCY_RETENTION.
+CREATE TABLE idempotency_keys (
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    claim_token CHAR(32) NOT NULL,
+    status_code INT,
+    content_type TEXT,
+    response_body BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys (created_at);